@@ -0,0 +1,116 @@
+package registry
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+// auditRecord is a single entry in the audit log.
+type auditRecord struct {
+	Time       time.Time `json:"time"`
+	Identity   string    `json:"identity,omitempty"`
+	Addr       string    `json:"addr,omitempty"`
+	Operation  string    `json:"operation"`
+	Repository string    `json:"repository"`
+	Image      string    `json:"image"`
+	Reference  string    `json:"reference,omitempty"`
+	Digest     string    `json:"digest,omitempty"`
+	Status     int       `json:"status"`
+	Result     string    `json:"result"`
+}
+
+// statusRecorder is an http.ResponseWriter keeping track of the status sent to the client.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader records the status and passes it on.
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// Write records an implicit 200 status if none has been written yet.
+func (s *statusRecorder) Write(data []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(data)
+}
+
+// auditor writes audit records, as json lines, into the configured writer. All methods are
+// safe to be called on a nil reference, in such case they no-op.
+type auditor struct {
+	sync.Mutex
+	to io.Writer
+}
+
+// operation returns the name of the audited operation the request refers to or an empty string
+// if the request is not audited. Only mutating operations are audited.
+func (a *auditor) operation(request Request) string {
+	switch {
+	case a == nil:
+		return ""
+	case request.IsManifest() && request.IsPut():
+		return "push-manifest"
+	case request.IsUploadFinalize():
+		return "push-blob"
+	case request.IsUploadChunk() && request.Get("digest") != "":
+		return "push-blob"
+	case request.IsDelete() && !request.HasBlobUploadID():
+		return "delete"
+	case request.IsTagHistory() && request.IsPost():
+		return "rollback-tag"
+	}
+	return ""
+}
+
+// record writes down an audit record for the provided request and response.
+func (a *auditor) record(request Request, op string, resp *statusRecorder) {
+	if a == nil {
+		return
+	}
+
+	repo, image, _ := request.RepositoryAndImage()
+	info, _ := ClientInfoFromContext(request.Context())
+	rec := auditRecord{
+		Time:       time.Now().UTC(),
+		Identity:   info.Identity,
+		Addr:       info.Addr,
+		Operation:  op,
+		Repository: repo,
+		Image:      image,
+		Reference:  request.last(),
+		Digest:     resp.Header().Get("docker-content-digest"),
+		Status:     resp.status,
+		Result:     "success",
+	}
+
+	if request.IsBlob() {
+		rec.Reference = ""
+		rec.Digest = request.UploadDigest()
+	}
+
+	if request.IsTagHistory() {
+		rec.Repository, rec.Image, rec.Reference, _, _ = historyPath(request)
+		rec.Digest = request.UploadDigest()
+	}
+
+	if resp.status >= http.StatusBadRequest {
+		rec.Result = "failure"
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	if err := json.NewEncoder(a.to).Encode(rec); err != nil {
+		klog.Errorf("unable to write audit record: %s", err)
+	}
+}
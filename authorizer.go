@@ -0,0 +1,59 @@
+package registry
+
+import "context"
+
+// StaticAuthorizer is an Authorizer that always returns the same decision. If Err is nil every
+// authentication succeeds (returning Token) and every request is authorized, otherwise Err is
+// returned for all of them. Useful when spinning up a registry in tests and examples.
+type StaticAuthorizer struct {
+	Token string
+	Err   *Error
+}
+
+// Authenticate returns the static token or the static error.
+func (s StaticAuthorizer) Authenticate(context.Context, Request) (string, *Error) {
+	if s.Err != nil {
+		return "", s.Err
+	}
+	return s.Token, nil
+}
+
+// Authorize returns the static error, nil means the request is authorized.
+func (s StaticAuthorizer) Authorize(context.Context, Request) *Error {
+	return s.Err
+}
+
+// AllowAllAuthorizer returns an Authorizer that authenticates and authorizes everybody. The
+// provided token is handed to every client requesting authentication.
+func AllowAllAuthorizer(token string) StaticAuthorizer {
+	return StaticAuthorizer{Token: token}
+}
+
+// DenyAllAuthorizer returns an Authorizer that refuses every authentication and authorization
+// with ErrUnauthorized.
+func DenyAllAuthorizer() StaticAuthorizer {
+	return StaticAuthorizer{Err: ErrUnauthorized}
+}
+
+// FuncAuthorizer is an Authorizer that delegates to the provided closures. A nil closure makes
+// the respective call fail with ErrUnauthorized.
+type FuncAuthorizer struct {
+	AuthenticateFunc func(context.Context, Request) (string, *Error)
+	AuthorizeFunc    func(context.Context, Request) *Error
+}
+
+// Authenticate calls AuthenticateFunc.
+func (f FuncAuthorizer) Authenticate(ctx context.Context, request Request) (string, *Error) {
+	if f.AuthenticateFunc == nil {
+		return "", ErrUnauthorized
+	}
+	return f.AuthenticateFunc(ctx, request)
+}
+
+// Authorize calls AuthorizeFunc.
+func (f FuncAuthorizer) Authorize(ctx context.Context, request Request) *Error {
+	if f.AuthorizeFunc == nil {
+		return ErrUnauthorized
+	}
+	return f.AuthorizeFunc(ctx, request)
+}
@@ -6,24 +6,102 @@ import (
 	"io"
 	"net/http"
 	"os"
-	"strings"
+	"path"
 	"time"
 
 	"k8s.io/klog"
 )
 
+// rangeable returns true if blobs read from the provided storage can be served in ranges, i.e.
+// if the storage returns seekable blobs. Unknown storages are assumed not to.
+func rangeable(storage Storage) bool {
+	_, ok := diskStorage(storage)
+	return ok
+}
+
+// diskStorage returns the on disk storage blobs are read from, if any. Storages transforming
+// blob content on the way (e.g. encryption) never qualify.
+func diskStorage(storage Storage) (*StorageHandler, bool) {
+	switch s := storage.(type) {
+	case *StorageHandler:
+		return s, true
+	case *FallbackStorage:
+		return diskStorage(s.reader())
+	default:
+		return nil, false
+	}
+}
+
+// uploadRange returns the value for the range header for an upload of the provided size. Range
+// ends are inclusive so for an upload of 10 bytes "0-9" is returned.
+func uploadRange(size int64) string {
+	if size == 0 {
+		return "0-0"
+	}
+	return fmt.Sprintf("0-%d", size-1)
+}
+
 // NewBlobHandler returns a new http handler for blob operations.
-func NewBlobHandler(sthandler *StorageHandler) *BlobHandler {
+func NewBlobHandler(sthandler Storage) *BlobHandler {
 	return &BlobHandler{
-		upload:  NewUploadHandler(),
-		storage: sthandler,
+		upload:   NewUploadHandler(),
+		storage:  sthandler,
+		deadline: 20 * time.Minute,
 	}
 }
 
+// BlobServeStrategy determines how blob content is handed to clients. By default blobs are
+// streamed through the registry process (BlobServeStream).
+type BlobServeStrategy struct {
+	accel string
+}
+
+// BlobServeStream makes the registry stream blob content to clients.
+var BlobServeStream = BlobServeStrategy{}
+
+// BlobServeAccel makes the registry reply blob requests with an empty body and a
+// X-Accel-Redirect header pointing to the blob path under the provided location, leaving to a
+// reverse proxy (nginx) the task of serving the file. The location must be an internal nginx
+// location aliasing the storage base directory. Only applies if the storage exposes the blob
+// paths (see BlobPather), blobs are streamed otherwise.
+func BlobServeAccel(location string) BlobServeStrategy {
+	return BlobServeStrategy{accel: location}
+}
+
 // BlobHandler handles all blob related operations.
 type BlobHandler struct {
-	upload  *UploadHandler
-	storage *StorageHandler
+	upload   *UploadHandler
+	storage  Storage
+	events   *events
+	strategy BlobServeStrategy
+	minchunk int64
+	readers  chan struct{}
+	deadline time.Duration
+	authzer  Authorizer
+}
+
+// accelRedirect replies the request with a X-Accel-Redirect header pointing to the blob. Returns
+// false if the storage does not expose blob paths, in this case nothing is written.
+func (b *BlobHandler) accelRedirect(resp http.ResponseWriter, repo, image, hash string) bool {
+	pather, ok := b.storage.(BlobPather)
+	if !ok {
+		return false
+	}
+
+	if _, err := b.storage.StatBlob(repo, image, hash); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			ErrUnknownBlob.Write(resp)
+			return true
+		}
+		klog.Errorf("unable to stat blob: %s", err)
+		ErrInternal(err).Write(resp)
+		return true
+	}
+
+	location := path.Join(b.strategy.accel, pather.BlobPath(repo, image, hash))
+	resp.Header().Set("x-accel-redirect", location)
+	resp.WriteHeader(http.StatusOK)
+	return true
 }
 
 // Stat verifies if the blob already exists in our storage.
@@ -31,59 +109,241 @@ func (b *BlobHandler) Stat(resp http.ResponseWriter, request Request) {
 	repo, img, err := request.RepositoryAndImage()
 	if err != nil {
 		klog.Errorf("error fetching repo/image: %s", err)
-		ErrInternal(err).Write(resp)
+		ErrNameInvalid.Write(resp)
 		return
 	}
 
 	hash := request.BlobHash()
 	size, err := b.storage.StatBlob(repo, img, hash)
-	if err != nil && !os.IsNotExist(err) {
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
 		klog.Errorf("unable to stat blob: %s", err)
 		ErrInternal(err).Write(resp)
 		return
 	}
 
-	if os.IsNotExist(err) {
+	if errors.Is(err, os.ErrNotExist) {
 		ErrUnknownBlob.Write(resp)
 		return
 	}
 
-	trimhash := strings.TrimPrefix(hash, "sha256:")
+	if rangeable(b.storage) {
+		resp.Header().Set("accept-ranges", "bytes")
+	}
 	resp.Header().Set("content-length", fmt.Sprint(size))
-	resp.Header().Set("docker-content-digest", trimhash)
+	resp.Header().Set("docker-content-digest", hash)
 	resp.WriteHeader(http.StatusOK)
 }
 
+// uploadHeaders sets the headers describing an upload in progress: its location, the range
+// of bytes already uploaded and its id.
+func (b *BlobHandler) uploadHeaders(resp http.ResponseWriter, repo, image, id string) {
+	newloc := fmt.Sprintf("/v2/%s/%s/blobs/uploads/%s", repo, image, id)
+	resp.Header().Set("location", newloc)
+	resp.Header().Set("range", uploadRange(b.upload.Size(id)))
+	resp.Header().Set("docker-upload-uuid", id)
+}
+
+// UploadStatus replies with the status of an upload in progress so clients can resume it.
+func (b *BlobHandler) UploadStatus(resp http.ResponseWriter, request Request) {
+	repo, img, err := request.RepositoryAndImage()
+	if err != nil {
+		klog.Errorf("unable to parse repo/image: %s", err)
+		ErrNameInvalid.Write(resp)
+		return
+	}
+
+	id := request.UploadID()
+	if err := b.upload.isValid(id); err != nil {
+		klog.Errorf("invalid upload status request: %s", err)
+		ErrUploadUnknown.Write(resp)
+		return
+	}
+
+	if !b.upload.belongsTo(id, repo, img) {
+		klog.Errorf("upload %s does not belong to %s/%s", id, repo, img)
+		ErrUploadInvalid.Write(resp)
+		return
+	}
+
+	b.uploadHeaders(resp, repo, img, id)
+	resp.WriteHeader(http.StatusNoContent)
+}
+
 // StartBlobUpload returns a temporary url where a blob upload can take place. Return a
 // Location header to be followed by the client when uploading the blob.
 func (b *BlobHandler) StartBlobUpload(resp http.ResponseWriter, request Request) {
 	repo, img, err := request.RepositoryAndImage()
 	if err != nil {
 		klog.Errorf("error parsing image/repo for upload: %s", err)
-		ErrInternal(err).Write(resp)
+		ErrNameInvalid.Write(resp)
 		return
 	}
 
-	id := b.upload.Start(20 * time.Minute)
-	newloc := fmt.Sprintf("/v2/%s/%s/blobs/upload/id/%s", repo, img, id)
-	resp.Header().Set("location", newloc)
-	resp.Header().Set("range", "0-0")
+	if hash := normalizeDigest(request.Get("mount")); hash != "" && b.mount(request, repo, img, hash) {
+		resp.Header().Set("location", fmt.Sprintf("/v2/%s/%s/blobs/%s", repo, img, hash))
+		resp.Header().Set("docker-content-digest", hash)
+		resp.WriteHeader(http.StatusCreated)
+		return
+	}
+
+	id, err := b.upload.Start(b.deadline, request.ClientID(), repo, img)
+	if err != nil {
+		klog.Errorf("unable to start upload: %s", err)
+		ErrUnavailable.Write(resp)
+		return
+	}
+
+	b.uploadHeaders(resp, repo, img, id)
 	resp.WriteHeader(http.StatusAccepted)
 }
 
+// mount attempts to satisfy a cross repository blob mount by copying the blob from the source
+// given in the 'from' query parameter or, if the blob is not there, from any repository holding
+// it. When the Authorizer has set a namespace for the request only the namespace is searched.
+// Blobs are only copied from sources the client is allowed to pull from, see canPull. Returns
+// false if the blob could not be mounted, the client is then expected to upload it.
+func (b *BlobHandler) mount(request Request, repo, image, hash string) bool {
+	if !validDigest(hash) {
+		return false
+	}
+
+	if _, err := b.storage.StatBlob(repo, image, hash); err == nil {
+		return true
+	}
+
+	srcrepo, srcimage, found := request.MountSource()
+	if found {
+		if _, err := b.storage.StatBlob(srcrepo, srcimage, hash); err != nil {
+			found = false
+		} else {
+			found = b.canPull(request, srcrepo, srcimage, hash)
+		}
+	}
+
+	_, nsok := NamespaceFromContext(request.Context())
+	if locator, ok := b.storage.(BlobLocator); ok && !found && !nsok {
+		srcrepo, srcimage, found = locator.BlobExistsAnywhere(hash)
+		found = found && b.canPull(request, srcrepo, srcimage, hash)
+	}
+
+	if !found {
+		return false
+	}
+
+	blob, _, err := b.storage.GetBlob(srcrepo, srcimage, hash)
+	if err != nil {
+		klog.Errorf("unable to read blob to mount: %s", err)
+		return false
+	}
+	defer blob.Close()
+
+	created := b.events.isNewImage(b.storage, repo, image)
+	if err := b.storage.PutBlob(repo, image, hash, blob); err != nil {
+		klog.Errorf("unable to mount blob: %s", err)
+		return false
+	}
+
+	if created {
+		if err := b.events.fireNewRepository(request.Context(), repo, image); err != nil {
+			klog.Errorf("event handler failed: %s", err)
+		}
+	}
+
+	if err := b.events.fireNewBlob(request.Context(), repo, image, hash); err != nil {
+		klog.Errorf("event handler failed: %s", err)
+	}
+
+	klog.Infof("mounted blob %s/%s@%s from %s/%s", repo, image, hash, srcrepo, srcimage)
+	return true
+}
+
+// canPull returns true if the Authorizer allows the client issuing the provided request to pull
+// the blob from the provided repository and image. The Authorizer is asked about a blob pull
+// carrying the same credentials as the request.
+func (b *BlobHandler) canPull(request Request, repo, image, hash string) bool {
+	if b.authzer == nil {
+		return true
+	}
+
+	ctx := withNamespaceHolder(request.Context())
+	path := fmt.Sprintf("/v2/%s/%s/blobs/%s", repo, image, hash)
+	pull, err := http.NewRequestWithContext(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		klog.Errorf("unable to create pull request for mount: %s", err)
+		return false
+	}
+	pull.Header = request.Header.Clone()
+	pull.Host = request.Host
+	pull.RemoteAddr = request.RemoteAddr
+
+	if err := b.authzer.Authorize(ctx, Request{pull}); err != nil {
+		klog.Infof("not mounting %s from %s/%s: %s", hash, repo, image, err.Message)
+		return false
+	}
+	return true
+}
+
 // Get returns a blob by its hash (sha256).
 func (b *BlobHandler) Get(resp http.ResponseWriter, request Request) {
 	hash := request.BlobHash()
 	repo, image, err := request.RepositoryAndImage()
 	if err != nil {
 		klog.Errorf("unable to parse repo/image: %s", err)
-		ErrInternal(err).Write(resp)
+		ErrNameInvalid.Write(resp)
+		return
+	}
+
+	// blobs never change so it is always safe to tell clients their copy is up to date.
+	if modtime, err := b.storage.BlobModTime(repo, image, hash); err == nil {
+		resp.Header().Set("last-modified", modtime.UTC().Format(http.TimeFormat))
+		since, err := http.ParseTime(request.Header.Get("if-modified-since"))
+		if err == nil && !modtime.Truncate(time.Second).After(since) {
+			resp.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	if b.strategy.accel != "" && b.accelRedirect(resp, repo, image, hash) {
+		return
+	}
+
+	// when the number of concurrent reads is capped we shed load right away instead of
+	// queueing, clients are expected to retry.
+	if b.readers != nil {
+		select {
+		case b.readers <- struct{}{}:
+			defer func() { <-b.readers }()
+		default:
+			klog.Errorf("too many concurrent blob reads, refusing %s/%s@%s", repo, image, hash)
+			ErrTooManyRequests.WithHeader("retry-after", "1").Write(resp)
+			return
+		}
+	}
+
+	// blobs kept on disk are read through a file shared by all concurrent readers, each
+	// request reads its own ranges through a section reader.
+	if disk, ok := diskStorage(b.storage); ok {
+		reader, size, err := disk.blobReaderAt(repo, image, hash)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				ErrUnknownBlob.Write(resp)
+				return
+			}
+			klog.Errorf("unable to get blob: %s", err)
+			ErrInternal(err).Write(resp)
+			return
+		}
+		defer reader.Close()
+
+		resp.Header().Set("content-type", "application/octet-stream")
+		section := io.NewSectionReader(reader, 0, size)
+		http.ServeContent(resp, request.Request, "", time.Time{}, section)
 		return
 	}
 
 	fp, fsize, err := b.storage.GetBlob(repo, image, hash)
 	if err != nil {
-		if err := errors.Unwrap(err); os.IsNotExist(err) {
+		if errors.Is(err, os.ErrNotExist) {
 			ErrUnknownBlob.Write(resp)
 			return
 		}
@@ -93,88 +353,218 @@ func (b *BlobHandler) Get(resp http.ResponseWriter, request Request) {
 	}
 	defer fp.Close()
 
+	// if the blob can be seeked we let the standard library serve it, it takes care of
+	// range requests and advertises them through the accept-ranges header.
+	if seeker, ok := fp.(io.ReadSeeker); ok {
+		resp.Header().Set("content-type", "application/octet-stream")
+		http.ServeContent(resp, request.Request, "", time.Time{}, seeker)
+		return
+	}
+
 	resp.Header().Add("content-length", fmt.Sprint(fsize))
 	if _, err := io.Copy(resp, fp); err != nil {
+		if isClientDisconnect(err) {
+			klog.Infof("client went away while copying blob: %s", err)
+			return
+		}
 		klog.Errorf("error copying blob: %s", err)
 	}
 }
 
+// CancelBlobUpload cancels an upload session, any content uploaded so far is discarded.
+func (b *BlobHandler) CancelBlobUpload(resp http.ResponseWriter, request Request) {
+	id := request.UploadID()
+	if len(id) == 0 {
+		klog.Errorf("invalid request: empty upload id")
+		ErrUploadInvalid.Write(resp)
+		return
+	}
+
+	repo, img, err := request.RepositoryAndImage()
+	if err != nil {
+		klog.Errorf("unable to parse repo/image: %s", err)
+		ErrNameInvalid.Write(resp)
+		return
+	}
+
+	if !b.upload.belongsTo(id, repo, img) {
+		klog.Errorf("upload %s does not belong to %s/%s", id, repo, img)
+		ErrUploadInvalid.Write(resp)
+		return
+	}
+
+	b.upload.Delete(id)
+	writeDeleted(resp)
+}
+
 // UploadBlob manages blob upload requests. This function is called when there is something
-// being uploaded by the client. We expect to find a valid upload 'id' in the url.
+// being uploaded by the client (PATCH) or when the client wants to finalize the upload (PUT or
+// PATCH with a digest). We expect to find a valid upload 'id' in the url.
 func (b *BlobHandler) UploadBlob(resp http.ResponseWriter, request Request) {
 	id := request.UploadID()
 	if len(id) == 0 {
-		err := fmt.Errorf("empty upload id")
-		klog.Errorf("invalid request: %s", err)
-		ErrInternal(err).Write(resp)
+		klog.Errorf("invalid request: empty upload id")
+		ErrUploadInvalid.Write(resp)
 		return
 	}
 
 	repo, img, err := request.RepositoryAndImage()
 	if err != nil {
 		klog.Errorf("unable to parse repo/image: %s", err)
-		ErrInternal(err).Write(resp)
+		ErrNameInvalid.Write(resp)
 		return
 	}
 
-	if request.IsDelete() {
-		b.upload.Delete(id)
-		resp.WriteHeader(http.StatusOK)
+	if !b.upload.belongsTo(id, repo, img) {
+		klog.Errorf("upload %s does not belong to %s/%s", id, repo, img)
+		ErrUploadInvalid.Write(resp)
 		return
 	}
 
-	written, err := b.upload.Append(id, request.Body)
+	// chunks are accounted for (see chunk and smallChunk) before they are appended, so the
+	// upload must be known beforehand.
+	if err := b.upload.isValid(id); err != nil {
+		klog.Errorf("invalid upload %s: %s", id, err)
+		ErrUploadUnknown.Write(resp)
+		return
+	}
+
+	// chunks must start where the upload stands, the range header tells the client where
+	// that is so it can resume from there.
+	if offset, ok, err := request.UploadOffset(); ok {
+		if size := b.upload.Size(id); err != nil || offset != size {
+			klog.Errorf("upload %s chunk out of order: %q, upload size %d", id, request.Header.Get("content-range"), size)
+			b.uploadHeaders(resp, repo, img, id)
+			ErrRangeInvalid.Write(resp)
+			return
+		}
+	}
+
+	if request.IsUploadChunk() && !b.upload.chunk(id) {
+		klog.Errorf("upload %s exceeded the maximum number of chunks", id)
+		ErrUploadInvalid.Write(resp)
+		return
+	}
+
+	// only non final chunks are subject to the minimum size. as clients may finalize uploads
+	// with an empty put we can't tell which patch is the last one, so one small chunk is
+	// tolerated per upload. if the client told us the chunk size we refuse it before reading
+	// anything.
+	partial := request.IsUploadChunk() && request.Get("digest") == ""
+	small := partial && request.ContentLength >= 0 && request.ContentLength < b.minchunk
+	if small && b.upload.smallChunk(id) {
+		klog.Errorf("upload chunk too small: %d bytes", request.ContentLength)
+		ErrRangeInvalid.Write(resp)
+		return
+	}
+
+	written, err := b.upload.Append(request.Context(), id, request.Body)
 	if err != nil {
 		klog.Errorf("error append to upload file: %s", err)
-		ErrInternal(err).Write(resp)
+		switch {
+		case errors.Is(err, errUploadUnknown):
+			ErrUploadUnknown.Write(resp)
+		case errors.Is(err, errQuotaExceeded):
+			ErrQuotaExceeded.Write(resp)
+		default:
+			ErrInternal(err).Write(resp)
+		}
 		return
 	}
 
-	newloc := fmt.Sprintf("/v2/%s/%s/blobs/upload/id/%s", repo, img, id)
-	resp.Header().Set("location", newloc)
-	resp.Header().Set("range", fmt.Sprintf("0-%d", written))
+	b.uploadHeaders(resp, repo, img, id)
+
+	if partial && !small && written < b.minchunk && b.upload.smallChunk(id) {
+		// the chunk has already been appended, the range header tells the client where
+		// the upload stands.
+		klog.Errorf("upload chunk too small: %d bytes", written)
+		ErrRangeInvalid.Write(resp)
+		return
+	}
 
-	if request.IsPatch() {
+	if partial {
 		// if the method is patch we still expect more slices of bytes coming our way
-		// during the next requests, just return StatusNoContent.
+		// during the next requests, just return StatusNoContent. A patch carrying the
+		// digest is the last chunk and we finalize the upload as if it was a put.
 		resp.WriteHeader(http.StatusNoContent)
 		return
 	}
 
+	expdgst := request.UploadDigest()
+	if expdgst == "" {
+		klog.Errorf("invalid request: empty digest provided during upload")
+		ErrUploadInvalid.Write(resp)
+		return
+	}
+
+	if !validDigest(expdgst) {
+		klog.Errorf("invalid request: invalid digest %q provided during upload", expdgst)
+		ErrDigestInvalid.Write(resp)
+		return
+	}
+
+	// with stream validation the content has been hashed as it arrived so a bad upload can
+	// be refused before it is committed. the storage still verifies the digest on its own.
+	if dgst, ok := b.upload.Digest(id); ok && dgst != expdgst {
+		klog.Errorf("upload %s digest mismatch: expected %s, got %s", id, expdgst, dgst)
+		b.upload.Delete(id)
+		digestMismatch(expdgst, dgst).Write(resp)
+		return
+	}
+
 	fp, err := b.upload.End(id)
 	if err != nil {
 		klog.Errorf("unable to commit uploaded file: %s", err)
+		if errors.Is(err, errUploadUnknown) {
+			ErrUploadUnknown.Write(resp)
+			return
+		}
 		ErrInternal(err).Write(resp)
 		return
 	}
 	defer fp.Close()
 
-	expdgst := request.Get("digest")
-	if expdgst == "" {
-		err := fmt.Errorf("empty digest provided during upload")
-		klog.Errorf("invalid request: %s", err)
-		ErrInternal(err).Write(resp)
+	created := b.events.isNewImage(b.storage, repo, img)
+	if err := b.storage.PutBlob(repo, img, expdgst, fp); err != nil {
+		klog.Errorf("error commiting blob to storage: %s", err)
+		writeStorageError(resp, err)
 		return
 	}
 
-	if err := b.storage.PutBlob(repo, img, expdgst, fp); err != nil {
-		klog.Errorf("error commiting blob to storage: %s", err)
+	if created {
+		if err := b.events.fireNewRepository(request.Context(), repo, img); err != nil {
+			klog.Errorf("event handler failed: %s", err)
+			ErrInternal(err).Write(resp)
+			return
+		}
+	}
+
+	if err := b.events.fireNewBlob(request.Context(), repo, img, expdgst); err != nil {
+		klog.Errorf("event handler failed: %s", err)
 		ErrInternal(err).Write(resp)
+		return
 	}
 	klog.Infof("new blob upload %s/%s@%s", repo, img, expdgst)
 	resp.WriteHeader(http.StatusCreated)
 }
 
+// ServeHTTP is our http handler for blob related requests. Each phase of a blob upload maps to
+// a single branch here: start (POST), chunk (PATCH), finalize (PUT), cancel (DELETE) and
+// status (GET).
 func (b *BlobHandler) ServeHTTP(resp http.ResponseWriter, request Request) {
 	switch {
+	case request.IsUploadStart():
+		b.StartBlobUpload(resp, request)
+	case request.IsUploadChunk(), request.IsUploadFinalize():
+		b.UploadBlob(resp, request)
+	case request.IsUploadCancel():
+		b.CancelBlobUpload(resp, request)
+	case request.IsUploadStatus():
+		b.UploadStatus(resp, request)
 	case request.IsHead():
 		b.Stat(resp, request)
 	case request.IsGet():
 		b.Get(resp, request)
-	case request.HasBlobUploadID():
-		b.UploadBlob(resp, request)
-	case request.IsBlobUploadRequest():
-		b.StartBlobUpload(resp, request)
 	default:
 		ErrUnsupported.Write(resp)
 	}
@@ -0,0 +1,446 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMountRequiresPullAccess(t *testing.T) {
+	// pulls from the "private" repository are refused, everything else is allowed.
+	authzer := FuncAuthorizer{
+		AuthorizeFunc: func(_ context.Context, request Request) *Error {
+			if request.Method == http.MethodGet && strings.HasPrefix(request.URL.Path, "/v2/private/") {
+				return ErrUnauthorized
+			}
+			return nil
+		},
+	}
+
+	for _, tt := range []struct {
+		name   string
+		from   string
+		status int
+	}{
+		{name: "allowed source", from: "public/image", status: http.StatusCreated},
+		{name: "denied source", from: "private/image", status: http.StatusAccepted},
+		{name: "denied source found anywhere", from: "", status: http.StatusAccepted},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			server, reg := newTestServer(t)
+			reg.authzer, reg.blobhdr.authzer = authzer, authzer
+
+			content := []byte("layer " + tt.name)
+			if tt.from == "public/image" {
+				pushBlob(t, server, "public", "image", content)
+			}
+			hash := pushBlob(t, server, "private", "image", content)
+
+			url := server.URL + "/v2/mine/image/blobs/uploads/?mount=" + hash
+			if tt.from != "" {
+				url += "&from=" + tt.from
+			}
+
+			resp, err := http.Post(url, "", nil)
+			if err != nil {
+				t.Fatalf("unable to mount: %s", err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.status {
+				t.Errorf("expected status %d, got %d", tt.status, resp.StatusCode)
+			}
+
+			_, err = reg.storage.StatBlob("mine", "image", hash)
+			if mounted := err == nil; mounted != (tt.status == http.StatusCreated) {
+				t.Errorf("unexpected mount state: mounted %v", mounted)
+			}
+		})
+	}
+}
+
+func TestSmallChunks(t *testing.T) {
+	server, reg := newTestServer(t, WithMinChunkSize(1024))
+
+	resp, _ := do(t, server, http.MethodPost, "/v2/repo/image/blobs/uploads/", "", nil)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("unexpected status starting upload: %d", resp.StatusCode)
+	}
+	location := resp.Header.Get("location")
+
+	if resp, body := do(t, server, http.MethodPatch, location, "", []byte("small")); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("first small chunk refused: %d: %s", resp.StatusCode, body)
+	}
+
+	if resp, body := do(t, server, http.MethodPatch, location, "", []byte("small")); resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("second small chunk not refused: %d: %s", resp.StatusCode, body)
+	}
+
+	unknown := "/v2/repo/image/blobs/uploads/00000000-0000-0000-0000-000000000000"
+	for i := 0; i < 3; i++ {
+		if resp, body := do(t, server, http.MethodPatch, unknown, "", []byte("small")); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("small chunk to unknown upload: unexpected reply %d: %s", resp.StatusCode, body)
+		}
+	}
+
+	if resp, _ := do(t, server, http.MethodDelete, location, "", nil); resp.StatusCode != http.StatusAccepted {
+		t.Errorf("unable to cancel upload: %d", resp.StatusCode)
+	}
+
+	uploads := reg.blobhdr.upload
+	uploads.Lock()
+	defer uploads.Unlock()
+	if len(uploads.smalls) != 0 || len(uploads.chunks) != 0 {
+		t.Errorf("chunk accounting left behind: %v %v", uploads.smalls, uploads.chunks)
+	}
+}
+
+func TestMonolithicPut(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		opts []Option
+	}{
+		{name: "on disk"},
+		{name: "in memory", opts: []Option{WithInMemoryUploadThreshold(1024)}},
+		{name: "min chunk size", opts: []Option{WithMinChunkSize(1024)}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			server, _ := newTestServer(t, tt.opts...)
+
+			content := []byte("monolithic blob content")
+			hash := pushBlob(t, server, "repo", "image", content)
+			if hash != DigestOf(content).String() {
+				t.Fatalf("unexpected digest %s", hash)
+			}
+
+			resp, body := do(t, server, http.MethodGet, "/v2/repo/image/blobs/"+hash, "", nil)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("unexpected status reading blob: %d: %s", resp.StatusCode, body)
+			}
+
+			if string(body) != string(content) {
+				t.Errorf("expected blob content %q, got %q", content, body)
+			}
+		})
+	}
+}
+
+func TestUploadRangeInvalid(t *testing.T) {
+	server, _ := newTestServer(t)
+
+	resp, _ := do(t, server, http.MethodPost, "/v2/repo/image/blobs/uploads/", "", nil)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("unexpected status starting upload: %d", resp.StatusCode)
+	}
+	location := resp.Header.Get("location")
+	uuid := resp.Header.Get("docker-upload-uuid")
+
+	patch := func(crange string, chunk []byte) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPatch, server.URL+location, bytes.NewReader(chunk))
+		if err != nil {
+			t.Fatalf("unable to create request: %s", err)
+		}
+		req.Header.Set("content-range", crange)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unable to send chunk: %s", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	if resp := patch("0-9", []byte("0123456789")); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("first chunk refused: %d", resp.StatusCode)
+	}
+
+	for _, crange := range []string{"20-29", "0-9", "garbage"} {
+		resp := patch(crange, []byte("abcdefghij"))
+		if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+			t.Errorf("%s: expected status %d, got %d", crange, http.StatusRequestedRangeNotSatisfiable, resp.StatusCode)
+			continue
+		}
+
+		if rng := resp.Header.Get("range"); rng != "0-9" {
+			t.Errorf("%s: expected range 0-9, got %q", crange, rng)
+		}
+
+		if got := resp.Header.Get("docker-upload-uuid"); got == "" || got != uuid {
+			t.Errorf("%s: expected upload uuid %q, got %q", crange, uuid, got)
+		}
+	}
+
+	if resp := patch("10-19", []byte("abcdefghij")); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("chunk at the committed offset refused: %d", resp.StatusCode)
+	}
+}
+
+func TestPatchWithDigest(t *testing.T) {
+	server, reg := newTestServer(t)
+
+	start := func() string {
+		t.Helper()
+		resp, _ := do(t, server, http.MethodPost, "/v2/repo/image/blobs/uploads/", "", nil)
+		if resp.StatusCode != http.StatusAccepted {
+			t.Fatalf("unexpected status starting upload: %d", resp.StatusCode)
+		}
+		return resp.Header.Get("location")
+	}
+
+	content := []byte("single chunk blob")
+	hash := DigestOf(content).String()
+	resp, body := do(t, server, http.MethodPatch, start()+"?digest="+hash, "", content)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, resp.StatusCode, body)
+	}
+
+	if _, err := reg.storage.StatBlob("repo", "image", hash); err != nil {
+		t.Errorf("blob not stored: %s", err)
+	}
+
+	resp, body = do(t, server, http.MethodPatch, start(), "", content)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusNoContent, resp.StatusCode, body)
+	}
+
+	if size := reg.blobhdr.upload.Size(resp.Header.Get("docker-upload-uuid")); size != int64(len(content)) {
+		t.Errorf("expected the upload to hold %d bytes, got %d", len(content), size)
+	}
+}
+
+func TestUploadRangeCumulative(t *testing.T) {
+	server, _ := newTestServer(t)
+
+	resp, _ := do(t, server, http.MethodPost, "/v2/repo/image/blobs/uploads/", "", nil)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("unexpected status starting upload: %d", resp.StatusCode)
+	}
+	location := resp.Header.Get("location")
+
+	for _, expected := range []string{"0-4", "0-9", "0-14"} {
+		resp, body := do(t, server, http.MethodPatch, location, "", []byte("chunk"))
+		if resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("chunk refused: %d: %s", resp.StatusCode, body)
+		}
+
+		if rng := resp.Header.Get("range"); rng != expected {
+			t.Errorf("expected range %s, got %s", expected, rng)
+		}
+	}
+
+	resp, _ = do(t, server, http.MethodGet, location, "", nil)
+	if rng := resp.Header.Get("range"); rng != "0-14" {
+		t.Errorf("expected upload status range 0-14, got %s", rng)
+	}
+}
+
+func TestUploadExpired(t *testing.T) {
+	server, reg := newTestServer(t)
+
+	resp, _ := do(t, server, http.MethodPost, "/v2/repo/image/blobs/uploads/", "", nil)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("unexpected status starting upload: %d", resp.StatusCode)
+	}
+	location := resp.Header.Get("location")
+	id := resp.Header.Get("docker-upload-uuid")
+
+	other := strings.Replace(location, "/repo/image/", "/repo/other/", 1)
+	resp, body := do(t, server, http.MethodPatch, other, "", []byte("data"))
+	if resp.StatusCode != ErrUploadInvalid.Status || !strings.Contains(string(body), ErrUploadInvalid.Code) {
+		t.Errorf("upload of another image: unexpected reply %d: %s", resp.StatusCode, body)
+	}
+
+	uploads := reg.blobhdr.upload
+	uploads.Lock()
+	uploads.active[id] = time.Now().Add(-time.Second)
+	uploads.Unlock()
+
+	finalize := location + "?digest=" + DigestOf([]byte("data")).String()
+	for method, path := range map[string]string{http.MethodPatch: location, http.MethodPut: finalize} {
+		resp, body := do(t, server, method, path, "", []byte("data"))
+		if resp.StatusCode != http.StatusNotFound || !strings.Contains(string(body), ErrUploadUnknown.Code) {
+			t.Errorf("%s to expired upload: unexpected reply %d: %s", method, resp.StatusCode, body)
+		}
+	}
+}
+
+func TestUploadPathForms(t *testing.T) {
+	server, reg := newTestServer(t)
+
+	for _, legacy := range []bool{false, true} {
+		resp, _ := do(t, server, http.MethodPost, "/v2/repo/image/blobs/uploads/", "", nil)
+		if resp.StatusCode != http.StatusAccepted {
+			t.Fatalf("unexpected status starting upload: %d", resp.StatusCode)
+		}
+
+		id := resp.Header.Get("docker-upload-uuid")
+		location := resp.Header.Get("location")
+		if location != "/v2/repo/image/blobs/uploads/"+id {
+			t.Errorf("unexpected upload location %s", location)
+		}
+
+		if legacy {
+			location = "/v2/repo/image/blobs/upload/id/" + id
+		}
+
+		content := []byte("upload through " + location)
+		if resp, body := do(t, server, http.MethodPatch, location, "", content); resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("%s: chunk refused: %d: %s", location, resp.StatusCode, body)
+		}
+
+		hash := DigestOf(content).String()
+		if resp, body := do(t, server, http.MethodPut, location+"?digest="+hash, "", nil); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("%s: unable to finalize: %d: %s", location, resp.StatusCode, body)
+		}
+
+		if _, err := reg.storage.StatBlob("repo", "image", hash); err != nil {
+			t.Errorf("%s: blob not stored: %s", location, err)
+		}
+	}
+}
+
+// BenchmarkPullStorm pulls the same blob from many concurrent clients, with and without a cap
+// on concurrent blob reads, reporting the fraction of pulls shed with a 429.
+func BenchmarkPullStorm(b *testing.B) {
+	for _, tt := range []struct {
+		name string
+		opts []Option
+	}{
+		{name: "unlimited"},
+		{name: "limited", opts: []Option{WithMaxConcurrentBlobReads(4)}},
+	} {
+		b.Run(tt.name, func(b *testing.B) {
+			server, _ := newTestServer(b, tt.opts...)
+			hash := pushBlob(b, server, "repo", "image", bytes.Repeat([]byte("a"), 8<<20))
+			url := server.URL + "/v2/repo/image/blobs/" + hash
+
+			var served, refused int64
+			b.SetParallelism(64)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					resp, err := http.Get(url)
+					if err != nil {
+						b.Errorf("unable to pull blob: %s", err)
+						return
+					}
+					io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+
+					switch resp.StatusCode {
+					case http.StatusOK:
+						atomic.AddInt64(&served, 1)
+					case http.StatusTooManyRequests:
+						atomic.AddInt64(&refused, 1)
+					default:
+						b.Errorf("unexpected status %d", resp.StatusCode)
+					}
+				}
+			})
+			b.ReportMetric(float64(refused)/float64(served+refused), "refused/op")
+		})
+	}
+}
+
+func TestStrictDigestValidation(t *testing.T) {
+	content := []byte("layer")
+	hex := DigestOf(content).Hex()
+	upper := "sha256:" + strings.ToUpper(hex)
+	mixed := "sha256:" + strings.ToUpper(hex[:32]) + hex[32:]
+	invalid := "sha256:" + strings.Repeat("z", 64)
+
+	for _, tt := range []struct {
+		name     string
+		strict   bool
+		statuses map[string]int
+	}{
+		{
+			name:   "strict",
+			strict: true,
+			statuses: map[string]int{
+				upper:   http.StatusBadRequest,
+				mixed:   http.StatusBadRequest,
+				invalid: http.StatusBadRequest,
+			},
+		},
+		{
+			name: "lenient",
+			statuses: map[string]int{
+				upper:   http.StatusOK,
+				mixed:   http.StatusOK,
+				invalid: http.StatusNotFound,
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			server, _ := newTestServer(t, WithStrictDigestValidation(tt.strict))
+			pushBlob(t, server, "repo", "image", content)
+
+			for dgst, status := range tt.statuses {
+				resp, body := do(t, server, http.MethodGet, "/v2/repo/image/blobs/"+dgst, "", nil)
+				if resp.StatusCode != status {
+					t.Errorf("%s: expected status %d, got %d: %s", dgst, status, resp.StatusCode, body)
+					continue
+				}
+
+				if status == http.StatusBadRequest && !strings.Contains(string(body), ErrDigestInvalid.Code) {
+					t.Errorf("%s: expected %s, got %s", dgst, ErrDigestInvalid.Code, body)
+				}
+
+				if status == http.StatusOK && string(body) != string(content) {
+					t.Errorf("%s: unexpected content %q", dgst, body)
+				}
+			}
+		})
+	}
+}
+
+func TestUploadInvalidDigest(t *testing.T) {
+	root := t.TempDir()
+	victim := filepath.Join(root, "001", "victim")
+	if err := os.MkdirAll(filepath.Dir(victim), 0755); err != nil {
+		t.Fatalf("unable to create victim directory: %s", err)
+	}
+	if err := os.WriteFile(victim, []byte("victim"), 0644); err != nil {
+		t.Fatalf("unable to write victim file: %s", err)
+	}
+
+	server, _ := newTestServer(t, WithStorageDir(filepath.Join(root, "storage")))
+	pushBlob(t, server, "repo", "image", []byte("blob"))
+	for _, dgst := range []string{"../../../001/victim", "sha256:..", "sha256:abc"} {
+		resp, _ := do(t, server, http.MethodPost, "/v2/repo/image/blobs/uploads/", "", nil)
+		if resp.StatusCode != http.StatusAccepted {
+			t.Fatalf("unexpected status starting upload: %d", resp.StatusCode)
+		}
+
+		finalize := resp.Header.Get("location") + "?digest=" + dgst
+		resp, body := do(t, server, http.MethodPut, finalize, "", []byte("data"))
+		if resp.StatusCode != ErrDigestInvalid.Status || !strings.Contains(string(body), ErrDigestInvalid.Code) {
+			t.Errorf("%q: unexpected reply %d: %s", dgst, resp.StatusCode, body)
+		}
+	}
+
+	if data, err := os.ReadFile(victim); err != nil || string(data) != "victim" {
+		t.Errorf("file outside the storage changed: %q, %v", data, err)
+	}
+}
+
+func TestGetBlobInvalidDigest(t *testing.T) {
+	server, _ := newTestServer(t)
+	pushBlob(t, server, "repo", "image", []byte("data"))
+
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		resp, body := do(t, server, method, "/v2/repo/image/blobs/sha256:..", "", nil)
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s: expected status %d, got %d: %s", method, http.StatusNotFound, resp.StatusCode, body)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// ClientInfo holds information about the client issuing a request. Identity is empty unless
+// the Authorizer sets it through SetIdentity.
+type ClientInfo struct {
+	Addr      string
+	UserAgent string
+	Identity  string
+}
+
+// clientKey is the context key under which the client information is kept.
+type clientKey struct{}
+
+// withClientInfo returns a context carrying the provided client information.
+func withClientInfo(ctx context.Context, info ClientInfo) context.Context {
+	return context.WithValue(ctx, clientKey{}, &info)
+}
+
+// ClientInfoFromContext returns the information about the client issuing the request the
+// provided context belongs to. Meant to be used by EventHandler implementations, returns false
+// if the context does not carry client information.
+func ClientInfoFromContext(ctx context.Context) (ClientInfo, bool) {
+	info, ok := ctx.Value(clientKey{}).(*ClientInfo)
+	if !ok {
+		return ClientInfo{}, false
+	}
+	return *info, true
+}
+
+// SetIdentity is meant to be called by Authorizer implementations, during Authorize, to record
+// who the authenticated client is (e.g. the subject of the token). The identity is then made
+// available through ClientInfoFromContext and recorded in the audit log.
+func SetIdentity(ctx context.Context, identity string) {
+	if info, ok := ctx.Value(clientKey{}).(*ClientInfo); ok {
+		info.Identity = identity
+	}
+}
+
+// isClientDisconnect returns true if the provided error, returned while writing a response,
+// means the client went away (e.g. a cancelled pull) rather than a failure on our side.
+func isClientDisconnect(err error) bool {
+	return errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, context.Canceled) ||
+		errors.Is(err, io.ErrClosedPipe)
+}
+
+// parseProxies parses a list of ip addresses or cidrs into a list of networks.
+func parseProxies(proxies []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid proxy address %q", proxy)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipnet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy cidr %q: %w", proxy, err)
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+// trustedProxy returns true if the provided address belongs to one of the trusted proxies.
+func (r *Registry) trustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, proxy := range r.proxies {
+		if proxy.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientInfo gathers the client information for the provided request. The x-forwarded-for
+// header is only honored if the request comes from a trusted proxy, in which case addresses
+// are walked from right to left and the first one not belonging to a trusted proxy is used.
+func (r *Registry) clientInfo(request Request) ClientInfo {
+	addr, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		addr = request.RemoteAddr
+	}
+
+	if r.trustedProxy(addr) {
+		hops := strings.Split(request.Header.Get("x-forwarded-for"), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if hop == "" {
+				continue
+			}
+			addr = hop
+			if !r.trustedProxy(hop) {
+				break
+			}
+		}
+	}
+
+	return ClientInfo{
+		Addr:      addr,
+		UserAgent: request.UserAgent(),
+	}
+}
+
+// scheme returns the scheme ("http" or "https") the client used to reach us. If forwarded
+// headers are trusted (see WithTrustForwardedHeaders) the first scheme in the x-forwarded-proto
+// header is used, as long as the request comes from a trusted proxy when trusted proxies have
+// been configured. Falls back to the TLS state of the connection.
+func (r *Registry) scheme(request Request) string {
+	addr, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		addr = request.RemoteAddr
+	}
+
+	if r.fwdproto && (len(r.proxies) == 0 || r.trustedProxy(addr)) {
+		proto, _, _ := strings.Cut(request.Header.Get("x-forwarded-proto"), ",")
+		proto = strings.ToLower(strings.TrimSpace(proto))
+		if proto == "http" || proto == "https" {
+			return proto
+		}
+	}
+
+	if request.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
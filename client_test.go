@@ -0,0 +1,70 @@
+package registry
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthRealmScheme(t *testing.T) {
+	deny := FuncAuthorizer{
+		AuthorizeFunc: func(context.Context, Request) *Error {
+			return ErrUnauthorized
+		},
+	}
+
+	for _, tt := range []struct {
+		name      string
+		opts      []Option
+		forwarded string
+		tls       bool
+		scheme    string
+	}{
+		{name: "plain", scheme: "http"},
+		{name: "tls", tls: true, scheme: "https"},
+		{name: "untrusted header", forwarded: "https", scheme: "http"},
+		{name: "untrusted header over tls", forwarded: "http", tls: true, scheme: "https"},
+		{name: "trusted header", opts: []Option{WithTrustForwardedHeaders()}, forwarded: "https", scheme: "https"},
+		{name: "trusted list", opts: []Option{WithTrustForwardedHeaders()}, forwarded: "https, http", scheme: "https"},
+		{name: "trusted without header", opts: []Option{WithTrustForwardedHeaders()}, scheme: "http"},
+		{name: "trusted invalid header", opts: []Option{WithTrustForwardedHeaders()}, forwarded: "ftp", scheme: "http"},
+		{
+			name:      "trusted proxy",
+			opts:      []Option{WithTrustForwardedHeaders(), WithTrustedProxies([]string{"192.0.2.0/24"})},
+			forwarded: "https",
+			scheme:    "https",
+		},
+		{
+			name:      "untrusted proxy",
+			opts:      []Option{WithTrustForwardedHeaders(), WithTrustedProxies([]string{"198.51.100.1"})},
+			forwarded: "https",
+			scheme:    "http",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := New(deny, append([]Option{WithStorageDir(t.TempDir())}, tt.opts...)...)
+
+			req := httptest.NewRequest(http.MethodGet, "http://registry.example.com/v2/", nil)
+			req.RemoteAddr = "192.0.2.10:4321"
+			if tt.forwarded != "" {
+				req.Header.Set("x-forwarded-proto", tt.forwarded)
+			}
+			if tt.tls {
+				req.TLS = &tls.ConnectionState{}
+			}
+
+			resp := httptest.NewRecorder()
+			reg.redirectToAuth(resp, Request{req})
+			if resp.Code != http.StatusUnauthorized {
+				t.Fatalf("expected status %d, got %d", http.StatusUnauthorized, resp.Code)
+			}
+
+			expected := `bearer realm="` + tt.scheme + `://registry.example.com/v2/auth",service="registry.example.com"`
+			if authdr := resp.Header().Get("www-authenticate"); authdr != expected {
+				t.Errorf("expected %s, got %s", expected, authdr)
+			}
+		})
+	}
+}
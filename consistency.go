@@ -0,0 +1,184 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/containers/image/v5/manifest"
+	"k8s.io/klog"
+)
+
+// ConsistencyCheck selects what the storage consistency check run at startup verifies and
+// what it does about inconsistencies. Values can be combined, e.g. ConsistencyRepair |
+// ConsistencyReferences. See WithStartupConsistencyCheck.
+type ConsistencyCheck uint
+
+const (
+	// ConsistencyLog verifies that every tag points to an existing manifest, dangling tags are
+	// logged.
+	ConsistencyLog ConsistencyCheck = 1 << iota
+	// ConsistencyRepair verifies tags as ConsistencyLog does and removes dangling tags, if the
+	// storage is capable of removing tags.
+	ConsistencyRepair
+	// ConsistencyReferences also verifies that the blobs (or child manifests) referred by tagged
+	// manifests exist. This reads every tagged manifest so it is slower. Missing references are
+	// only logged as there is no way of repairing them.
+	ConsistencyReferences
+)
+
+// consistencyChecker verifies the storage content, see ConsistencyCheck.
+type consistencyChecker struct {
+	storage  Storage
+	mode     ConsistencyCheck
+	verified map[string]bool
+	problems int
+}
+
+// checkConsistency verifies the content of the provided storage according to the provided
+// mode. Returns the number of inconsistencies found.
+func checkConsistency(storage Storage, mode ConsistencyCheck) (int, error) {
+	checker := &consistencyChecker{
+		storage:  storage,
+		mode:     mode,
+		verified: map[string]bool{},
+	}
+
+	names, err := storage.ListRepositories()
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("unable to list repositories: %w", err)
+	}
+
+	for _, name := range names {
+		repo, image, ok := strings.Cut(name, "/")
+		if !ok {
+			continue
+		}
+
+		if err := checker.checkImage(repo, image); err != nil {
+			return checker.problems, err
+		}
+	}
+	return checker.problems, nil
+}
+
+// checkImage verifies all tags of the provided repository and image.
+func (c *consistencyChecker) checkImage(repo, image string) error {
+	tags, err := c.storage.ListTags(repo, image)
+	if errors.Is(err, errNameUnknown) || errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("unable to list tags for %s/%s: %w", repo, image, err)
+	}
+
+	for _, tag := range tags {
+		hash, err := c.storage.ResolveTag(repo, image, tag)
+		if err != nil {
+			return fmt.Errorf("unable to resolve tag %s/%s:%s: %w", repo, image, tag, err)
+		}
+
+		if _, err := c.storage.StatBlob(repo, image, hash); err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("unable to stat manifest %s: %w", hash, err)
+			}
+
+			c.problems++
+			klog.Warningf("tag %s/%s:%s points to missing manifest %s", repo, image, tag, hash)
+			if err := c.repair(repo, image, tag); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if c.mode&ConsistencyReferences == 0 {
+			continue
+		}
+
+		if err := c.checkReferences(repo, image, hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// repair removes a dangling tag if running in repair mode.
+func (c *consistencyChecker) repair(repo, image, tag string) error {
+	if c.mode&ConsistencyRepair == 0 {
+		return nil
+	}
+
+	deleter, ok := c.storage.(TagDeleter)
+	if !ok {
+		klog.Warningf("storage can't remove tags, not removing %s/%s:%s", repo, image, tag)
+		return nil
+	}
+
+	if err := deleter.DeleteTag(repo, image, tag); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("unable to remove tag %s/%s:%s: %w", repo, image, tag, err)
+	}
+	klog.Infof("removed dangling tag %s/%s:%s", repo, image, tag)
+	return nil
+}
+
+// checkReferences verifies that everything the provided manifest refers to exists. Child
+// manifests of image indexes are verified as well. Manifests are verified only once.
+func (c *consistencyChecker) checkReferences(repo, image, hash string) error {
+	key := fmt.Sprintf("%s/%s@%s", repo, image, hash)
+	if c.verified[key] {
+		return nil
+	}
+	c.verified[key] = true
+
+	blob, _, err := c.storage.GetBlob(repo, image, hash)
+	if err != nil {
+		return fmt.Errorf("unable to read manifest %s: %w", hash, err)
+	}
+	defer blob.Close()
+
+	data, err := io.ReadAll(blob)
+	if err != nil {
+		return fmt.Errorf("unable to read manifest %s: %w", hash, err)
+	}
+
+	ctype, err := c.storage.GetManifestType(repo, image, hash)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("unable to read manifest content type: %w", err)
+	}
+	if ctype == "" {
+		ctype = manifest.GuessMIMEType(data)
+	}
+
+	// the registry accepts content types it does not understand, we can't tell what these
+	// refer to so they are not an inconsistency.
+	refs, err := parseManifestReferences(data, ctype)
+	if err != nil {
+		klog.Infof("not verifying references of %s/%s@%s: %s", repo, image, hash, err)
+		return nil
+	}
+
+	for _, ref := range refs {
+		if _, err := c.storage.StatBlob(repo, image, ref); err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("unable to stat %s: %w", ref, err)
+			}
+
+			c.problems++
+			klog.Warningf("manifest %s/%s@%s refers to missing %s", repo, image, hash, ref)
+			continue
+		}
+
+		if !manifest.MIMETypeIsMultiImage(ctype) {
+			continue
+		}
+
+		if err := c.checkReferences(repo, image, ref); err != nil {
+			return err
+		}
+	}
+	return nil
+}
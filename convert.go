@@ -0,0 +1,132 @@
+package registry
+
+import (
+	"fmt"
+	"mime"
+	"strings"
+
+	"github.com/containers/image/v5/manifest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"k8s.io/klog"
+)
+
+// accepts returns the media types present in the request accept headers.
+func accepts(request Request) map[string]bool {
+	types := map[string]bool{}
+	for _, header := range request.Header.Values("accept") {
+		for _, value := range strings.Split(header, ",") {
+			mtype, _, err := mime.ParseMediaType(strings.TrimSpace(value))
+			if err != nil {
+				continue
+			}
+			types[mtype] = true
+		}
+	}
+	return types
+}
+
+// ociLayerTypes maps docker schema2 layer media types into their oci counterparts. Foreign
+// layers are left out on purpose as they can't be converted without structural changes.
+var ociLayerTypes = map[string]string{
+	manifest.DockerV2Schema2LayerMediaType:            imgspecv1.MediaTypeImageLayerGzip,
+	manifest.DockerV2SchemaLayerMediaTypeUncompressed: imgspecv1.MediaTypeImageLayer,
+}
+
+// schema2ToOCI converts a docker schema2 manifest into an oci manifest. Returns an error if
+// the conversion can't be done by just rewriting media types.
+func schema2ToOCI(data []byte) ([]byte, error) {
+	s2, err := manifest.Schema2FromManifest(data)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse schema2 manifest: %w", err)
+	}
+
+	if s2.ConfigDescriptor.MediaType != manifest.DockerV2Schema2ConfigMediaType {
+		return nil, fmt.Errorf("unsupported config media type %q", s2.ConfigDescriptor.MediaType)
+	}
+
+	config := imgspecv1.Descriptor{
+		MediaType: imgspecv1.MediaTypeImageConfig,
+		Digest:    s2.ConfigDescriptor.Digest,
+		Size:      s2.ConfigDescriptor.Size,
+	}
+
+	layers := make([]imgspecv1.Descriptor, 0, len(s2.LayersDescriptors))
+	for _, layer := range s2.LayersDescriptors {
+		mtype, ok := ociLayerTypes[layer.MediaType]
+		if !ok || len(layer.URLs) > 0 {
+			return nil, fmt.Errorf("unsupported layer media type %q", layer.MediaType)
+		}
+		layers = append(layers, imgspecv1.Descriptor{
+			MediaType: mtype,
+			Digest:    layer.Digest,
+			Size:      layer.Size,
+		})
+	}
+
+	return manifest.OCI1FromComponents(config, layers).Serialize()
+}
+
+// schema2ListToOCI converts a docker schema2 manifest list into an oci image index.
+func schema2ListToOCI(data []byte) ([]byte, error) {
+	list, err := manifest.ListFromBlob(data, manifest.DockerV2ListMediaType)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse manifest list: %w", err)
+	}
+
+	index, err := manifest.ConvertListToMIMEType(list, imgspecv1.MediaTypeImageIndex)
+	if err != nil {
+		return nil, fmt.Errorf("unable to convert manifest list: %w", err)
+	}
+	return index.Serialize()
+}
+
+// conversion returns the function transcoding a manifest of the provided content type into
+// its oci counterpart, together with the oci content type, if the client accepts the oci media
+// type and does not accept the stored one. Returns a nil function if no conversion is needed
+// or possible.
+func conversion(ctype string, request Request) (func([]byte) ([]byte, error), string) {
+	types := accepts(request)
+	if types[ctype] {
+		return nil, ""
+	}
+
+	var convfn func([]byte) ([]byte, error)
+	var octype string
+	switch ctype {
+	case manifest.DockerV2Schema2MediaType:
+		convfn, octype = schema2ToOCI, imgspecv1.MediaTypeImageManifest
+	case manifest.DockerV2ListMediaType:
+		convfn, octype = schema2ListToOCI, imgspecv1.MediaTypeImageIndex
+	default:
+		return nil, ""
+	}
+
+	if !types[octype] {
+		return nil, ""
+	}
+	return convfn, octype
+}
+
+// convert transcodes the provided docker schema2 manifest (or manifest list) into its oci
+// counterpart, see conversion. The provided manifest content must have been read. The returned
+// manifest carries the digest of the converted data. If no conversion is needed, or if it
+// isn't possible, the provided manifest is returned untouched.
+func convert(man *resolvedManifest, request Request) *resolvedManifest {
+	convfn, ctype := conversion(man.ctype, request)
+	if convfn == nil {
+		return man
+	}
+
+	data, err := convfn(man.data)
+	if err != nil {
+		klog.Warningf("unable to convert manifest %s: %s", man.digest, err)
+		return man
+	}
+
+	return &resolvedManifest{
+		data:   data,
+		size:   int64(len(data)),
+		ctype:  ctype,
+		digest: DigestOf(data).String(),
+	}
+}
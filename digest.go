@@ -0,0 +1,102 @@
+package registry
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// digestAlgorithm is the only digest algorithm supported by the registry.
+const digestAlgorithm = "sha256"
+
+// Digest is a content digest in its full "sha256:<hex>" form. This is the form used to name
+// blobs in the storage and to send digests to clients, use Hex only where the bare hex string
+// is required.
+type Digest string
+
+// ParseDigest parses and normalizes the provided digest string. Only sha256 digests are
+// accepted, the hex part is lowercased.
+func ParseDigest(dgst string) (Digest, error) {
+	algo, hex, found := strings.Cut(strings.TrimSpace(dgst), ":")
+	if !found {
+		return "", fmt.Errorf("invalid digest %q: missing algorithm", dgst)
+	}
+
+	if strings.ToLower(algo) != digestAlgorithm {
+		return "", fmt.Errorf("invalid digest %q: unsupported algorithm", dgst)
+	}
+
+	hex = strings.ToLower(hex)
+	if len(hex) != 2*sha256.Size {
+		return "", fmt.Errorf("invalid digest %q: invalid length", dgst)
+	}
+
+	for _, c := range hex {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return "", fmt.Errorf("invalid digest %q: invalid character", dgst)
+		}
+	}
+	return Digest(digestAlgorithm + ":" + hex), nil
+}
+
+// DigestOf returns the digest of the provided data.
+func DigestOf(data []byte) Digest {
+	return Digest(fmt.Sprintf("%s:%x", digestAlgorithm, sha256.Sum256(data)))
+}
+
+// digestFromHash returns the digest for the data written so far into the provided sha256 hash.
+func digestFromHash(hasher hash.Hash) Digest {
+	return Digest(fmt.Sprintf("%s:%x", digestAlgorithm, hasher.Sum(nil)))
+}
+
+// normalizeDigest returns the provided digest in its normalized form. Digests that can't be
+// parsed are returned untouched, callers must refuse them with validDigest before use.
+func normalizeDigest(dgst string) string {
+	parsed, err := ParseDigest(dgst)
+	if err != nil {
+		return dgst
+	}
+	return parsed.String()
+}
+
+// isDigestReference returns true if the provided manifest reference is a valid digest, in any
+// case, rather than a tag. References that are neither are refused as invalid tags.
+func isDigestReference(ref string) bool {
+	return validDigest(normalizeDigest(ref))
+}
+
+// String returns the digest in its full form.
+func (d Digest) String() string {
+	return string(d)
+}
+
+// Algorithm returns the digest algorithm.
+func (d Digest) Algorithm() string {
+	algo, _, _ := strings.Cut(string(d), ":")
+	return algo
+}
+
+// Hex returns the digest without the algorithm prefix.
+func (d Digest) Hex() string {
+	_, hex, _ := strings.Cut(string(d), ":")
+	return hex
+}
+
+// DigestMismatchError is returned when content does not hash to the digest it has been stored
+// or pushed under. Expected is the digest provided by the client while Actual is the one that
+// has been computed.
+type DigestMismatchError struct {
+	Expected string `json:"expected"`
+	Actual   string `json:"actual"`
+}
+
+// Error returns the error message.
+func (d *DigestMismatchError) Error() string {
+	return fmt.Sprintf("digest mismatch: expected %s, got %s", d.Expected, d.Actual)
+}
+
+// digestMismatch returns ErrDigestInvalid carrying the expected and actual digests as detail.
+func digestMismatch(expected, actual string) *Error {
+	return ErrDigestInvalid.WithDetail(&DigestMismatchError{Expected: expected, Actual: actual})
+}
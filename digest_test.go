@@ -0,0 +1,79 @@
+package registry
+
+import (
+	"crypto/sha256"
+	"strings"
+	"testing"
+)
+
+func TestParseDigest(t *testing.T) {
+	hex := strings.Repeat("ab", 32)
+	for _, tt := range []struct {
+		input    string
+		expected string
+		valid    bool
+	}{
+		{input: "sha256:" + hex, expected: "sha256:" + hex, valid: true},
+		{input: "SHA256:" + strings.ToUpper(hex), expected: "sha256:" + hex, valid: true},
+		{input: " sha256:" + hex + " ", expected: "sha256:" + hex, valid: true},
+		{input: hex},
+		{input: "sha512:" + hex},
+		{input: "sha256:" + hex[:62]},
+		{input: "sha256:" + hex + "00"},
+		{input: "sha256:" + strings.Repeat("zz", 32)},
+		{input: ""},
+	} {
+		parsed, err := ParseDigest(tt.input)
+		if valid := err == nil; valid != tt.valid {
+			t.Errorf("%q: expected valid %v, got error %v", tt.input, tt.valid, err)
+			continue
+		}
+
+		if parsed.String() != tt.expected {
+			t.Errorf("%q: expected %q, got %q", tt.input, tt.expected, parsed)
+		}
+
+		if tt.valid && (parsed.Algorithm() != "sha256" || parsed.Hex() != hex) {
+			t.Errorf("%q: unexpected parts %q %q", tt.input, parsed.Algorithm(), parsed.Hex())
+		}
+	}
+}
+
+func TestDigestNormalization(t *testing.T) {
+	content := []byte("content")
+	expected := DigestOf(content)
+
+	hasher := sha256.New()
+	hasher.Write(content)
+	if dgst := digestFromHash(hasher); dgst != expected {
+		t.Errorf("expected %s from the hash, got %s", expected, dgst)
+	}
+
+	if dgst := normalizeDigest(strings.ToUpper(expected.String())); dgst != expected.String() {
+		t.Errorf("expected %s once normalized, got %s", expected, dgst)
+	}
+
+	if dgst := normalizeDigest("latest"); dgst != "latest" {
+		t.Errorf("invalid digest changed by normalization: %s", dgst)
+	}
+
+	for ref, digest := range map[string]bool{
+		expected.String():                  true,
+		strings.ToUpper(expected.String()): true,
+		"latest":                           false,
+	} {
+		if isDigestReference(ref) != digest {
+			t.Errorf("%q: expected digest reference %v", ref, digest)
+		}
+	}
+
+	for dgst, valid := range map[string]bool{
+		expected.String():                  true,
+		strings.ToUpper(expected.String()): false,
+		expected.Hex():                     false,
+	} {
+		if validDigest(dgst) != valid {
+			t.Errorf("%q: expected valid %v", dgst, valid)
+		}
+	}
+}
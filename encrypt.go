@@ -0,0 +1,397 @@
+package registry
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"k8s.io/klog"
+)
+
+const (
+	// encChunkSize is the amount of plaintext sealed at once. Each sealed chunk carries its
+	// own authentication tag so blobs can be decrypted as a stream.
+	encChunkSize = 64 * 1024
+	// encPrefixSize is the size of the random nonce prefix written at the start of each
+	// encrypted blob. The remaining nonce bytes are used as a chunk counter.
+	encPrefixSize = 8
+)
+
+// EncryptedStorage wraps a Storage and encrypts blobs at rest using AES-GCM. Blobs are sealed
+// in chunks of encChunkSize bytes, the nonce for each chunk is composed by a random per blob
+// prefix followed by the chunk counter and the last chunk is authenticated as such so a
+// truncated blob is detected on read.
+//
+// As the stored ciphertext hash differs from the plaintext hash the ciphertext is stored under
+// its own hash and a hidden tag named after the plaintext hash points to it, this way the rest
+// of the registry keeps indexing blobs by their plaintext hash. Tags are left untouched and keep
+// pointing to plaintext hashes.
+//
+// Encryption is not free: every PutBlob writes the ciphertext to a temporary file before it is
+// handed to the wrapped Storage (its hash must be known beforehand) and every read or write
+// goes through AES-GCM. As only the Storage interface is used this composes with any backend,
+// remote ones included.
+type EncryptedStorage struct {
+	Storage
+	aead cipher.AEAD
+}
+
+// encTag returns the name of the hidden tag used to map a plaintext hash into the hash of its
+// ciphertext. Tags can't start with a dot so this never collides with a tag pushed by a user.
+// The hash is laid out as <algorithm>-<encoded> as not all filesystems accept ':' in file names.
+func (e *EncryptedStorage) encTag(hash string) string {
+	return fmt.Sprintf(".encrypted.%s", strings.Replace(hash, ":", "-", 1))
+}
+
+// legacyEncTag returns the name of the hidden tag written by older versions, named after the
+// plaintext hash as is.
+func (e *EncryptedStorage) legacyEncTag(hash string) string {
+	return fmt.Sprintf(".encrypted.%s", hash)
+}
+
+// cipherHash returns the hash of the ciphertext for the provided plaintext hash. Hidden tags
+// written by older versions, see legacyEncTag, are still resolved.
+func (e *EncryptedStorage) cipherHash(repo, image, hash string) (string, error) {
+	cipherhash, err := e.Storage.ResolveTag(repo, image, e.encTag(hash))
+	if err == nil || !errors.Is(err, os.ErrNotExist) {
+		return cipherhash, err
+	}
+
+	if legacy, lerr := e.Storage.ResolveTag(repo, image, e.legacyEncTag(hash)); lerr == nil {
+		return legacy, nil
+	}
+	return "", err
+}
+
+// nonce returns the nonce for the chunk with the provided index.
+func (e *EncryptedStorage) nonce(prefix []byte, idx uint32) []byte {
+	nonce := make([]byte, e.aead.NonceSize())
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encPrefixSize:], idx)
+	return nonce
+}
+
+// plainSize returns the size of the plaintext for a ciphertext of the provided size.
+func (e *EncryptedStorage) plainSize(size int64) int64 {
+	sealed := int64(encChunkSize + e.aead.Overhead())
+	size -= encPrefixSize + int64(e.aead.Overhead())
+	if size < 0 {
+		return 0
+	}
+	return (size/sealed)*encChunkSize + size%sealed
+}
+
+// PutBlob encrypts the content read from the provided io.Reader and stores it in the wrapped
+// Storage. The provided hash is verified against the plaintext.
+func (e *EncryptedStorage) PutBlob(repo, image, hash string, from io.Reader) error {
+	tmpfp, err := os.CreateTemp("", "encrypted-blob-")
+	if err != nil {
+		return fmt.Errorf("unable to create temp file: %w", err)
+	}
+	defer os.RemoveAll(tmpfp.Name())
+	defer tmpfp.Close()
+
+	prefix := make([]byte, encPrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return fmt.Errorf("unable to generate nonce: %w", err)
+	}
+
+	cipherhasher := sha256.New()
+	to := io.MultiWriter(tmpfp, cipherhasher)
+	if _, err := to.Write(prefix); err != nil {
+		return fmt.Errorf("unable to write encrypted blob: %w", err)
+	}
+
+	plainhasher := sha256.New()
+	from = io.TeeReader(from, plainhasher)
+	plain := make([]byte, encChunkSize)
+	sealed := make([]byte, 0, encChunkSize+e.aead.Overhead())
+	for idx := uint32(0); ; idx++ {
+		read, err := io.ReadFull(from, plain)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return fmt.Errorf("error reading blob: %w", err)
+		}
+
+		aad := []byte{0}
+		if last {
+			aad[0] = 1
+		}
+
+		sealed = e.aead.Seal(sealed[:0], e.nonce(prefix, idx), plain[:read], aad)
+		if _, err := to.Write(sealed); err != nil {
+			return fmt.Errorf("unable to write encrypted blob: %w", err)
+		}
+
+		if last {
+			break
+		}
+	}
+
+	reshash := digestFromHash(plainhasher).String()
+	if hash != reshash {
+		return &DigestMismatchError{Expected: hash, Actual: reshash}
+	}
+
+	if _, err := tmpfp.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("unable to rewind encrypted blob: %w", err)
+	}
+
+	cipherhash := digestFromHash(cipherhasher).String()
+	if err := e.Storage.PutBlob(repo, image, cipherhash, tmpfp); err != nil {
+		return fmt.Errorf("unable to store encrypted blob: %w", err)
+	}
+	return e.Storage.PutTag(repo, image, e.encTag(hash), cipherhash)
+}
+
+// GetBlob returns a ReadCloser from where the decrypted blob content can be read. The returned
+// size refers to the plaintext. It is caller's responsibility to close the returned ReadCloser.
+func (e *EncryptedStorage) GetBlob(repo, image, hash string) (io.ReadCloser, int64, error) {
+	cipherhash, err := e.cipherHash(repo, image, hash)
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to resolve encrypted blob: %w", err)
+	}
+
+	blobfp, size, err := e.Storage.GetBlob(repo, image, cipherhash)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	prefix := make([]byte, encPrefixSize)
+	if _, err := io.ReadFull(blobfp, prefix); err != nil {
+		blobfp.Close()
+		return nil, 0, fmt.Errorf("unable to read encrypted blob: %w", err)
+	}
+
+	reader := &decryptReader{
+		src:       blobfp,
+		storage:   e,
+		prefix:    prefix,
+		remaining: size - encPrefixSize,
+	}
+	return reader, e.plainSize(size), nil
+}
+
+// GetTag returns a ReadCloser from where the decrypted manifest the tag points to can be read.
+func (e *EncryptedStorage) GetTag(repo, image, tag string) (io.ReadCloser, int64, error) {
+	hash, err := e.Storage.ResolveTag(repo, image, tag)
+	if err != nil {
+		return nil, 0, err
+	}
+	return e.GetBlob(repo, image, hash)
+}
+
+// StatBlob returns the plaintext size for the blob identified by the provided hash.
+func (e *EncryptedStorage) StatBlob(repo, image, hash string) (int64, error) {
+	cipherhash, err := e.cipherHash(repo, image, hash)
+	if err != nil {
+		return 0, err
+	}
+
+	size, err := e.Storage.StatBlob(repo, image, cipherhash)
+	if err != nil {
+		return 0, err
+	}
+	return e.plainSize(size), nil
+}
+
+// BlobModTime returns the last time the encrypted blob was modified.
+func (e *EncryptedStorage) BlobModTime(repo, image, hash string) (time.Time, error) {
+	cipherhash, err := e.cipherHash(repo, image, hash)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return e.Storage.BlobModTime(repo, image, cipherhash)
+}
+
+// DeleteBlob removes the encrypted blob if the wrapped Storage is capable of removing blobs. The
+// hidden tags pointing to it, see encTag and legacyEncTag, are removed as well if the wrapped
+// Storage is capable of removing tags, otherwise they are left behind pointing to a missing
+// blob.
+func (e *EncryptedStorage) DeleteBlob(repo, image, hash string) error {
+	deleter, ok := e.Storage.(BlobDeleter)
+	if !ok {
+		return fmt.Errorf("storage does not support blob removal")
+	}
+
+	cipherhash, err := e.cipherHash(repo, image, hash)
+	if err != nil {
+		return err
+	}
+
+	if err := deleter.DeleteBlob(repo, image, cipherhash); err != nil {
+		return err
+	}
+
+	tagdeleter, ok := e.Storage.(TagDeleter)
+	if !ok {
+		return nil
+	}
+
+	for _, tag := range []string{e.encTag(hash), e.legacyEncTag(hash)} {
+		if err := tagdeleter.DeleteTag(repo, image, tag); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("unable to remove encrypted blob tag: %w", err)
+		}
+	}
+	return nil
+}
+
+// DeleteTag removes the tag if the wrapped Storage is capable of removing tags. Tags point to
+// plaintext hashes so they are removed as they are.
+func (e *EncryptedStorage) DeleteTag(repo, image, tag string) error {
+	deleter, ok := e.Storage.(TagDeleter)
+	if !ok {
+		return fmt.Errorf("storage does not support tag removal")
+	}
+	return deleter.DeleteTag(repo, image, tag)
+}
+
+// PutTagHistory records a tag history entry if the wrapped Storage is capable of keeping tag
+// histories. As tags, histories refer to plaintext hashes.
+func (e *EncryptedStorage) PutTagHistory(repo, image, tag, hash string, max int) error {
+	historian, ok := e.Storage.(TagHistorian)
+	if !ok {
+		return fmt.Errorf("storage does not support tag history")
+	}
+	return historian.PutTagHistory(repo, image, tag, hash, max)
+}
+
+// TagHistory reads a tag history if the wrapped Storage is capable of keeping tag histories.
+func (e *EncryptedStorage) TagHistory(repo, image, tag string) ([]string, error) {
+	historian, ok := e.Storage.(TagHistorian)
+	if !ok {
+		return nil, fmt.Errorf("storage does not support tag history")
+	}
+	return historian.TagHistory(repo, image, tag)
+}
+
+// BlobExistsAnywhere looks for the provided plaintext hash in all repositories and images. The
+// wrapped Storage only knows about ciphertext hashes so blobs are looked up through their
+// hidden tags instead of being delegated.
+func (e *EncryptedStorage) BlobExistsAnywhere(hash string) (string, string, bool) {
+	names, err := e.Storage.ListRepositories()
+	if err != nil {
+		klog.Errorf("unable to look for blob %s: %s", hash, err)
+		return "", "", false
+	}
+
+	for _, name := range names {
+		repo, image, _ := strings.Cut(name, "/")
+		if _, err := e.StatBlob(repo, image, hash); err == nil {
+			return repo, image, true
+		}
+	}
+	return "", "", false
+}
+
+// ImageExists checks for a repository and image if the wrapped Storage is capable of it.
+func (e *EncryptedStorage) ImageExists(repo, image string) (bool, error) {
+	checker, ok := e.Storage.(ImageChecker)
+	if !ok {
+		return false, fmt.Errorf("storage does not support image checks")
+	}
+	return checker.ImageExists(repo, image)
+}
+
+// DiskUsage reports the usage of the wrapped Storage if it is capable of reporting it.
+func (e *EncryptedStorage) DiskUsage() (DiskUsage, error) {
+	reporter, ok := e.Storage.(SpaceReporter)
+	if !ok {
+		return DiskUsage{}, fmt.Errorf("storage does not report disk usage")
+	}
+	return reporter.DiskUsage()
+}
+
+// decryptReader decrypts, chunk by chunk, the content read from an encrypted blob.
+type decryptReader struct {
+	src       io.ReadCloser
+	storage   *EncryptedStorage
+	prefix    []byte
+	remaining int64
+	idx       uint32
+	plain     []byte
+	done      bool
+}
+
+// next reads and opens the next sealed chunk from the underlying reader.
+func (d *decryptReader) next() error {
+	overhead := int64(d.storage.aead.Overhead())
+	size := int64(encChunkSize) + overhead
+	last := d.remaining < size+overhead
+	if last {
+		size = d.remaining
+	}
+
+	if size < overhead || size > int64(encChunkSize)+overhead {
+		return fmt.Errorf("invalid encrypted blob size")
+	}
+
+	sealed := make([]byte, size)
+	if _, err := io.ReadFull(d.src, sealed); err != nil {
+		return fmt.Errorf("unable to read encrypted blob: %w", err)
+	}
+	d.remaining -= size
+
+	aad := []byte{0}
+	if last {
+		aad[0] = 1
+	}
+
+	plain, err := d.storage.aead.Open(sealed[:0], d.storage.nonce(d.prefix, d.idx), sealed, aad)
+	if err != nil {
+		return fmt.Errorf("unable to decrypt blob: %w", err)
+	}
+
+	d.idx++
+	d.plain = plain
+	d.done = last
+	return nil
+}
+
+// Read reads decrypted data into the provided slice.
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	copied := copy(p, d.plain)
+	d.plain = d.plain[copied:]
+	return copied, nil
+}
+
+// Close closes the underlying encrypted blob reader.
+func (d *decryptReader) Close() error {
+	return d.src.Close()
+}
+
+// NewEncryptedStorage returns a Storage that encrypts blobs using the provided key before they
+// are handed to the wrapped Storage. Key must be 16, 24 or 32 bytes long.
+func NewEncryptedStorage(storage Storage, key []byte) (*EncryptedStorage, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %w", err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create gcm cipher: %w", err)
+	}
+
+	return &EncryptedStorage{
+		Storage: storage,
+		aead:    aead,
+	}, nil
+}
@@ -0,0 +1,112 @@
+package registry
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEncryptedStorageOptionalInterfaces(t *testing.T) {
+	storage, err := NewEncryptedStorage(newTestStorage(t), []byte(strings.Repeat("k", 32)))
+	if err != nil {
+		t.Fatalf("unable to create encrypted storage: %s", err)
+	}
+
+	var wrapped Storage = storage
+	forwarded := map[string]bool{}
+	_, forwarded["BlobDeleter"] = wrapped.(BlobDeleter)
+	_, forwarded["TagDeleter"] = wrapped.(TagDeleter)
+	_, forwarded["TagHistorian"] = wrapped.(TagHistorian)
+	_, forwarded["BlobLocator"] = wrapped.(BlobLocator)
+	_, forwarded["ImageChecker"] = wrapped.(ImageChecker)
+	_, forwarded["SpaceReporter"] = wrapped.(SpaceReporter)
+	for name, ok := range forwarded {
+		if !ok {
+			t.Errorf("encrypted storage does not forward %s", name)
+		}
+	}
+
+	content := []byte("layer")
+	hash := DigestOf(content).String()
+	if err := storage.PutBlob("repo", "image", hash, bytes.NewReader(content)); err != nil {
+		t.Fatalf("unable to store blob: %s", err)
+	}
+
+	if repo, image, found := storage.BlobExistsAnywhere(hash); !found || repo != "repo" || image != "image" {
+		t.Errorf("blob not located by its plaintext hash: %s/%s %v", repo, image, found)
+	}
+
+	if err := storage.PutTag("repo", "image", "latest", hash); err != nil {
+		t.Fatalf("unable to store tag: %s", err)
+	}
+
+	if err := storage.DeleteTag("repo", "image", "latest"); err != nil {
+		t.Errorf("unable to delete tag: %s", err)
+	}
+
+	if exists, err := storage.ImageExists("repo", "image"); err != nil || !exists {
+		t.Errorf("image not found: %v %s", exists, err)
+	}
+}
+
+func TestEncryptedTagNames(t *testing.T) {
+	base := newTestStorage(t)
+	storage, err := NewEncryptedStorage(base, []byte(strings.Repeat("k", 32)))
+	if err != nil {
+		t.Fatalf("unable to create encrypted storage: %s", err)
+	}
+
+	content := []byte("layer")
+	hash := DigestOf(content).String()
+	if err := storage.PutBlob("repo", "image", hash, bytes.NewReader(content)); err != nil {
+		t.Fatalf("unable to store blob: %s", err)
+	}
+
+	entries, err := os.ReadDir(filepath.Join(base.basedir, "repo", "image", "tags"))
+	if err != nil {
+		t.Fatalf("unable to list tags: %s", err)
+	}
+
+	for _, entry := range entries {
+		if strings.Contains(entry.Name(), ":") {
+			t.Errorf("tag file named with a colon: %s", entry.Name())
+		}
+	}
+
+	// move the hidden tag to the name used by older versions.
+	cipherhash, err := base.ResolveTag("repo", "image", storage.encTag(hash))
+	if err != nil {
+		t.Fatalf("unable to resolve encrypted blob: %s", err)
+	}
+
+	if err := base.PutTag("repo", "image", storage.legacyEncTag(hash), cipherhash); err != nil {
+		t.Fatalf("unable to store legacy tag: %s", err)
+	}
+
+	if err := base.DeleteTag("repo", "image", storage.encTag(hash)); err != nil {
+		t.Fatalf("unable to delete tag: %s", err)
+	}
+
+	blob, _, err := storage.GetBlob("repo", "image", hash)
+	if err != nil {
+		t.Fatalf("blob not found through the legacy tag: %s", err)
+	}
+
+	data, err := io.ReadAll(blob)
+	blob.Close()
+	if err != nil || !bytes.Equal(data, content) {
+		t.Errorf("unexpected blob content: %q, %v", data, err)
+	}
+
+	if err := storage.DeleteBlob("repo", "image", hash); err != nil {
+		t.Fatalf("unable to delete blob: %s", err)
+	}
+
+	if _, err := base.ResolveTag("repo", "image", storage.legacyEncTag(hash)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("legacy tag left behind: %v", err)
+	}
+}
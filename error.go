@@ -21,6 +21,61 @@ var ErrUnknownBlob = &Error{
 	Message: "unknown blob",
 }
 
+// ErrUploadUnknown is returned to the client when it refers to an upload the registry is not
+// aware of, either because it never existed or because it has expired.
+var ErrUploadUnknown = &Error{
+	Status:  http.StatusNotFound,
+	Code:    "BLOB_UPLOAD_UNKNOWN",
+	Message: "blob upload unknown to registry",
+}
+
+// ErrUploadInvalid is returned to the client when an upload request is malformed, e.g. when an
+// upload is finalized without a digest.
+var ErrUploadInvalid = &Error{
+	Status:  http.StatusBadRequest,
+	Code:    "BLOB_UPLOAD_INVALID",
+	Message: "blob upload invalid",
+}
+
+// ErrRangeInvalid is returned to the client when an upload chunk is not acceptable, e.g. when it
+// is smaller than the configured minimum chunk size or does not start where the upload stands.
+var ErrRangeInvalid = &Error{
+	Status:  http.StatusRequestedRangeNotSatisfiable,
+	Code:    "BLOB_UPLOAD_INVALID",
+	Message: "invalid upload chunk",
+}
+
+// ErrNameInvalid is returned to the client when the repository or image could not be parsed
+// out of the request url.
+var ErrNameInvalid = &Error{
+	Status:  http.StatusBadRequest,
+	Code:    "NAME_INVALID",
+	Message: "invalid repository name",
+}
+
+// ErrTagInvalid is returned to the client when a manifest is referred by a tag not following
+// the tag grammar, see validTag.
+var ErrTagInvalid = &Error{
+	Status:  http.StatusBadRequest,
+	Code:    "TAG_INVALID",
+	Message: "invalid tag",
+}
+
+// ErrDigestInvalid is returned to the client when a provided digest is not valid, e.g. when it
+// is not lowercase and strict digest validation is enabled.
+var ErrDigestInvalid = &Error{
+	Status:  http.StatusBadRequest,
+	Code:    "DIGEST_INVALID",
+	Message: "invalid digest",
+}
+
+// ErrNameUnknown is returned to the client when the repository it refers to does not exist.
+var ErrNameUnknown = &Error{
+	Status:  http.StatusNotFound,
+	Code:    "NAME_UNKNOWN",
+	Message: "repository name not known to registry",
+}
+
 // ErrUnknownManifest is returned to the client when it attempts to read a manifest the
 // registry is not aware of.
 var ErrUnknownManifest = &Error{
@@ -29,6 +84,62 @@ var ErrUnknownManifest = &Error{
 	Message: "unknown manifest",
 }
 
+// ErrManifestInvalid is returned to the client when the manifest it attempts to push can't be
+// parsed or fails any of our validations.
+var ErrManifestInvalid = &Error{
+	Status:  http.StatusBadRequest,
+	Code:    "MANIFEST_INVALID",
+	Message: "manifest invalid",
+}
+
+// ErrManifestBlobUnknown is returned to the client when it pushes a manifest referring to
+// blobs or child manifests the registry is not aware of.
+var ErrManifestBlobUnknown = &Error{
+	Status:  http.StatusBadRequest,
+	Code:    "MANIFEST_BLOB_UNKNOWN",
+	Message: "manifest references unknown blob",
+}
+
+// ErrManifestTooLarge is returned to the client when the manifest it attempts to push is
+// larger than the configured limit.
+var ErrManifestTooLarge = &Error{
+	Status:  http.StatusRequestEntityTooLarge,
+	Code:    "SIZE_INVALID",
+	Message: "manifest too large",
+}
+
+// ErrRequestTooLarge is returned to the client when the request body is larger than the
+// configured limit.
+var ErrRequestTooLarge = &Error{
+	Status:  http.StatusRequestEntityTooLarge,
+	Code:    "SIZE_INVALID",
+	Message: "request body too large",
+}
+
+// ErrQuotaExceeded is returned to the client when an upload would take it beyond the amount of
+// disk it is allowed to use for uploads in progress.
+var ErrQuotaExceeded = &Error{
+	Status:  http.StatusRequestEntityTooLarge,
+	Code:    "DENIED",
+	Message: "upload quota exceeded",
+}
+
+// ErrTooManyTags is returned to the client when it attempts to create a new tag for an image
+// that already holds the maximum number of tags allowed.
+var ErrTooManyTags = &Error{
+	Status:  http.StatusConflict,
+	Code:    "TOO_MANY_TAGS",
+	Message: "maximum number of tags reached",
+}
+
+// ErrHostNotAllowed is returned to the client when the request is addressed to a host the
+// registry does not serve.
+var ErrHostNotAllowed = &Error{
+	Status:  http.StatusBadRequest,
+	Code:    "HOST_NOT_ALLOWED",
+	Message: "host not allowed",
+}
+
 // ErrUnsupported is returned to the client attempts to execute an http request that the
 // registry does not know how to handle or hasn't it implemented yet.
 var ErrUnsupported = &Error{
@@ -37,6 +148,22 @@ var ErrUnsupported = &Error{
 	Message: "unsupported operation",
 }
 
+// ErrTooManyRequests is returned to the client when it issues more requests than the registry
+// is willing to serve. Usually carries a retry-after header, see WithHeader.
+var ErrTooManyRequests = &Error{
+	Status:  http.StatusTooManyRequests,
+	Code:    "TOOMANYREQUESTS",
+	Message: "too many requests",
+}
+
+// ErrUnavailable is returned to the client when the registry can't serve the request at the
+// moment, e.g. when a new upload is requested while the registry is shutting down.
+var ErrUnavailable = &Error{
+	Status:  http.StatusServiceUnavailable,
+	Code:    "UNAVAILABLE",
+	Message: "service unavailable",
+}
+
 // ErrInternal wraps a regular go error into a Error struct and returns it.
 func ErrInternal(err error) *Error {
 	return &Error{
@@ -54,19 +181,53 @@ type Error struct {
 	Status  int
 	Code    string
 	Message string
+	Detail  interface{}
+	Headers http.Header
+}
+
+// WithHeader returns a copy of the error carrying the provided header. Headers are sent to the
+// client when the error is written. Errors are often shared variables so they are never changed
+// in place.
+func (r *Error) WithHeader(key, value string) *Error {
+	cp := *r
+	cp.Headers = r.Headers.Clone()
+	if cp.Headers == nil {
+		cp.Headers = http.Header{}
+	}
+	cp.Headers.Set(key, value)
+	return &cp
+}
+
+// WithDetail returns a copy of the error carrying the provided detail. The detail is sent to
+// the client, as part of the error, when the error is written.
+func (r *Error) WithDetail(detail interface{}) *Error {
+	cp := *r
+	cp.Detail = detail
+	return &cp
 }
 
-// Write writes down the error (marshaled as a json) into provided ResponseWriter.
+// Write writes down the error (marshaled as a json) into provided ResponseWriter. Headers must
+// be set before the status is written, otherwise they never reach the client.
 func (r *Error) Write(resp http.ResponseWriter) error {
+	for key, values := range r.Headers {
+		for _, value := range values {
+			resp.Header().Add(key, value)
+		}
+	}
+	resp.Header().Set("content-type", "application/json")
 	resp.WriteHeader(r.Status)
+
+	entry := map[string]interface{}{
+		"code":    r.Code,
+		"message": r.Message,
+	}
+	if r.Detail != nil {
+		entry["detail"] = r.Detail
+	}
+
 	return json.NewEncoder(resp).Encode(
 		map[string]interface{}{
-			"errors": []map[string]interface{}{
-				{
-					"code":    r.Code,
-					"message": r.Message,
-				},
-			},
+			"errors": []map[string]interface{}{entry},
 		},
 	)
 }
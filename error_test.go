@@ -0,0 +1,49 @@
+package registry
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestErrorWrite(t *testing.T) {
+	resp := httptest.NewRecorder()
+	ErrTooManyRequests.WithHeader("retry-after", "30").WithDetail("slow down").Write(resp)
+
+	if resp.Code != http.StatusTooManyRequests {
+		t.Errorf("expected status %d, got %d", http.StatusTooManyRequests, resp.Code)
+	}
+
+	if ctype := resp.Header().Get("content-type"); ctype != "application/json" {
+		t.Errorf("expected content type application/json, got %q", ctype)
+	}
+
+	if retry := resp.Header().Get("retry-after"); retry != "30" {
+		t.Errorf("expected retry-after 30, got %q", retry)
+	}
+
+	var reply struct {
+		Errors []struct {
+			Code    string      `json:"code"`
+			Message string      `json:"message"`
+			Detail  interface{} `json:"detail"`
+		} `json:"errors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		t.Fatalf("unable to decode error: %s", err)
+	}
+
+	if len(reply.Errors) != 1 {
+		t.Fatalf("expected one error, got %+v", reply.Errors)
+	}
+
+	entry := reply.Errors[0]
+	if entry.Code != ErrTooManyRequests.Code || entry.Message != ErrTooManyRequests.Message || entry.Detail != "slow down" {
+		t.Errorf("unexpected error %+v", entry)
+	}
+
+	if ErrTooManyRequests.Headers.Get("retry-after") != "" || ErrTooManyRequests.Detail != nil {
+		t.Error("shared error changed in place")
+	}
+}
@@ -0,0 +1,141 @@
+package registry
+
+import (
+	"context"
+	"sync"
+)
+
+// BlobEventHandler may be implemented by an EventHandler willing to be notified about new
+// blobs. This is an optional interface, handlers not implementing it are not notified.
+type BlobEventHandler interface {
+	NewBlob(context.Context, string, string, string) error
+}
+
+// RepositoryEventHandler may be implemented by an EventHandler willing to be notified the first
+// time content is stored for a repository and image. This is an optional interface, handlers
+// not implementing it are not notified.
+type RepositoryEventHandler interface {
+	NewRepository(context.Context, string, string) error
+}
+
+// UploadEventHandler may be implemented by an EventHandler willing to be notified when upload
+// files can't be cleaned up. This is an optional interface, handlers not implementing it are
+// not notified.
+type UploadEventHandler interface {
+	UploadCleanupFailed(string, error)
+}
+
+// EventType identifies a kind of event. Event types can be combined, as a bitmask, to subscribe
+// an EventHandler to a subset of the events (see WithEventHandlerFiltered).
+type EventType uint
+
+const (
+	// EventNewTag is fired when a tag is created or updated, see EventHandler.
+	EventNewTag EventType = 1 << iota
+	// EventNewBlob is fired when a blob is stored, see BlobEventHandler.
+	EventNewBlob
+	// EventNewRepository is fired when content is first stored for a repository and image, see
+	// RepositoryEventHandler.
+	EventNewRepository
+	// EventUploadCleanupFailed is fired when an upload file can't be removed, see
+	// UploadEventHandler.
+	EventUploadCleanupFailed
+)
+
+// events dispatches registry events to the registered EventHandler and, for new tags, to the
+// replicator. All methods are safe to be called on a nil reference or when no handler has been
+// registered, in such cases they no-op. If a filter is set the handler is only notified about
+// the event types in it.
+type events struct {
+	handler   EventHandler
+	filter    EventType
+	replicate *replicator
+	announced sync.Map
+}
+
+// wants returns true if the event handler is subscribed to the provided event type.
+func (e *events) wants(etype EventType) bool {
+	return e.handler != nil && (e.filter == 0 || e.filter&etype != 0)
+}
+
+// fireNewTag notifies the event handler about a new tag. Tags accepted by the handler are then
+// queued for replication.
+func (e *events) fireNewTag(ctx context.Context, repo, image, tag string) error {
+	if e == nil {
+		return nil
+	}
+
+	if e.wants(EventNewTag) {
+		if err := e.handler.NewTag(ctx, repo, image, tag); err != nil {
+			return err
+		}
+	}
+
+	e.replicate.enqueue(repo, image, tag)
+	return nil
+}
+
+// fireNewBlob notifies the event handler about a new blob, if the handler is interested.
+func (e *events) fireNewBlob(ctx context.Context, repo, image, hash string) error {
+	if e == nil || !e.wants(EventNewBlob) {
+		return nil
+	}
+
+	bhandler, ok := e.handler.(BlobEventHandler)
+	if !ok {
+		return nil
+	}
+	return bhandler.NewBlob(ctx, repo, image, hash)
+}
+
+// isNewImage returns true if the provided repository and image do not exist in the storage yet.
+// This must be called before content is stored. Always returns false if the event handler is
+// not interested in new repositories or if the storage can't tell.
+func (e *events) isNewImage(storage Storage, repo, image string) bool {
+	if e == nil || !e.wants(EventNewRepository) {
+		return false
+	}
+
+	if _, ok := e.handler.(RepositoryEventHandler); !ok {
+		return false
+	}
+
+	checker, ok := storage.(ImageChecker)
+	if !ok {
+		return false
+	}
+
+	exists, err := checker.ImageExists(repo, image)
+	return err == nil && !exists
+}
+
+// fireNewRepository notifies the event handler about a new repository and image, if the
+// handler is interested. Concurrent first pushes may all find the image missing so each one is
+// announced only once.
+func (e *events) fireNewRepository(ctx context.Context, repo, image string) error {
+	if e == nil || !e.wants(EventNewRepository) {
+		return nil
+	}
+
+	rhandler, ok := e.handler.(RepositoryEventHandler)
+	if !ok {
+		return nil
+	}
+
+	if _, loaded := e.announced.LoadOrStore(repo+"/"+image, true); loaded {
+		return nil
+	}
+	return rhandler.NewRepository(ctx, repo, image)
+}
+
+// fireUploadCleanupFailed notifies the event handler about an upload whose temporary file could
+// not be removed, if the handler is interested.
+func (e *events) fireUploadCleanupFailed(id string, err error) {
+	if e == nil || !e.wants(EventUploadCleanupFailed) {
+		return
+	}
+
+	if uhandler, ok := e.handler.(UploadEventHandler); ok {
+		uhandler.UploadCleanupFailed(id, err)
+	}
+}
@@ -0,0 +1,318 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+// readOnlyError is returned by FallbackStorage writes while the primary storage is not
+// accepting writes. Retry holds how long until writes are attempted again.
+type readOnlyError struct {
+	retry time.Duration
+	cause error
+}
+
+// Error returns the error message.
+func (r *readOnlyError) Error() string {
+	if r.cause == nil {
+		return "storage is read only"
+	}
+	return fmt.Sprintf("storage is read only: %s", r.cause)
+}
+
+// Unwrap returns the error that made the storage read only, if any.
+func (r *readOnlyError) Unwrap() error {
+	return r.cause
+}
+
+// storageFailure returns true if the provided write error comes from the storage itself. Errors
+// caused by the request, e.g. content not matching its digest or a tag that does not exist, say
+// nothing about the storage health.
+func storageFailure(err error) bool {
+	var mismatch *DigestMismatchError
+	return !errors.As(err, &mismatch) && !errors.Is(err, os.ErrNotExist)
+}
+
+// writeStorageError writes the appropriate error for a failed storage write. If the storage is
+// read only ErrUnavailable is returned with a retry-after header, if the content does not match
+// its digest ErrDigestInvalid is returned with both digests, if the digest itself is not valid
+// ErrDigestInvalid is returned, otherwise ErrInternal.
+func writeStorageError(resp http.ResponseWriter, err error) {
+	storageError(err).Write(resp)
+}
+
+// storageError returns the Error to be sent to the client for the provided storage error, see
+// writeStorageError.
+func storageError(err error) *Error {
+	var mismatch *DigestMismatchError
+	if errors.As(err, &mismatch) {
+		return digestMismatch(mismatch.Expected, mismatch.Actual)
+	}
+
+	if errors.Is(err, errInvalidDigest) {
+		return ErrDigestInvalid
+	}
+
+	var roerr *readOnlyError
+	if !errors.As(err, &roerr) {
+		return ErrInternal(err)
+	}
+
+	secs := int(roerr.retry.Seconds())
+	if secs < 1 {
+		secs = 1
+	}
+	return ErrUnavailable.WithHeader("retry-after", fmt.Sprint(secs))
+}
+
+// FallbackStorage wraps a primary Storage and a read only secondary one. Everything goes to
+// the primary until a write fails, from then on writes are refused with a read only error and
+// reads are served by the secondary. Once every 'retry' a write is attempted against the
+// primary again and, if it succeeds, the primary is back in charge. This is meant to keep pulls
+// flowing during storage maintenance windows.
+type FallbackStorage struct {
+	sync.Mutex
+	primary   Storage
+	secondary Storage
+	retry     time.Duration
+	since     time.Time
+}
+
+// ReadOnly returns true if the primary storage is not accepting writes and reads are being
+// served by the secondary storage.
+func (f *FallbackStorage) ReadOnly() bool {
+	f.Lock()
+	defer f.Unlock()
+	return !f.since.IsZero()
+}
+
+// RetryAfter returns how long until a write is attempted against the primary storage again.
+func (f *FallbackStorage) RetryAfter() time.Duration {
+	f.Lock()
+	defer f.Unlock()
+	if f.since.IsZero() {
+		return 0
+	}
+	if left := f.retry - time.Since(f.since); left > 0 {
+		return left
+	}
+	return 0
+}
+
+// reader returns the storage reads should be served from.
+func (f *FallbackStorage) reader() Storage {
+	if f.ReadOnly() {
+		return f.secondary
+	}
+	return f.primary
+}
+
+// write runs the provided write against the primary storage. If the primary is in read only
+// mode and the retry window hasn't passed yet a read only error is returned right away. Only
+// storage failures put the primary in read only mode, other errors are returned unchanged.
+func (f *FallbackStorage) write(fn func(Storage) error) error {
+	f.Lock()
+	if !f.since.IsZero() && time.Since(f.since) < f.retry {
+		retry := f.retry - time.Since(f.since)
+		f.Unlock()
+		return &readOnlyError{retry: retry}
+	}
+	f.Unlock()
+
+	err := fn(f.primary)
+	if err != nil && !storageFailure(err) {
+		return err
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	if err == nil {
+		if !f.since.IsZero() {
+			klog.Infof("primary storage accepting writes again")
+		}
+		f.since = time.Time{}
+		return nil
+	}
+
+	if f.since.IsZero() {
+		klog.Warningf("primary storage write failed, falling back to read only: %s", err)
+	}
+	f.since = time.Now()
+	return &readOnlyError{retry: f.retry, cause: err}
+}
+
+// PutTag stores a tag in the primary storage.
+func (f *FallbackStorage) PutTag(repo, image, tag, hash string) error {
+	return f.write(func(s Storage) error {
+		return s.PutTag(repo, image, tag, hash)
+	})
+}
+
+// PutBlob stores a blob in the primary storage.
+func (f *FallbackStorage) PutBlob(repo, image, hash string, from io.Reader) error {
+	return f.write(func(s Storage) error {
+		return s.PutBlob(repo, image, hash, from)
+	})
+}
+
+// PutManifestType stores a manifest content type in the primary storage.
+func (f *FallbackStorage) PutManifestType(repo, image, hash, ctype string) error {
+	return f.write(func(s Storage) error {
+		return s.PutManifestType(repo, image, hash, ctype)
+	})
+}
+
+// PutReferrer stores a referrer in the primary storage.
+func (f *FallbackStorage) PutReferrer(repo, image, subject, hash string) error {
+	return f.write(func(s Storage) error {
+		return s.PutReferrer(repo, image, subject, hash)
+	})
+}
+
+// PutIndexChild stores an index child reference in the primary storage.
+func (f *FallbackStorage) PutIndexChild(repo, image, index, child string) error {
+	return f.write(func(s Storage) error {
+		return s.PutIndexChild(repo, image, index, child)
+	})
+}
+
+// DeleteBlob removes a blob from the primary storage if it is capable of removing blobs.
+func (f *FallbackStorage) DeleteBlob(repo, image, hash string) error {
+	deleter, ok := f.primary.(BlobDeleter)
+	if !ok {
+		return fmt.Errorf("storage does not support blob removal")
+	}
+
+	return f.write(func(Storage) error {
+		return deleter.DeleteBlob(repo, image, hash)
+	})
+}
+
+// PutTagHistory records a tag history entry in the primary storage if it is capable of keeping
+// tag histories.
+func (f *FallbackStorage) PutTagHistory(repo, image, tag, hash string, max int) error {
+	historian, ok := f.primary.(TagHistorian)
+	if !ok {
+		return fmt.Errorf("storage does not support tag history")
+	}
+
+	return f.write(func(Storage) error {
+		return historian.PutTagHistory(repo, image, tag, hash, max)
+	})
+}
+
+// TagHistory reads a tag history from the storage currently serving reads.
+func (f *FallbackStorage) TagHistory(repo, image, tag string) ([]string, error) {
+	historian, ok := f.reader().(TagHistorian)
+	if !ok {
+		return nil, fmt.Errorf("storage does not support tag history")
+	}
+	return historian.TagHistory(repo, image, tag)
+}
+
+// BlobExistsAnywhere looks for a blob in the storage currently serving reads.
+func (f *FallbackStorage) BlobExistsAnywhere(hash string) (string, string, bool) {
+	locator, ok := f.reader().(BlobLocator)
+	if !ok {
+		return "", "", false
+	}
+	return locator.BlobExistsAnywhere(hash)
+}
+
+// DeleteTag removes a tag from the primary storage if it is capable of removing tags.
+func (f *FallbackStorage) DeleteTag(repo, image, tag string) error {
+	deleter, ok := f.primary.(TagDeleter)
+	if !ok {
+		return fmt.Errorf("storage does not support tag removal")
+	}
+
+	return f.write(func(Storage) error {
+		return deleter.DeleteTag(repo, image, tag)
+	})
+}
+
+// DiskUsage reports the usage of the primary storage, where new content is written to.
+func (f *FallbackStorage) DiskUsage() (DiskUsage, error) {
+	reporter, ok := f.primary.(SpaceReporter)
+	if !ok {
+		return DiskUsage{}, fmt.Errorf("storage does not report disk usage")
+	}
+	return reporter.DiskUsage()
+}
+
+// ImageExists checks for a repository and image in the storage currently serving reads.
+func (f *FallbackStorage) ImageExists(repo, image string) (bool, error) {
+	checker, ok := f.reader().(ImageChecker)
+	if !ok {
+		return false, fmt.Errorf("storage does not support image checks")
+	}
+	return checker.ImageExists(repo, image)
+}
+
+// GetTag reads a tag from the storage currently serving reads.
+func (f *FallbackStorage) GetTag(repo, image, tag string) (io.ReadCloser, int64, error) {
+	return f.reader().GetTag(repo, image, tag)
+}
+
+// ResolveTag resolves a tag using the storage currently serving reads.
+func (f *FallbackStorage) ResolveTag(repo, image, tag string) (string, error) {
+	return f.reader().ResolveTag(repo, image, tag)
+}
+
+// GetBlob reads a blob from the storage currently serving reads.
+func (f *FallbackStorage) GetBlob(repo, image, hash string) (io.ReadCloser, int64, error) {
+	return f.reader().GetBlob(repo, image, hash)
+}
+
+// StatBlob stats a blob in the storage currently serving reads.
+func (f *FallbackStorage) StatBlob(repo, image, hash string) (int64, error) {
+	return f.reader().StatBlob(repo, image, hash)
+}
+
+// BlobModTime returns a blob modification time from the storage currently serving reads.
+func (f *FallbackStorage) BlobModTime(repo, image, hash string) (time.Time, error) {
+	return f.reader().BlobModTime(repo, image, hash)
+}
+
+// GetManifestType reads a manifest content type from the storage currently serving reads.
+func (f *FallbackStorage) GetManifestType(repo, image, hash string) (string, error) {
+	return f.reader().GetManifestType(repo, image, hash)
+}
+
+// ListRepositories lists repositories in the storage currently serving reads.
+func (f *FallbackStorage) ListRepositories() ([]string, error) {
+	return f.reader().ListRepositories()
+}
+
+// ListTags lists tags in the storage currently serving reads.
+func (f *FallbackStorage) ListTags(repo, image string) ([]string, error) {
+	return f.reader().ListTags(repo, image)
+}
+
+// ListReferrers lists referrers in the storage currently serving reads.
+func (f *FallbackStorage) ListReferrers(repo, image, subject string) ([]string, error) {
+	return f.reader().ListReferrers(repo, image, subject)
+}
+
+// ListIndexParents lists index references in the storage currently serving reads.
+func (f *FallbackStorage) ListIndexParents(repo, image, child string) ([]string, error) {
+	return f.reader().ListIndexParents(repo, image, child)
+}
+
+// NewFallbackStorage returns a FallbackStorage using primary for reads and writes and falling
+// back to secondary, for reads only, when primary fails to write. Writes are attempted against
+// the primary again once every 'retry'.
+func NewFallbackStorage(primary, secondary Storage, retry time.Duration) *FallbackStorage {
+	return &FallbackStorage{
+		primary:   primary,
+		secondary: secondary,
+		retry:     retry,
+	}
+}
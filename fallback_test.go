@@ -0,0 +1,45 @@
+package registry
+
+import (
+	"bytes"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFallbackStorageDigestMismatch(t *testing.T) {
+	storage := NewFallbackStorage(newTestStorage(t), newTestStorage(t), time.Hour)
+
+	content := []byte("content")
+	expected := "sha256:" + strings.Repeat("a", 64)
+	err := storage.PutBlob("repo", "image", expected, bytes.NewReader(content))
+
+	var mismatch *DigestMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("expected a digest mismatch, got %v", err)
+	}
+
+	if mismatch.Expected != expected || mismatch.Actual != DigestOf(content).String() {
+		t.Errorf("unexpected mismatch digests: %+v", mismatch)
+	}
+
+	if storage.ReadOnly() {
+		t.Fatal("digest mismatch put the storage in read only mode")
+	}
+
+	resp := httptest.NewRecorder()
+	writeStorageError(resp, err)
+	if resp.Code != ErrDigestInvalid.Status {
+		t.Errorf("expected status %d, got %d", ErrDigestInvalid.Status, resp.Code)
+	}
+}
+
+func TestFallbackStorageReadOnlyUnwrap(t *testing.T) {
+	cause := errors.New("disk on fire")
+	err := error(&readOnlyError{retry: time.Second, cause: cause})
+	if !errors.Is(err, cause) {
+		t.Error("read only error does not unwrap to its cause")
+	}
+}
@@ -5,6 +5,7 @@ go 1.18
 require (
 	github.com/containers/image/v5 v5.21.1
 	github.com/google/uuid v1.3.0
+	github.com/opencontainers/image-spec v1.0.3-0.20211202193544-a5463b7f9c84
 	k8s.io/klog v1.0.0
 )
 
@@ -13,7 +14,6 @@ require (
 	github.com/containers/ocicrypt v1.1.4-0.20220428134531-566b808bdf6f // indirect
 	github.com/docker/docker v20.10.14+incompatible // indirect
 	github.com/opencontainers/go-digest v1.0.0 // indirect
-	github.com/opencontainers/image-spec v1.0.3-0.20211202193544-a5463b7f9c84 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/sirupsen/logrus v1.8.1 // indirect
 	golang.org/x/sys v0.0.0-20220422013727-9388b58f7150 // indirect
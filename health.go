@@ -0,0 +1,174 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+const (
+	// probeRepo and probeImage compose the reserved location used by the storage health
+	// probe. Hidden names are never accepted from clients nor listed.
+	probeRepo  = ".health"
+	probeImage = ".probe"
+)
+
+// probeData is the content written and read back by the storage health probe.
+var probeData = []byte("registry storage health probe")
+
+// health keeps the result of the last storage health probe.
+type health struct {
+	sync.Mutex
+	interval time.Duration
+	err      error
+}
+
+// set records the result of a probe.
+func (h *health) set(err error) {
+	h.Lock()
+	defer h.Unlock()
+	h.err = err
+}
+
+// get returns the result of the last probe.
+func (h *health) get() error {
+	h.Lock()
+	defer h.Unlock()
+	return h.err
+}
+
+// probe does a put, get and delete round trip against the provided storage.
+func (h *health) probe(storage Storage) error {
+	hash := DigestOf(probeData).String()
+	if err := storage.PutBlob(probeRepo, probeImage, hash, bytes.NewReader(probeData)); err != nil {
+		// a storage that has fallen back to read only mode is still serving pulls so we
+		// keep reporting it as healthy.
+		var roerr *readOnlyError
+		if errors.As(err, &roerr) {
+			return nil
+		}
+		return fmt.Errorf("unable to write probe: %w", err)
+	}
+
+	blob, _, err := storage.GetBlob(probeRepo, probeImage, hash)
+	if err != nil {
+		return fmt.Errorf("unable to read probe: %w", err)
+	}
+	defer blob.Close()
+
+	data, err := io.ReadAll(blob)
+	if err != nil {
+		return fmt.Errorf("unable to read probe: %w", err)
+	}
+
+	if !bytes.Equal(data, probeData) {
+		return fmt.Errorf("probe content mismatch")
+	}
+
+	if deleter, ok := storage.(BlobDeleter); ok {
+		err := deleter.DeleteBlob(probeRepo, probeImage, hash)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("unable to delete probe: %w", err)
+		}
+	}
+	return nil
+}
+
+// run probes the storage once every interval until the provided context is done.
+func (h *health) run(ctx context.Context, storage Storage, wg *sync.WaitGroup) {
+	defer wg.Done()
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		err := h.probe(storage)
+		if err != nil {
+			klog.Errorf("storage health probe failed: %s", err)
+		}
+		h.set(err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// newHealth returns a health reporting the storage as not ready until the first probe runs.
+func newHealth(interval time.Duration) *health {
+	return &health{
+		interval: interval,
+		err:      fmt.Errorf("storage not probed yet"),
+	}
+}
+
+// readyz replies with 200 if the registry is ready to serve requests. If a storage health check
+// has been configured (see WithStorageHealthCheck) the result of the last probe is reported.
+// If a minimum amount of free space has been configured (see WithMinFreeSpace) the registry is
+// reported as not ready once the storage free space drops below it.
+func (r *Registry) readyz(resp http.ResponseWriter) {
+	if r.health != nil {
+		if err := r.health.get(); err != nil {
+			ErrUnavailable.Write(resp)
+			return
+		}
+	}
+
+	if r.minfree > 0 {
+		if usage, ok := r.diskUsage(); ok && usage.Free < r.minfree {
+			klog.Errorf("storage free space below threshold: %d bytes free", usage.Free)
+			ErrUnavailable.Write(resp)
+			return
+		}
+	}
+	resp.WriteHeader(http.StatusOK)
+}
+
+// diskUsage returns the usage of the filesystem backing the storage. Returns false if the
+// storage is unable to report it.
+func (r *Registry) diskUsage() (DiskUsage, bool) {
+	reporter, ok := r.storage.(SpaceReporter)
+	if !ok {
+		return DiskUsage{}, false
+	}
+
+	usage, err := reporter.DiskUsage()
+	if err != nil {
+		klog.Errorf("unable to read storage disk usage: %s", err)
+		return DiskUsage{}, false
+	}
+	return usage, true
+}
+
+// serveDiskUsage replies with the usage of the filesystem backing the storage as json. Storages
+// unable to report it are reported with an "unknown" status.
+func (r *Registry) serveDiskUsage(resp http.ResponseWriter, request Request) {
+	if !request.IsGet() {
+		ErrUnsupported.Write(resp)
+		return
+	}
+
+	reply := map[string]interface{}{"status": "unknown"}
+	if usage, ok := r.diskUsage(); ok {
+		reply = map[string]interface{}{
+			"status": "ok",
+			"total":  usage.Total,
+			"used":   usage.Used,
+			"free":   usage.Free,
+		}
+	}
+
+	resp.Header().Set("content-type", "application/json")
+	if err := json.NewEncoder(resp).Encode(reply); err != nil {
+		klog.Errorf("unable to encode disk usage: %s", err)
+	}
+}
@@ -0,0 +1,51 @@
+package registry
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHealthProbeCleanup(t *testing.T) {
+	backend := newTestStorage(t)
+	storage, err := NewEncryptedStorage(backend, []byte(strings.Repeat("k", 32)))
+	if err != nil {
+		t.Fatalf("unable to create encrypted storage: %s", err)
+	}
+
+	if err := newHealth(0).probe(storage); err != nil {
+		t.Fatalf("probe failed: %s", err)
+	}
+
+	tags, err := os.ReadDir(filepath.Join(backend.basedir, probeRepo, probeImage, "tags"))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatalf("unable to list probe tags: %s", err)
+	}
+
+	for _, tag := range tags {
+		t.Errorf("probe left tag %s behind", tag.Name())
+	}
+
+	if _, err := storage.StatBlob(probeRepo, probeImage, DigestOf(probeData).String()); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("probe left its blob behind: %v", err)
+	}
+}
+
+func TestHiddenNamesRefused(t *testing.T) {
+	server, _ := newTestServer(t)
+
+	hash := DigestOf(probeData).String()
+	for _, path := range []string{
+		"/v2/" + probeRepo + "/" + probeImage + "/blobs/" + hash,
+		"/v2/repo/.hidden/manifests/latest",
+		"/v2//image/manifests/latest",
+	} {
+		resp, body := do(t, server, http.MethodGet, path, "", nil)
+		if resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(body), "NAME_INVALID") {
+			t.Errorf("GET %s: unexpected reply %d: %s", path, resp.StatusCode, body)
+		}
+	}
+}
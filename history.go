@@ -0,0 +1,139 @@
+package registry
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"k8s.io/klog"
+)
+
+// tagHistoryReply is the reply sent to requests for a tag history.
+type tagHistoryReply struct {
+	Name    string   `json:"name"`
+	Tag     string   `json:"tag"`
+	History []string `json:"history"`
+}
+
+// historyPath extracts the repository, image, tag and action from an admin tag url, i.e.
+// /admin/tags/<repository>/<image>/<tag>/<action>. If the Authorizer has set a namespace for
+// the request it is returned as the repository.
+func historyPath(request Request) (string, string, string, string, bool) {
+	path := strings.TrimPrefix(request.URL.Path, "/admin/tags/")
+	parts := strings.Split(path, "/")
+	if len(parts) != 4 {
+		return "", "", "", "", false
+	}
+
+	for _, part := range parts {
+		if part == "" {
+			return "", "", "", "", false
+		}
+	}
+
+	repo := parts[0]
+	if ns, ok := NamespaceFromContext(request.Context()); ok {
+		repo = ns
+	}
+	return repo, parts[1], parts[2], parts[3], true
+}
+
+// recordTagHistory stores the digest the tag currently points to in the tag history, this is
+// meant to be called right before the tag is overwritten. Tags being created or pointing to
+// the same digest are not recorded.
+func (m *ManifestHandler) recordTagHistory(repo, image, tag, hash string) error {
+	historian, ok := m.storage.(TagHistorian)
+	if m.history <= 0 || !ok {
+		return nil
+	}
+
+	prev, err := m.storage.ResolveTag(repo, image, tag)
+	if err != nil || prev == hash {
+		return nil
+	}
+	return historian.PutTagHistory(repo, image, tag, prev, m.history)
+}
+
+// serveTagHistory handles the admin tag history endpoints. A GET against .../history returns
+// the digests the tag pointed to, newest first, while a POST against .../rollback?digest=<d>
+// points the tag back to one of the digests in its history.
+func (m *ManifestHandler) serveTagHistory(resp http.ResponseWriter, request Request) {
+	repo, image, tag, action, ok := historyPath(request)
+	if !ok {
+		ErrUnsupported.Write(resp)
+		return
+	}
+
+	historian, ok := m.storage.(TagHistorian)
+	if !ok {
+		ErrUnsupported.Write(resp)
+		return
+	}
+
+	history, err := historian.TagHistory(repo, image, tag)
+	if err != nil {
+		klog.Errorf("unable to read tag history: %s", err)
+		ErrInternal(err).Write(resp)
+		return
+	}
+
+	switch {
+	case action == "history" && request.IsGet():
+		resp.Header().Set("content-type", "application/json")
+		reply := tagHistoryReply{
+			Name:    repo + "/" + image,
+			Tag:     tag,
+			History: history,
+		}
+		if err := json.NewEncoder(resp).Encode(reply); err != nil {
+			klog.Errorf("unable to encode tag history: %s", err)
+		}
+	case action == "rollback" && request.IsPost():
+		m.rollbackTag(resp, request, repo, image, tag, history)
+	default:
+		ErrUnsupported.Write(resp)
+	}
+}
+
+// rollbackTag points the tag to the digest provided in the request. Only digests present in
+// the tag history are accepted. The tag is stored as if pushed, see putTag, so the digest it
+// pointed to before the rollback is recorded in the history and a rollback can be undone.
+func (m *ManifestHandler) rollbackTag(resp http.ResponseWriter, request Request, repo, image, tag string, history []string) {
+	hash := request.UploadDigest()
+	found := false
+	for _, entry := range history {
+		if entry == hash {
+			found = true
+			break
+		}
+	}
+
+	if hash == "" || !found {
+		klog.Errorf("digest %q not in %s/%s:%s history", hash, repo, image, tag)
+		ErrUnknownManifest.Write(resp)
+		return
+	}
+
+	allowed, err := m.canTag(repo, image, tag)
+	if err != nil {
+		klog.Errorf("error verifying tags: %s", err)
+		ErrInternal(err).Write(resp)
+		return
+	}
+
+	if !allowed {
+		klog.Errorf("too many tags, refusing %s/%s:%s", repo, image, tag)
+		ErrTooManyTags.Write(resp)
+		return
+	}
+
+	if err := m.putTag(request.Context(), repo, image, tag, hash); err != nil {
+		klog.Errorf("error rolling tag back: %s", err)
+		writeStorageError(resp, err)
+		return
+	}
+
+	klog.Infof("tag %s/%s:%s rolled back to %s", repo, image, tag, hash)
+	resp.Header().Set("docker-content-digest", hash)
+	resp.WriteHeader(http.StatusNoContent)
+}
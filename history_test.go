@@ -0,0 +1,110 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// tagRecorder is an EventHandler keeping track of the tags it is notified about.
+type tagRecorder struct {
+	sync.Mutex
+	tags []string
+}
+
+// NewTag records the tag.
+func (r *tagRecorder) NewTag(_ context.Context, repo, image, tag string) error {
+	r.Lock()
+	defer r.Unlock()
+	r.tags = append(r.tags, repo+"/"+image+":"+tag)
+	return nil
+}
+
+func TestRollbackTag(t *testing.T) {
+	audit := &bytes.Buffer{}
+	events := &tagRecorder{}
+	server, _ := newTestServer(
+		t,
+		WithTagHistory(5),
+		WithAuditLog(audit),
+		WithEventHandler(events),
+		WithStorageEncryption([]byte(strings.Repeat("k", 32))),
+	)
+
+	mtype := "application/vnd.oci.image.manifest.v1+json"
+	first := DigestOf([]byte(testManifest)).String()
+	second := strings.Replace(testManifest, `"layers":[]`, `"layers":[],"annotations":{"a":"b"}`, 1)
+	pushManifest(t, server, "repo", "image", "latest", mtype, []byte(testManifest))
+	pushManifest(t, server, "repo", "image", "latest", mtype, []byte(second))
+
+	resp, body := do(t, server, http.MethodGet, "/admin/tags/repo/image/latest/history", "", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status reading history: %d: %s", resp.StatusCode, body)
+	}
+
+	var history tagHistoryReply
+	if err := json.Unmarshal(body, &history); err != nil {
+		t.Fatalf("unable to parse history: %s", err)
+	}
+
+	if len(history.History) != 1 || history.History[0] != first {
+		t.Fatalf("unexpected history: %v", history.History)
+	}
+
+	resp, body = do(t, server, http.MethodPost, "/admin/tags/repo/image/latest/rollback?digest="+first, "", nil)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("unexpected status rolling back: %d: %s", resp.StatusCode, body)
+	}
+
+	if resp, _ := do(t, server, http.MethodHead, "/v2/repo/image/manifests/latest", "", nil); resp.Header.Get("docker-content-digest") != first {
+		t.Errorf("tag not rolled back, points to %s", resp.Header.Get("docker-content-digest"))
+	}
+
+	if len(events.tags) != 3 {
+		t.Errorf("expected 3 new tag events, got %v", events.tags)
+	}
+
+	var rollback *auditRecord
+	for _, line := range strings.Split(strings.TrimSpace(audit.String()), "\n") {
+		var rec auditRecord
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatalf("unable to parse audit record: %s", err)
+		}
+		if rec.Operation == "rollback-tag" {
+			rollback = &rec
+		}
+	}
+
+	if rollback == nil {
+		t.Fatalf("rollback not audited: %s", audit)
+	}
+
+	if rollback.Repository != "repo" || rollback.Image != "image" || rollback.Reference != "latest" ||
+		rollback.Digest != first || rollback.Result != "success" {
+		t.Errorf("unexpected rollback audit record: %+v", rollback)
+	}
+}
+
+func TestRollbackTagMaxTags(t *testing.T) {
+	server, _ := newTestServer(t, WithTagHistory(5), WithMaxTagsPerRepo(1), WithAllowDeleteByDigest(true))
+
+	mtype := "application/vnd.oci.image.manifest.v1+json"
+	first := DigestOf([]byte(testManifest)).String()
+	second := strings.Replace(testManifest, `"layers":[]`, `"layers":[],"annotations":{"a":"b"}`, 1)
+	pushManifest(t, server, "repo", "image", "old", mtype, []byte(testManifest))
+	pushManifest(t, server, "repo", "image", "old", mtype, []byte(second))
+
+	if resp, body := do(t, server, http.MethodDelete, "/v2/repo/image/manifests/old", "", nil); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("unexpected status deleting tag: %d: %s", resp.StatusCode, body)
+	}
+	pushManifest(t, server, "repo", "image", "new", mtype, []byte(second))
+
+	resp, body := do(t, server, http.MethodPost, "/admin/tags/repo/image/old/rollback?digest="+first, "", nil)
+	if resp.StatusCode != http.StatusConflict || !strings.Contains(string(body), "TOO_MANY_TAGS") {
+		t.Errorf("unexpected reply rolling back beyond the tag limit: %d: %s", resp.StatusCode, body)
+	}
+}
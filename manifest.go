@@ -2,15 +2,20 @@ package registry
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"path"
 	"strings"
+	"time"
 
 	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/types"
 	"k8s.io/klog"
 )
 
@@ -20,57 +25,558 @@ type ManifestTag struct {
 	ContentType string `json:"contentType"`
 }
 
+// manifestFields holds the manifest (or image index) fields we inspect when a manifest is
+// pushed. Only the digests of image index children are kept out of the descriptors, this way
+// parsing a large manifest does not hold its content in memory.
+type manifestFields struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	MediaType     string `json:"mediaType"`
+	Config        *struct {
+		MediaType string `json:"mediaType"`
+	} `json:"config"`
+	Layers    []struct{} `json:"layers"`
+	Manifests []struct {
+		Digest string `json:"digest"`
+	} `json:"manifests"`
+	Subject *struct {
+		Digest string `json:"digest"`
+	} `json:"subject"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+// isIndex returns true if the manifest, pushed with the provided content type, is an image
+// index (or manifest list). Without a content type manifests are told apart the same way
+// manifest.GuessMIMEType does.
+func (m manifestFields) isIndex(ctype string) bool {
+	if ctype != "" {
+		return manifest.MIMETypeIsMultiImage(ctype)
+	}
+
+	unknownConfig := m.Config == nil || m.Config.MediaType == ""
+	return m.SchemaVersion == 2 && unknownConfig && len(m.Manifests) > 0
+}
+
+// subject returns the digest of the manifest subject or an empty string if the manifest has no
+// subject.
+func (m manifestFields) subject() string {
+	if m.Subject == nil {
+		return ""
+	}
+	return m.Subject.Digest
+}
+
+// parseManifestReferences returns the digests of all descriptors referenced by the provided
+// manifest. For image manifests these are the config and the layers while for image indexes
+// (or manifest lists) these are the child manifests. If the content type is empty we attempt
+// to guess it from the manifest content.
+func parseManifestReferences(data []byte, ctype string) ([]string, error) {
+	if ctype == "" {
+		ctype = manifest.GuessMIMEType(data)
+	}
+
+	if manifest.MIMETypeIsMultiImage(ctype) {
+		list, err := manifest.ListFromBlob(data, ctype)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse manifest list: %w", err)
+		}
+
+		var refs []string
+		for _, dgst := range list.Instances() {
+			refs = append(refs, dgst.String())
+		}
+		return refs, nil
+	}
+
+	man, err := manifest.FromBlob(data, ctype)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse manifest: %w", err)
+	}
+
+	var refs []string
+	if config := man.ConfigInfo(); config.Digest != "" {
+		refs = append(refs, config.Digest.String())
+	}
+	for _, layer := range man.LayerInfos() {
+		refs = append(refs, layer.Digest.String())
+	}
+	return refs, nil
+}
+
+// PlatformManifest is a child manifest of an image index together with the platform it is
+// meant for.
+type PlatformManifest struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant,omitempty"`
+	Digest       string `json:"digest"`
+}
+
+// parsePlatforms returns the child manifests of the provided image index (or manifest list)
+// together with their platforms. Children without a platform are returned with empty os and
+// architecture.
+func parsePlatforms(data []byte, ctype string) ([]PlatformManifest, error) {
+	list, err := manifest.ListFromBlob(data, ctype)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse manifest list: %w", err)
+	}
+
+	platforms := []PlatformManifest{}
+	switch list := list.(type) {
+	case *manifest.OCI1Index:
+		for _, child := range list.Manifests {
+			platform := PlatformManifest{Digest: child.Digest.String()}
+			if child.Platform != nil {
+				platform.OS = child.Platform.OS
+				platform.Architecture = child.Platform.Architecture
+				platform.Variant = child.Platform.Variant
+			}
+			platforms = append(platforms, platform)
+		}
+	case *manifest.Schema2List:
+		for _, child := range list.Manifests {
+			platforms = append(platforms, PlatformManifest{
+				OS:           child.Platform.OS,
+				Architecture: child.Platform.Architecture,
+				Variant:      child.Platform.Variant,
+				Digest:       child.Digest.String(),
+			})
+		}
+	default:
+		return nil, fmt.Errorf("unsupported manifest list type %s", list.MIMEType())
+	}
+	return platforms, nil
+}
+
+// ManifestValidator is a function called for each manifest being pushed, after our built-in
+// validations pass and before the manifest is stored. Receives the repository, the image, the
+// manifest content type and its content. A non nil returned Error aborts the push and is sent
+// to the client.
+type ManifestValidator func(context.Context, string, string, string, []byte) *Error
+
+// AnnotationPolicy is a function called for each manifest being pushed with the manifest
+// annotations, an empty map if the manifest has none. A non nil returned Error aborts the push
+// and is sent to the client.
+type AnnotationPolicy func(map[string]string) *Error
+
+// ManifestTransform is a function called for each manifest being pushed by tag, receives the
+// manifest content type and its content and returns the content to be stored instead. As the
+// stored content is what determines the manifest digest, a transform changing the content
+// makes the digest differ from the one computed by the client.
+type ManifestTransform func(string, []byte) ([]byte, error)
+
 // ManifestHandler handles all manifest related operations.
 type ManifestHandler struct {
-	storage    *StorageHandler
-	evthandler EventHandler
+	storage Storage
+	events  *events
+	maxrefs int
+	maxtags int
+	maxsize int64
+	vldtor  ManifestValidator
+	deftag  string
+	convert bool
+	nodgst  bool
+	history int
+	pulls   *pullCounter
+	deldgst bool
+	subjreq []string
+	defplat *types.SystemContext
+	xform   ManifestTransform
+	annpol  AnnotationPolicy
+	spool   int64
+	upload  *UploadHandler
+}
+
+// canTag returns false if the provided tag can't be created because the image already holds
+// the maximum number of tags. Overwriting an existing tag is always allowed.
+func (m *ManifestHandler) canTag(repo, image, tag string) (bool, error) {
+	if m.maxtags <= 0 {
+		return true, nil
+	}
+
+	if _, err := m.storage.ResolveTag(repo, image, tag); err == nil {
+		return true, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+
+	tags, err := m.storage.ListTags(repo, image)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+	return len(tags) < m.maxtags, nil
+}
+
+// putTag points the provided tag to the provided manifest hash. The digest the tag pointed to
+// is recorded in the tag history first, see WithTagHistory. Once the tag is stored the event
+// handler is notified and the tag is queued for replication.
+func (m *ManifestHandler) putTag(ctx context.Context, repo, image, tag, hash string) error {
+	if err := m.recordTagHistory(repo, image, tag, hash); err != nil {
+		return fmt.Errorf("unable to save tag history: %w", err)
+	}
+
+	if err := m.storage.PutTag(repo, image, tag, hash); err != nil {
+		return fmt.Errorf("unable to save tag: %w", err)
+	}
+
+	if err := m.events.fireNewTag(ctx, repo, image, tag); err != nil {
+		return fmt.Errorf("event handler failed: %w", err)
+	}
+	return nil
+}
+
+// requiresSubject returns true if manifests pushed to the provided repository and image must
+// carry a subject, see WithRequireSubject.
+func (m *ManifestHandler) requiresSubject(repo, image string) bool {
+	for _, pattern := range m.subjreq {
+		if matched, _ := path.Match(pattern, repo+"/"+image); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks the provided manifest does not refer to more descriptors than the configured
+// limit. Returns the manifest content type, if both the request content type and the manifest
+// media type are present they must agree. An empty string is returned if neither of them is
+// present.
+func (m *ManifestHandler) validate(request Request, fields manifestFields) (string, error) {
+	if subject := fields.subject(); subject != "" && !validDigest(subject) {
+		return "", fmt.Errorf("invalid subject digest %q", subject)
+	}
+
+	refs := len(fields.Layers) + len(fields.Manifests)
+	if fields.Config != nil {
+		refs++
+	}
+
+	if m.maxrefs > 0 && refs > m.maxrefs {
+		return "", fmt.Errorf("manifest refers to %d descriptors, limit is %d", refs, m.maxrefs)
+	}
+
+	ctype := strings.TrimSpace(strings.Split(request.ContentType(), ";")[0])
+	switch {
+	case ctype == "":
+		return fields.MediaType, nil
+	case fields.MediaType == "":
+		return ctype, nil
+	case ctype != fields.MediaType:
+		return "", fmt.Errorf("content type %q differs from media type %q", ctype, fields.MediaType)
+	}
+	return ctype, nil
+}
+
+// indexChildren returns the child manifests referred by the provided manifest if it is an
+// image index (or manifest list), for other manifests nil is returned. All children must be
+// present in the storage. Children are taken from the parsed manifest fields so the manifest
+// content is never read into memory.
+func (m *ManifestHandler) indexChildren(repo, image, ctype string, fields manifestFields) ([]string, *Error) {
+	if !fields.isIndex(ctype) {
+		return nil, nil
+	}
+
+	children := make([]string, 0, len(fields.Manifests))
+	for _, child := range fields.Manifests {
+		if !validDigest(child.Digest) {
+			klog.Errorf("invalid image index child digest %q", child.Digest)
+			return nil, ErrManifestInvalid
+		}
+
+		if _, err := m.storage.StatBlob(repo, image, child.Digest); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				klog.Errorf("image index refers to unknown manifest %s", child.Digest)
+				return nil, ErrManifestBlobUnknown
+			}
+			klog.Errorf("error verifying image index child: %s", err)
+			return nil, ErrInternal(err)
+		}
+		children = append(children, child.Digest)
+	}
+	return children, nil
+}
+
+// transform applies the configured ManifestTransform to a manifest. The transformed manifest
+// goes through our built-in validations again. Returns the transformed content together with
+// its parsed fields and content type.
+func (m *ManifestHandler) transform(request Request, ctype string, data []byte) ([]byte, manifestFields, string, *Error) {
+	var fields manifestFields
+	data, err := m.xform(ctype, data)
+	if err != nil {
+		klog.Errorf("unable to transform manifest: %s", err)
+		return nil, fields, "", ErrManifestInvalid
+	}
+
+	if int64(len(data)) > m.maxsize {
+		klog.Errorf("transformed manifest too large: %d bytes", len(data))
+		return nil, fields, "", ErrManifestTooLarge
+	}
+
+	if err := json.Unmarshal(data, &fields); err != nil {
+		klog.Errorf("unable to parse transformed manifest: %s", err)
+		return nil, fields, "", ErrManifestInvalid
+	}
+
+	if ctype, err = m.validate(request, fields); err != nil {
+		klog.Errorf("invalid transformed manifest: %s", err)
+		return nil, fields, "", ErrManifestInvalid
+	}
+	return data, fields, ctype, nil
+}
+
+// readManifest reads the manifest being pushed, writing it to the provided hasher on the way.
+// Manifests larger than the spool threshold are written to a temporary file, in the upload
+// directory, instead of being kept in memory. Manifests larger than the maximum manifest size
+// are refused either way. Caller must Close the returned body.
+func (m *ManifestHandler) readManifest(request Request, hasher io.Writer) (*manifestBody, *Error) {
+	inmem := m.maxsize
+	if m.upload != nil && m.spool > 0 && m.spool < m.maxsize {
+		inmem = m.spool
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if request.ContentLength > 0 && request.ContentLength <= inmem {
+		buf.Grow(int(request.ContentLength))
+	}
+
+	body := &manifestBody{}
+	from := io.TeeReader(io.LimitReader(request.Body, m.maxsize+1), hasher)
+	written, err := io.CopyN(buf, from, inmem+1)
+	if err == nil && inmem < m.maxsize {
+		written, err = body.spool(m.upload, io.MultiReader(buf, from))
+	}
+	if body.file == nil {
+		body.data = buf.Bytes()
+	}
+	body.size = written
+
+	if errors.Is(err, errBodyTooLarge) {
+		body.Close()
+		klog.Errorf("error copying manifest blob: %s", err)
+		return nil, ErrRequestTooLarge
+	} else if err != nil && !errors.Is(err, io.EOF) {
+		body.Close()
+		klog.Errorf("error copying manifest blob: %s", err)
+		return nil, ErrInternal(err)
+	} else if written > m.maxsize {
+		body.Close()
+		klog.Errorf("manifest too large: more than %d bytes", m.maxsize)
+		return nil, ErrManifestTooLarge
+	}
+	return body, nil
+}
+
+// putManifestBlob writes the manifest content to the storage. The event handler is notified if
+// this is the first content stored for the repository and image.
+func (m *ManifestHandler) putManifestBlob(request Request, repo, image, hash string, body *manifestBody) *Error {
+	created := m.events.isNewImage(m.storage, repo, image)
+	from, err := body.reader()
+	if err != nil {
+		klog.Errorf("unable to read manifest: %s", err)
+		return ErrInternal(err)
+	}
+
+	if err := m.storage.PutBlob(repo, image, hash, from); err != nil {
+		klog.Errorf("error saving manifest blob: %s", err)
+		return storageError(err)
+	}
+
+	if !created {
+		return nil
+	}
+
+	if err := m.events.fireNewRepository(request.Context(), repo, image); err != nil {
+		klog.Errorf("event handler failed: %s", err)
+		return ErrInternal(err)
+	}
+	return nil
+}
+
+// stored returns true if the manifest with the provided hash is already in the storage with
+// the provided size.
+func (m *ManifestHandler) stored(repo, image, hash string, size int64) bool {
+	stored, err := m.storage.StatBlob(repo, image, hash)
+	return err == nil && stored == size
 }
 
 // StoreManifest stores a manifest in our underlying storage.
 func (m *ManifestHandler) StoreManifest(resp http.ResponseWriter, request Request) {
 	manid := request.ManifestID()
+	if manid == "" {
+		klog.Errorf("empty manifest reference")
+		ErrManifestInvalid.Write(resp)
+		return
+	}
+
+	if !isDigestReference(manid) && !validTag(manid) {
+		klog.Errorf("invalid tag %q", manid)
+		ErrTagInvalid.Write(resp)
+		return
+	}
+
 	repo, image, err := request.RepositoryAndImage()
 	if err != nil {
 		klog.Errorf("error parsing repo/image: %s", err)
-		ErrInternal(err).Write(resp)
+		ErrNameInvalid.Write(resp)
+		return
+	}
+
+	// we read the manifest only once, hashing it on the way, and limit how much we are willing
+	// to take. Large manifests are spooled to disk instead of being held in memory.
+	if request.ContentLength > m.maxsize {
+		klog.Errorf("manifest too large: %d bytes", request.ContentLength)
+		ErrManifestTooLarge.Write(resp)
 		return
 	}
 
 	hasher := sha256.New()
-	buf := bytes.NewBuffer(nil)
-	to := io.MultiWriter(buf, hasher)
-	if _, err := io.Copy(to, request.Body); err != nil {
-		klog.Errorf("error copying manifest blob: %s", err)
-		ErrInternal(err).Write(resp)
+	body, rerr := m.readManifest(request, hasher)
+	if rerr != nil {
+		rerr.Write(resp)
 		return
 	}
+	defer body.Close()
 
-	hash := fmt.Sprintf("sha256:%x", hasher.Sum(nil))
-	if err := m.storage.PutBlob(repo, image, hash, buf); err != nil {
-		klog.Errorf("error saving manifest blob: %s", err)
-		ErrInternal(err).Write(resp)
+	fields, err := body.decode()
+	if err != nil {
+		klog.Errorf("unable to parse manifest: %s", err)
+		ErrManifestInvalid.Write(resp)
 		return
 	}
 
-	if strings.HasPrefix(manid, "sha256:") {
-		klog.Infof("new manifest upload %s/%s@%s", repo, image, manid)
-		resp.WriteHeader(http.StatusCreated)
+	ctype, err := m.validate(request, fields)
+	if err != nil {
+		klog.Errorf("invalid manifest: %s", err)
+		ErrManifestInvalid.Write(resp)
 		return
 	}
 
-	if err := m.storage.PutTag(repo, image, manid, hash); err != nil {
-		klog.Errorf("error saving manifest tag file: %s", err)
-		ErrInternal(err).Write(resp)
+	// manifests pushed by digest are never transformed, the client expects them to be
+	// stored under the digest it has computed.
+	if m.xform != nil && !isDigestReference(manid) {
+		data, err := body.content()
+		if err != nil {
+			klog.Errorf("unable to read manifest: %s", err)
+			ErrInternal(err).Write(resp)
+			return
+		}
+
+		data, tfields, tctype, terr := m.transform(request, ctype, data)
+		if terr != nil {
+			terr.Write(resp)
+			return
+		}
+
+		body, fields, ctype = newManifestBody(data), tfields, tctype
+		hasher.Reset()
+		hasher.Write(data)
+	}
+
+	if fields.subject() == "" && m.requiresSubject(repo, image) {
+		klog.Errorf("manifest without subject refused for %s/%s", repo, image)
+		ErrManifestInvalid.Write(resp)
+		return
+	}
+
+	if m.annpol != nil {
+		annotations := fields.Annotations
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+
+		if err := m.annpol(annotations); err != nil {
+			klog.Errorf("manifest refused by annotation policy: %s", err.Message)
+			err.Write(resp)
+			return
+		}
+	}
+
+	if m.vldtor != nil {
+		data, err := body.content()
+		if err != nil {
+			klog.Errorf("unable to read manifest: %s", err)
+			ErrInternal(err).Write(resp)
+			return
+		}
+
+		if err := m.vldtor(request.Context(), repo, image, ctype, data); err != nil {
+			klog.Errorf("manifest refused by validator: %s", err.Message)
+			err.Write(resp)
+			return
+		}
+	}
+
+	children, ierr := m.indexChildren(repo, image, ctype, fields)
+	if ierr != nil {
+		ierr.Write(resp)
 		return
 	}
 
-	if m.evthandler != nil {
-		err := m.evthandler.NewTag(request.Context(), repo, image, manid)
+	if !isDigestReference(manid) {
+		allowed, err := m.canTag(repo, image, manid)
 		if err != nil {
-			klog.Errorf("event handler failed: %s", err)
+			klog.Errorf("error verifying tags: %s", err)
 			ErrInternal(err).Write(resp)
 			return
 		}
+
+		if !allowed {
+			klog.Errorf("too many tags, refusing %s/%s:%s", repo, image, manid)
+			ErrTooManyTags.Write(resp)
+			return
+		}
+	}
+
+	hash := digestFromHash(hasher).String()
+	if isDigestReference(manid) && !strings.EqualFold(manid, hash) {
+		klog.Errorf("manifest pushed as %s but its digest is %s", manid, hash)
+		digestMismatch(manid, hash).Write(resp)
+		return
+	}
+
+	// a manifest pushed by digest is immutable as its content is its name, if we already
+	// hold it the blob is not written again. what we record about it is, as it may have
+	// been lost or may predate the recording.
+	if isDigestReference(manid) && m.stored(repo, image, hash, body.size) {
+		klog.Infof("manifest %s/%s@%s already stored", repo, image, hash)
+	} else if rerr := m.putManifestBlob(request, repo, image, hash, body); rerr != nil {
+		rerr.Write(resp)
+		return
+	}
+
+	if ctype != "" {
+		if err := m.storage.PutManifestType(repo, image, hash, ctype); err != nil {
+			klog.Errorf("error saving manifest content type: %s", err)
+			writeStorageError(resp, err)
+			return
+		}
+	}
+
+	for _, child := range children {
+		if err := m.storage.PutIndexChild(repo, image, hash, child); err != nil {
+			klog.Errorf("error saving image index child: %s", err)
+			writeStorageError(resp, err)
+			return
+		}
+	}
+
+	if subject := fields.subject(); subject != "" {
+		if err := m.storage.PutReferrer(repo, image, subject, hash); err != nil {
+			klog.Errorf("error saving manifest subject: %s", err)
+			writeStorageError(resp, err)
+			return
+		}
+		resp.Header().Set("oci-subject", subject)
+	}
+
+	if isDigestReference(manid) {
+		klog.Infof("new manifest upload %s/%s@%s", repo, image, manid)
+		resp.WriteHeader(http.StatusCreated)
+		return
+	}
+
+	if err := m.putTag(request.Context(), repo, image, manid, hash); err != nil {
+		klog.Errorf("error tagging manifest: %s", err)
+		writeStorageError(resp, err)
+		return
 	}
 
 	klog.Infof("new manifest tag upload %s/%s:%s", repo, image, manid)
@@ -78,64 +584,624 @@ func (m *ManifestHandler) StoreManifest(resp http.ResponseWriter, request Reques
 	resp.WriteHeader(http.StatusCreated)
 }
 
-// GetManifest returns a manifest from the storage. Reference to the manifest may be made by
-// means of a tag ("latest" for instance) or by the manifest hash (sha256).
-func (m *ManifestHandler) GetManifest(resp http.ResponseWriter, request Request) {
+// resolvedManifest holds a manifest read from the storage together with its size, content type
+// and digest. The content is nil until read, see ManifestHandler.read.
+type resolvedManifest struct {
+	data   []byte
+	size   int64
+	ctype  string
+	digest string
+}
+
+// reference returns the repository, image, manifest reference (tag or digest) and manifest
+// hash the request refers to. Tags are resolved into hashes but the manifest is not read.
+func (m *ManifestHandler) reference(request Request) (string, string, string, string, *Error) {
 	manid := request.ManifestID()
+	if manid == "" {
+		manid = m.deftag
+	}
+
+	if manid == "" {
+		klog.Errorf("empty manifest reference")
+		return "", "", "", "", ErrManifestInvalid
+	}
+
+	if !isDigestReference(manid) && !validTag(manid) {
+		klog.Errorf("invalid tag %q", manid)
+		return "", "", "", "", ErrTagInvalid
+	}
+
 	repo, image, err := request.RepositoryAndImage()
 	if err != nil {
 		klog.Errorf("error parsing image/repo for upload: %s", err)
+		return "", "", "", "", ErrNameInvalid
+	}
+
+	hash := manid
+	if !isDigestReference(manid) {
+		if hash, err = m.storage.ResolveTag(repo, image, manid); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return "", "", "", "", ErrUnknownManifest
+			}
+			klog.Errorf("error resolving manifest tag: %s", err)
+			return "", "", "", "", ErrInternal(err)
+		}
+	}
+	return repo, image, manid, hash, nil
+}
+
+// resolve reads from the storage the manifest referred by the request. Reference to the
+// manifest may be made by means of a tag ("latest" for instance) or by the manifest hash
+// (sha256). If no reference is provided the default tag, if configured, is used. This is the
+// only place where manifests are resolved so HEAD and GET requests always agree. For HEAD
+// requests the manifest content is read only if it is needed to tell what would be served.
+func (m *ManifestHandler) resolve(request Request) (*resolvedManifest, *Error) {
+	repo, image, manid, hash, rerr := m.reference(request)
+	if rerr != nil {
+		return nil, rerr
+	}
+
+	man, rerr := m.load(repo, image, hash, !request.IsHead())
+	if rerr != nil {
+		return nil, rerr
+	}
+
+	// manifests pulled by digest are never replaced by a platform manifest nor converted as
+	// the client expects to receive content matching the digest it asked for.
+	if hash == manid {
+		return man, nil
+	}
+
+	platforms := request.IsPlatformsQuery()
+	if m.defplat != nil && !platforms && manifest.MIMETypeIsMultiImage(man.ctype) && !accepts(request)[man.ctype] {
+		if man, rerr = m.platformManifest(repo, image, man, !request.IsHead()); rerr != nil {
+			return nil, rerr
+		}
+	}
+
+	if m.convert && !platforms {
+		if convfn, _ := conversion(man.ctype, request); convfn != nil {
+			if rerr := m.read(repo, image, man); rerr != nil {
+				return nil, rerr
+			}
+		}
+		man = convert(man, request)
+	}
+	return man, nil
+}
+
+// platformManifest returns the manifest, out of the provided image index, matching the default
+// platform. See WithDefaultPlatform. The content of the returned manifest is read only if full
+// is set.
+func (m *ManifestHandler) platformManifest(repo, image string, index *resolvedManifest, full bool) (*resolvedManifest, *Error) {
+	if rerr := m.read(repo, image, index); rerr != nil {
+		return nil, rerr
+	}
+
+	list, err := manifest.ListFromBlob(index.data, index.ctype)
+	if err != nil {
+		klog.Errorf("unable to parse image index: %s", err)
+		return nil, ErrInternal(err)
+	}
+
+	child, err := list.ChooseInstance(m.defplat)
+	if err != nil {
+		klog.Errorf("no manifest for default platform in %s: %s", index.digest, err)
+		return nil, ErrUnknownManifest
+	}
+	return m.load(repo, image, child.String(), full)
+}
+
+// load returns the manifest stored under the provided hash. The manifest content is only read
+// if full is set, otherwise only its size and content type are. If the manifest content type
+// is unknown it is guessed from the manifest content, which is then read regardless.
+func (m *ManifestHandler) load(repo, image, hash string, full bool) (*resolvedManifest, *Error) {
+	ctype, err := m.storage.GetManifestType(repo, image, hash)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		klog.Errorf("error reading manifest content type: %s", err)
+		return nil, ErrInternal(err)
+	}
+
+	man := &resolvedManifest{ctype: ctype, digest: hash}
+	sniff := ctype == ""
+	if full || sniff {
+		if rerr := m.read(repo, image, man); rerr != nil {
+			return nil, rerr
+		}
+	} else if man.size, err = m.storage.StatBlob(repo, image, hash); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrUnknownManifest
+		}
+		klog.Errorf("error stating manifest: %s", err)
+		return nil, ErrInternal(err)
+	}
+
+	if sniff {
+		man.ctype = manifest.GuessMIMEType(man.data)
+	}
+	if man.ctype == "" {
+		man.ctype = "application/json"
+	}
+	return man, nil
+}
+
+// read reads the content of the provided manifest from the storage, if not read yet.
+func (m *ManifestHandler) read(repo, image string, man *resolvedManifest) *Error {
+	if man.data != nil {
+		return nil
+	}
+
+	manread, _, err := m.storage.GetBlob(repo, image, man.digest)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return ErrUnknownManifest
+		}
+		klog.Errorf("error getting manifest blob: %s", err)
+		return ErrInternal(err)
+	}
+	defer manread.Close()
+
+	mandata, err := io.ReadAll(manread)
+	if err != nil {
+		klog.Errorf("error reading manifest blob: %s", err)
+		return ErrInternal(err)
+	}
+
+	man.data, man.size = mandata, int64(len(mandata))
+	return nil
+}
+
+// writeHeaders writes the headers describing the provided manifest.
+func (m *ManifestHandler) writeHeaders(resp http.ResponseWriter, man *resolvedManifest) {
+	resp.Header().Set("content-length", fmt.Sprint(man.size))
+	resp.Header().Set("content-type", man.ctype)
+	resp.Header().Set("accept-ranges", "bytes")
+	resp.Header().Set("docker-content-digest", man.digest)
+}
+
+// resolveDigest replies only with the digest the requested tag points to. The manifest is not
+// read from the storage so content length and type are not sent.
+func (m *ManifestHandler) resolveDigest(resp http.ResponseWriter, request Request) {
+	repo, image, manid, hash, rerr := m.reference(request)
+	if rerr != nil {
+		rerr.Write(resp)
+		return
+	}
+
+	// tags point to existing manifests, digests must be checked.
+	if hash == manid {
+		if _, err := m.storage.StatBlob(repo, image, hash); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				ErrUnknownManifest.Write(resp)
+				return
+			}
+			klog.Errorf("error stating manifest: %s", err)
+			ErrInternal(err).Write(resp)
+			return
+		}
+	}
+
+	resp.Header().Set("docker-content-digest", hash)
+	resp.WriteHeader(http.StatusOK)
+}
+
+// StatManifest replies with the same headers a GetManifest would, without the manifest. If the
+// request carries a 'resolve=digest' query only the digest is returned, see resolveDigest. The
+// shortcut is not taken if what is served may differ from what the tag points to (conversions
+// or a default platform) as the digest would not match what a GetManifest returns.
+func (m *ManifestHandler) StatManifest(resp http.ResponseWriter, request Request) {
+	if request.Get("resolve") == "digest" && !m.convert && m.defplat == nil {
+		m.resolveDigest(resp, request)
+		return
+	}
+
+	man, err := m.resolve(request)
+	if err != nil {
+		err.Write(resp)
+		return
+	}
+
+	m.writeHeaders(resp, man)
+	resp.WriteHeader(http.StatusOK)
+}
+
+// GetManifest returns a manifest from the storage. See resolve for details on how manifests
+// are referred. Range requests are honoured, only full reads are counted as pulls. The digest
+// header is sent unless disabled through WithDigestHeaderOnGet, its value comes from the tag
+// file so the manifest is never hashed on the way out.
+func (m *ManifestHandler) GetManifest(resp http.ResponseWriter, request Request) {
+	man, err := m.resolve(request)
+	if err != nil {
+		err.Write(resp)
+		return
+	}
+
+	if request.IsPlatformsQuery() {
+		m.servePlatforms(resp, man)
+		return
+	}
+
+	m.writeHeaders(resp, man)
+	if m.nodgst {
+		resp.Header().Del("docker-content-digest")
+	}
+
+	// partial reads are served by the standard library, the same way blobs are. partial,
+	// not modified or unsatisfiable replies are not pulls.
+	recorder := &statusRecorder{ResponseWriter: resp}
+	http.ServeContent(recorder, request.Request, "", time.Time{}, bytes.NewReader(man.data))
+	if recorder.status != http.StatusOK {
+		return
+	}
+
+	if repo, image, err := request.RepositoryAndImage(); err == nil {
+		m.pulls.count(repo, image, man.digest)
+	}
+}
+
+// servePlatforms replies with the platforms and digests of the children of the provided image
+// index as json, instead of the index itself. The reply is not the manifest content so it does
+// not carry a docker-content-digest header, the index digest is part of the json instead.
+func (m *ManifestHandler) servePlatforms(resp http.ResponseWriter, man *resolvedManifest) {
+	if !manifest.MIMETypeIsMultiImage(man.ctype) {
+		klog.Errorf("platforms requested for %s, not an image index", man.digest)
+		ErrManifestInvalid.Write(resp)
+		return
+	}
+
+	platforms, err := parsePlatforms(man.data, man.ctype)
+	if err != nil {
+		klog.Errorf("unable to parse image index: %s", err)
 		ErrInternal(err).Write(resp)
 		return
 	}
 
-	var manread io.ReadCloser
-	var mansize int64
-	if strings.HasPrefix(manid, "sha256:") {
-		manread, mansize, err = m.storage.GetBlob(repo, image, manid)
-	} else {
-		manread, mansize, err = m.storage.GetTag(repo, image, manid)
+	resp.Header().Set("content-type", "application/json")
+	reply := map[string]interface{}{
+		"digest":    man.digest,
+		"platforms": platforms,
+	}
+	if err := json.NewEncoder(resp).Encode(reply); err != nil {
+		klog.Errorf("unable to encode platforms: %s", err)
 	}
+}
 
+// taggedAs returns all tags pointing to the provided manifest hash.
+func (m *ManifestHandler) taggedAs(repo, image, hash string) ([]string, error) {
+	tags, err := m.storage.ListTags(repo, image)
 	if err != nil {
-		if err := errors.Unwrap(err); os.IsNotExist(err) {
-			ErrUnknownManifest.Write(resp)
+		return nil, err
+	}
+
+	var tagged []string
+	for _, tag := range tags {
+		if thash, err := m.storage.ResolveTag(repo, image, tag); err == nil && thash == hash {
+			tagged = append(tagged, tag)
+		}
+	}
+	return tagged, nil
+}
+
+// indexParents returns the image indexes, still stored, referring to the provided manifest hash.
+// Parents are recorded when indexes are pushed and never forgotten so parents deleted since are
+// skipped.
+func (m *ManifestHandler) indexParents(repo, image, hash string) ([]string, error) {
+	recorded, err := m.storage.ListIndexParents(repo, image, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	parents := []string{}
+	for _, parent := range recorded {
+		if _, err := m.storage.StatBlob(repo, image, parent); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+		parents = append(parents, parent)
+	}
+	return parents, nil
+}
+
+// DeleteManifest deletes a manifest tag or, if enabled through WithAllowDeleteByDigest, a
+// manifest by digest. Deleting a tag keeps the manifest it points to. As deleting by digest
+// affects every tag and image index referring to the manifest the reply carries a warning
+// header listing them.
+func (m *ManifestHandler) DeleteManifest(resp http.ResponseWriter, request Request) {
+	repo, image, err := request.RepositoryAndImage()
+	if err != nil {
+		klog.Errorf("unable to parse repo/image: %s", err)
+		ErrNameInvalid.Write(resp)
+		return
+	}
+
+	manid := request.ManifestID()
+	if !isDigestReference(manid) && !validTag(manid) {
+		klog.Errorf("invalid tag %q", manid)
+		ErrTagInvalid.Write(resp)
+		return
+	}
+
+	if !isDigestReference(manid) {
+		deleter, ok := m.storage.(TagDeleter)
+		if !ok {
+			ErrUnsupported.Write(resp)
 			return
 		}
-		klog.Errorf("error getting manifest blob: %s", err)
+
+		if err := deleter.DeleteTag(repo, image, manid); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				ErrUnknownManifest.Write(resp)
+				return
+			}
+			klog.Errorf("error deleting manifest tag: %s", err)
+			writeStorageError(resp, err)
+			return
+		}
+
+		klog.Infof("deleted manifest tag %s/%s:%s", repo, image, manid)
+		writeDeleted(resp)
+		return
+	}
+
+	deleter, ok := m.storage.(BlobDeleter)
+	if !m.deldgst || !ok {
+		klog.Errorf("refusing to delete %s/%s@%s, delete by digest disabled", repo, image, manid)
+		ErrUnsupported.Write(resp)
+		return
+	}
+
+	tagged, err := m.taggedAs(repo, image, manid)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		klog.Errorf("error listing manifest tags: %s", err)
 		ErrInternal(err).Write(resp)
 		return
 	}
-	defer manread.Close()
 
-	mandata, err := io.ReadAll(manread)
+	parents, err := m.indexParents(repo, image, manid)
 	if err != nil {
-		klog.Errorf("error reading manifest blob: %s", err)
+		klog.Errorf("error listing manifest parents: %s", err)
 		ErrInternal(err).Write(resp)
 		return
 	}
 
-	resp.Header().Add("content-length", fmt.Sprint(mansize))
-	resp.Header().Add("content-type", manifest.GuessMIMEType(mandata))
-	resp.Header().Add("content-type", "application/json")
-	resp.Write(mandata)
+	if err := deleter.DeleteBlob(repo, image, manid); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			ErrUnknownManifest.Write(resp)
+			return
+		}
+		klog.Errorf("error deleting manifest: %s", err)
+		writeStorageError(resp, err)
+		return
+	}
+
+	if len(tagged) > 0 {
+		msg := fmt.Sprintf("deleted manifest was still tagged as %s", strings.Join(tagged, ", "))
+		resp.Header().Add("warning", fmt.Sprintf("299 - %q", msg))
+	}
+
+	if len(parents) > 0 {
+		msg := fmt.Sprintf("deleted manifest was still referred to by %s", strings.Join(parents, ", "))
+		resp.Header().Add("warning", fmt.Sprintf("299 - %q", msg))
+	}
+
+	klog.Infof("deleted manifest %s/%s@%s", repo, image, manid)
+	writeDeleted(resp)
 }
 
 // ServeHTTP is our http handler for manifest related requests.
 func (m *ManifestHandler) ServeHTTP(resp http.ResponseWriter, request Request) {
 	switch {
+	case request.IsHead():
+		m.StatManifest(resp, request)
 	case request.IsGet():
 		m.GetManifest(resp, request)
 	case request.IsPut():
 		m.StoreManifest(resp, request)
+	case request.IsDelete():
+		m.DeleteManifest(resp, request)
 	default:
 		ErrUnsupported.Write(resp)
 	}
 }
 
 // NewManifestHandler returns a new http handler manifest related operations.
-func NewManifestHandler(handler *StorageHandler) *ManifestHandler {
+func NewManifestHandler(handler Storage) *ManifestHandler {
 	return &ManifestHandler{
 		storage: handler,
+		maxrefs: 1000,
+		maxsize: 4 << 20,
+		spool:   1 << 20,
+	}
+}
+
+// manifestBody holds the content of a manifest being pushed. Small manifests are kept in
+// memory while large ones are spooled to a temporary file, so they can be validated and stored
+// without holding them in memory.
+type manifestBody struct {
+	data []byte
+	file *tmpFileWrapper
+	size int64
+}
+
+// newManifestBody returns a manifestBody for content already in memory.
+func newManifestBody(data []byte) *manifestBody {
+	return &manifestBody{data: data, size: int64(len(data))}
+}
+
+// spool copies the manifest from the provided reader into a spool file created by the upload
+// handler. Returns the number of bytes written.
+func (b *manifestBody) spool(upload *UploadHandler, from io.Reader) (int64, error) {
+	file, err := upload.spoolFile()
+	if err != nil {
+		return 0, err
+	}
+
+	b.file = file
+	return io.Copy(file, from)
+}
+
+// reader returns a reader for the manifest content, from its beginning.
+func (b *manifestBody) reader() (io.Reader, error) {
+	if b.file == nil {
+		return bytes.NewReader(b.data), nil
+	}
+
+	if _, err := b.file.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("unable to rewind spool file: %w", err)
+	}
+	return b.file, nil
+}
+
+// content returns the whole manifest content. Spooled manifests are read back into memory so
+// this is only called when the content is needed at once, e.g. by a ManifestValidator.
+func (b *manifestBody) content() ([]byte, error) {
+	if b.file == nil {
+		return b.data, nil
+	}
+
+	from, err := b.reader()
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(from)
+}
+
+// decode parses the manifest fields we inspect. Spooled manifests are decoded straight from
+// the spool file, see decodeManifestFields.
+func (b *manifestBody) decode() (manifestFields, error) {
+	from, err := b.reader()
+	if err != nil {
+		return manifestFields{}, err
+	}
+	return decodeManifestFields(from)
+}
+
+// decodeManifestFields parses the manifest fields we inspect out of the provided reader. The
+// manifest is walked token by token, descriptors are decoded one at a time and fields we don't
+// inspect are skipped, this way decoding does not read the whole manifest into memory.
+func decodeManifestFields(from io.Reader) (manifestFields, error) {
+	var fields manifestFields
+	decoder := json.NewDecoder(from)
+	if err := expectDelim(decoder, '{'); err != nil {
+		return fields, err
+	}
+
+	for decoder.More() {
+		key, err := decoder.Token()
+		if err != nil {
+			return fields, err
+		}
+
+		switch key {
+		case "schemaVersion":
+			err = decoder.Decode(&fields.SchemaVersion)
+		case "mediaType":
+			err = decoder.Decode(&fields.MediaType)
+		case "config":
+			err = decoder.Decode(&fields.Config)
+		case "subject":
+			err = decoder.Decode(&fields.Subject)
+		case "annotations":
+			err = decoder.Decode(&fields.Annotations)
+		case "layers":
+			err = decodeArray(decoder, func() error {
+				fields.Layers = append(fields.Layers, struct{}{})
+				return skipValue(decoder)
+			})
+		case "manifests":
+			err = decodeArray(decoder, func() error {
+				var child struct {
+					Digest string `json:"digest"`
+				}
+				if err := decoder.Decode(&child); err != nil {
+					return err
+				}
+				fields.Manifests = append(fields.Manifests, child)
+				return nil
+			})
+		default:
+			err = skipValue(decoder)
+		}
+		if err != nil {
+			return fields, err
+		}
+	}
+
+	if err := expectDelim(decoder, '}'); err != nil {
+		return fields, err
+	}
+
+	if _, err := decoder.Token(); err != io.EOF {
+		return fields, fmt.Errorf("unexpected content after manifest")
+	}
+	return fields, nil
+}
+
+// expectDelim reads the next token, failing if it is not the provided delimiter.
+func expectDelim(decoder *json.Decoder, delim json.Delim) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+
+	if token != delim {
+		return fmt.Errorf("expected %q, found %v", delim, token)
+	}
+	return nil
+}
+
+// decodeArray calls fn once for each element of the array the decoder is positioned at, fn is
+// expected to consume the element. A null is taken as an empty array.
+func decodeArray(decoder *json.Decoder, fn func() error) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+
+	if token == nil {
+		return nil
+	}
+
+	if token != json.Delim('[') {
+		return fmt.Errorf("expected array, found %v", token)
+	}
+
+	for decoder.More() {
+		if err := fn(); err != nil {
+			return err
+		}
+	}
+	return expectDelim(decoder, ']')
+}
+
+// skipValue consumes the value the decoder is positioned at, token by token.
+func skipValue(decoder *json.Decoder) error {
+	var depth int
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+
+		switch token {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+
+		if depth == 0 {
+			return nil
+		}
+	}
+}
+
+// Close removes the spool file, if any.
+func (b *manifestBody) Close() error {
+	if b.file == nil {
+		return nil
 	}
+	return b.file.Close()
 }
@@ -0,0 +1,561 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestValidTag(t *testing.T) {
+	for tag, valid := range map[string]bool{
+		"latest":                 true,
+		"v1.0.0-rc_1":            true,
+		"_private":               true,
+		strings.Repeat("a", 128): true,
+		"":                       false,
+		".encrypted.sha256:abc":  false,
+		".encrypted.sha256-abc":  false,
+		".hidden":                false,
+		"-dash":                  false,
+		"with/slash":             false,
+		"with:colon":             false,
+		strings.Repeat("a", 129): false,
+	} {
+		if got := validTag(tag); got != valid {
+			t.Errorf("validTag(%q): expected %v, got %v", tag, valid, got)
+		}
+	}
+}
+
+func TestHiddenTagsRefused(t *testing.T) {
+	server, reg := newTestServer(t, WithStorageEncryption([]byte(strings.Repeat("k", 32))))
+
+	content := []byte("encrypted layer")
+	hash := pushBlob(t, server, "repo", "image", content)
+	for _, mapping := range []string{".encrypted." + strings.Replace(hash, ":", "-", 1), ".encrypted." + hash} {
+		path := "/v2/repo/image/manifests/" + mapping
+		for _, method := range []string{http.MethodPut, http.MethodDelete, http.MethodGet} {
+			resp, body := do(t, server, method, path, "application/vnd.oci.image.manifest.v1+json", []byte(testManifest))
+			if resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(body), "TAG_INVALID") {
+				t.Errorf("%s %s: unexpected reply %d: %s", method, mapping, resp.StatusCode, body)
+			}
+		}
+	}
+
+	blob, _, err := reg.storage.GetBlob("repo", "image", hash)
+	if err != nil {
+		t.Fatalf("encrypted blob no longer readable: %s", err)
+	}
+	blob.Close()
+}
+
+func TestDeleteReferencedManifest(t *testing.T) {
+	server, _ := newTestServer(t, WithAllowDeleteByDigest(true))
+
+	mtype := "application/vnd.oci.image.manifest.v1+json"
+	child := DigestOf([]byte(testManifest)).String()
+	pushManifest(t, server, "repo", "image", "child", mtype, []byte(testManifest))
+
+	index := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json",` +
+		`"manifests":[{"mediaType":"` + mtype + `","size":1,"digest":"` + child + `"}]}`
+	parent := DigestOf([]byte(index)).String()
+	pushManifest(t, server, "repo", "image", "latest", "application/vnd.oci.image.index.v1+json", []byte(index))
+
+	for _, tt := range []struct {
+		name     string
+		ref      string
+		warnings []string
+	}{
+		{name: "tagged index child", ref: child, warnings: []string{"tagged as child", "referred to by " + parent}},
+		{name: "tag", ref: "latest"},
+		{name: "untagged index", ref: parent},
+	} {
+		path := "/v2/repo/image/manifests/" + tt.ref
+		resp, body := do(t, server, http.MethodDelete, path, "", nil)
+		if resp.StatusCode != http.StatusAccepted {
+			t.Errorf("%s: expected status %d, got %d: %s", tt.name, http.StatusAccepted, resp.StatusCode, body)
+		}
+
+		warnings := resp.Header.Values("warning")
+		if len(warnings) != len(tt.warnings) {
+			t.Errorf("%s: expected %d warnings, got %q", tt.name, len(tt.warnings), warnings)
+			continue
+		}
+
+		for i, warning := range warnings {
+			if !strings.HasPrefix(warning, "299 - ") || !strings.Contains(warning, tt.warnings[i]) {
+				t.Errorf("%s: expected warning about %q, got %q", tt.name, tt.warnings[i], warning)
+			}
+		}
+	}
+}
+
+func TestDeleteTagEncrypted(t *testing.T) {
+	server, _ := newTestServer(t, WithStorageEncryption([]byte(strings.Repeat("k", 32))))
+	pushManifest(t, server, "repo", "image", "latest", "application/vnd.oci.image.manifest.v1+json", []byte(testManifest))
+
+	resp, body := do(t, server, http.MethodDelete, "/v2/repo/image/manifests/latest", "", nil)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("unexpected status deleting tag: %d: %s", resp.StatusCode, body)
+	}
+
+	if resp, _ := do(t, server, http.MethodGet, "/v2/repo/image/manifests/latest", "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("tag still served after removal: %d", resp.StatusCode)
+	}
+}
+
+func TestResolveDigestDefaultPlatform(t *testing.T) {
+	server, _ := newTestServer(t, WithDefaultPlatform("linux", "amd64"))
+
+	mtype := "application/vnd.oci.image.manifest.v1+json"
+	child := DigestOf([]byte(testManifest)).String()
+	pushManifest(t, server, "repo", "image", child, mtype, []byte(testManifest))
+
+	index := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json",` +
+		`"manifests":[{"mediaType":"` + mtype + `","size":1,"digest":"` + child + `",` +
+		`"platform":{"os":"linux","architecture":"amd64"}}]}`
+	pushManifest(t, server, "repo", "image", "latest", "application/vnd.oci.image.index.v1+json", []byte(index))
+
+	for _, path := range []string{
+		"/v2/repo/image/manifests/latest",
+		"/v2/repo/image/manifests/latest?resolve=digest",
+	} {
+		resp, body := do(t, server, http.MethodHead, path, "", nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("HEAD %s: unexpected status %d: %s", path, resp.StatusCode, body)
+		}
+
+		if dgst := resp.Header.Get("docker-content-digest"); dgst != child {
+			t.Errorf("HEAD %s: expected digest %s, got %s", path, child, dgst)
+		}
+	}
+}
+
+// repeatReader reads the provided pattern over and over until 'remaining' bytes are read.
+type repeatReader struct {
+	pattern   []byte
+	remaining int64
+	offset    int
+}
+
+// Read fills p with the pattern.
+func (r *repeatReader) Read(p []byte) (int, error) {
+	if r.remaining <= 0 {
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+
+	var read int
+	for read < len(p) {
+		copied := copy(p[read:], r.pattern[r.offset:])
+		r.offset = (r.offset + copied) % len(r.pattern)
+		read += copied
+	}
+	r.remaining -= int64(read)
+	return read, nil
+}
+
+func TestDecodeLargeManifest(t *testing.T) {
+	child := DigestOf([]byte(testManifest)).String()
+	prefix := `{"schemaVersion":2,"manifests":[{"digest":"` + child + `","size":1}],"padding":[`
+	padding := []byte("[],")
+	size := int64(16 << 20)
+	from := io.MultiReader(
+		strings.NewReader(prefix),
+		&repeatReader{pattern: padding, remaining: size - size%int64(len(padding))},
+		strings.NewReader(`[]]}`),
+	)
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	fields, err := decodeManifestFields(from)
+	if err != nil {
+		t.Fatalf("unable to decode manifest: %s", err)
+	}
+
+	runtime.ReadMemStats(&after)
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > uint64(size/8) {
+		t.Errorf("decoding a %d bytes manifest allocated %d bytes", size, allocated)
+	}
+
+	if !fields.isIndex("") || len(fields.Manifests) != 1 || fields.Manifests[0].Digest != child {
+		t.Errorf("unexpected manifest fields: %+v", fields)
+	}
+}
+
+func TestStoreLargeIndex(t *testing.T) {
+	server, reg := newTestServer(t, WithManifestSpoolThreshold(4<<10), WithMaxManifestSize(8<<20))
+
+	child := DigestOf([]byte(testManifest)).String()
+	pushManifest(t, server, "repo", "image", child, "application/vnd.oci.image.manifest.v1+json", []byte(testManifest))
+
+	// no media type nor content type, the registry must tell this is an index on its own.
+	index := `{"schemaVersion":2,"manifests":[{"digest":"` + child + `","size":1}],` +
+		`"annotations":{"padding":"` + strings.Repeat("a", 6<<20) + `"}}`
+	pushManifest(t, server, "repo", "image", "latest", "", []byte(index))
+
+	parents, err := reg.storage.ListIndexParents("repo", "image", child)
+	if err != nil {
+		t.Fatalf("unable to list index parents: %s", err)
+	}
+
+	if dgst := DigestOf([]byte(index)).String(); len(parents) != 1 || parents[0] != dgst {
+		t.Errorf("expected parent %s, got %v", dgst, parents)
+	}
+
+	resp, body := do(t, server, http.MethodGet, "/v2/repo/image/manifests/latest", "", nil)
+	if resp.StatusCode != http.StatusOK || string(body) != index {
+		t.Errorf("unexpected reply pulling large index: %d, %d bytes", resp.StatusCode, len(body))
+	}
+}
+
+func TestStoreManifestAlreadyStored(t *testing.T) {
+	server, _ := newTestServer(t)
+
+	mtype := "application/vnd.oci.image.manifest.v1+json"
+	subject := DigestOf([]byte(testManifest)).String()
+	pushManifest(t, server, "repo", "image", "latest", mtype, []byte(testManifest))
+
+	referrer := strings.Replace(testManifest, `"layers":[]`, `"layers":[],`+
+		`"subject":{"mediaType":"`+mtype+`","size":1,"digest":"`+subject+`"}`, 1)
+
+	// the manifest content is already stored, as a blob, but nothing has been recorded
+	// about it as a manifest.
+	dgst := pushBlob(t, server, "repo", "image", []byte(referrer))
+	pushManifest(t, server, "repo", "image", dgst, mtype, []byte(referrer))
+
+	resp, _ := do(t, server, http.MethodHead, "/v2/repo/image/manifests/"+dgst, "", nil)
+	if ctype := resp.Header.Get("content-type"); ctype != mtype {
+		t.Errorf("expected content type %s, got %s", mtype, ctype)
+	}
+
+	resp, body := do(t, server, http.MethodGet, "/v2/repo/image/referrers/"+subject, "", nil)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), dgst) {
+		t.Errorf("referrer not recorded: %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestCustomArtifactType(t *testing.T) {
+	server, reg := newTestServer(t)
+
+	ctype := "application/vnd.example.artifact.v1+json"
+	artifact := []byte(`{"name":"artifact","data":"content"}`)
+	pushManifest(t, server, "repo", "image", "latest", ctype, artifact)
+
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		resp, body := do(t, server, method, "/v2/repo/image/manifests/latest", "", nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: unexpected status %d: %s", method, resp.StatusCode, body)
+		}
+
+		if got := resp.Header.Get("content-type"); got != ctype {
+			t.Errorf("%s: expected content type %s, got %s", method, ctype, got)
+		}
+	}
+
+	// without a recorded content type unknown content is served as json.
+	hash := DigestOf(artifact).String()
+	if err := reg.storage.PutBlob("repo", "other", hash, bytes.NewReader(artifact)); err != nil {
+		t.Fatalf("unable to store manifest: %s", err)
+	}
+	if err := reg.storage.PutTag("repo", "other", "latest", hash); err != nil {
+		t.Fatalf("unable to tag manifest: %s", err)
+	}
+
+	resp, body := do(t, server, http.MethodGet, "/v2/repo/other/manifests/latest", "", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", resp.StatusCode, body)
+	}
+
+	if got := resp.Header.Get("content-type"); got != "application/json" {
+		t.Errorf("expected content type application/json, got %s", got)
+	}
+}
+
+func TestManifestMediaType(t *testing.T) {
+	oci := "application/vnd.oci.image.manifest.v1+json"
+	docker := "application/vnd.docker.distribution.manifest.v2+json"
+	untyped := `{"schemaVersion":2,"config":{"mediaType":"application/vnd.oci.image.config.v1+json",` +
+		`"size":2,"digest":"sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a"},"layers":[]}`
+
+	for _, tt := range []struct {
+		name     string
+		ctype    string
+		manifest string
+		status   int
+		served   string
+	}{
+		{name: "agreeing", ctype: oci, manifest: testManifest, status: http.StatusCreated, served: oci},
+		{name: "disagreeing", ctype: docker, manifest: testManifest, status: http.StatusBadRequest},
+		{name: "missing content type", manifest: testManifest, status: http.StatusCreated, served: oci},
+		{name: "missing media type", ctype: oci, manifest: untyped, status: http.StatusCreated, served: oci},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			server, _ := newTestServer(t)
+
+			path := "/v2/repo/image/manifests/latest"
+			resp, body := do(t, server, http.MethodPut, path, tt.ctype, []byte(tt.manifest))
+			if resp.StatusCode != tt.status {
+				t.Fatalf("expected status %d, got %d: %s", tt.status, resp.StatusCode, body)
+			}
+
+			if tt.status != http.StatusCreated {
+				if !strings.Contains(string(body), ErrManifestInvalid.Code) {
+					t.Errorf("expected %s, got %s", ErrManifestInvalid.Code, body)
+				}
+				return
+			}
+
+			resp, _ = do(t, server, http.MethodHead, path, "", nil)
+			if got := resp.Header.Get("content-type"); got != tt.served {
+				t.Errorf("expected content type %s, got %s", tt.served, got)
+			}
+		})
+	}
+}
+
+func TestParseManifestReferences(t *testing.T) {
+	config := "sha256:" + strings.Repeat("c", 64)
+	layer := "sha256:" + strings.Repeat("1", 64)
+	child := "sha256:" + strings.Repeat("2", 64)
+
+	schema2 := `{"schemaVersion":2,"mediaType":"application/vnd.docker.distribution.manifest.v2+json",` +
+		`"config":{"mediaType":"application/vnd.docker.container.image.v1+json","size":1,"digest":"` + config + `"},` +
+		`"layers":[{"mediaType":"application/vnd.docker.image.rootfs.diff.tar.gzip","size":1,"digest":"` + layer + `"}]}`
+	image := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json",` +
+		`"config":{"mediaType":"application/vnd.oci.image.config.v1+json","size":1,"digest":"` + config + `"},` +
+		`"layers":[{"mediaType":"application/vnd.oci.image.layer.v1.tar+gzip","size":1,"digest":"` + layer + `"}]}`
+	index := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json",` +
+		`"manifests":[{"mediaType":"application/vnd.oci.image.manifest.v1+json","size":1,"digest":"` + child + `",` +
+		`"platform":{"os":"linux","architecture":"amd64"}}]}`
+
+	for _, tt := range []struct {
+		name     string
+		manifest string
+		ctype    string
+		refs     []string
+	}{
+		{
+			name:     "schema2",
+			manifest: schema2,
+			ctype:    "application/vnd.docker.distribution.manifest.v2+json",
+			refs:     []string{config, layer},
+		},
+		{
+			name:     "oci image",
+			manifest: image,
+			ctype:    "application/vnd.oci.image.manifest.v1+json",
+			refs:     []string{config, layer},
+		},
+		{
+			name:     "oci index",
+			manifest: index,
+			ctype:    "application/vnd.oci.image.index.v1+json",
+			refs:     []string{child},
+		},
+		{
+			name:     "guessed content type",
+			manifest: index,
+			refs:     []string{child},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			refs, err := parseManifestReferences([]byte(tt.manifest), tt.ctype)
+			if err != nil {
+				t.Fatalf("unable to parse references: %s", err)
+			}
+
+			if strings.Join(refs, ",") != strings.Join(tt.refs, ",") {
+				t.Errorf("expected references %v, got %v", tt.refs, refs)
+			}
+		})
+	}
+
+	if _, err := parseManifestReferences([]byte("not a manifest"), "application/octet-stream"); err == nil {
+		t.Error("expected an error parsing an unknown manifest")
+	}
+}
+
+func TestHeadMatchesGet(t *testing.T) {
+	mtype := "application/vnd.oci.image.manifest.v1+json"
+	child := DigestOf([]byte(testManifest)).String()
+	index := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json",` +
+		`"manifests":[{"mediaType":"` + mtype + `","size":1,"digest":"` + child + `",` +
+		`"platform":{"os":"linux","architecture":"amd64"}}]}`
+
+	for _, tt := range []struct {
+		name string
+		opts []Option
+	}{
+		{name: "as stored"},
+		{name: "default platform", opts: []Option{WithDefaultPlatform("linux", "amd64")}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			server, _ := newTestServer(t, tt.opts...)
+			pushManifest(t, server, "repo", "image", child, mtype, []byte(testManifest))
+			pushManifest(t, server, "repo", "image", "latest", "application/vnd.oci.image.index.v1+json", []byte(index))
+
+			path := "/v2/repo/image/manifests/latest"
+			head, _ := do(t, server, http.MethodHead, path, "", nil)
+			get, body := do(t, server, http.MethodGet, path, "", nil)
+			if head.StatusCode != http.StatusOK || get.StatusCode != http.StatusOK {
+				t.Fatalf("unexpected status: HEAD %d, GET %d", head.StatusCode, get.StatusCode)
+			}
+
+			for _, header := range []string{"content-length", "content-type", "docker-content-digest"} {
+				if head.Header.Get(header) != get.Header.Get(header) {
+					t.Errorf("%s differs: HEAD %q, GET %q", header, head.Header.Get(header), get.Header.Get(header))
+				}
+			}
+
+			if length := head.Header.Get("content-length"); length != strconv.Itoa(len(body)) {
+				t.Errorf("HEAD reported length %s, GET served %d bytes", length, len(body))
+			}
+		})
+	}
+}
+
+func TestMultiArchPushPull(t *testing.T) {
+	server, reg := newTestServer(t)
+
+	mtype := "application/vnd.oci.image.manifest.v1+json"
+	itype := "application/vnd.oci.image.index.v1+json"
+	amd64 := []byte(testManifest)
+	arm64 := []byte(strings.Replace(testManifest, `"layers":[]`, `"layers":[],"annotations":{"arch":"arm64"}`, 1))
+
+	var children []string
+	for _, child := range [][]byte{amd64, arm64} {
+		hash := DigestOf(child).String()
+		pushManifest(t, server, "repo", "image", hash, mtype, child)
+		children = append(children, hash)
+	}
+
+	descriptor := func(hash, arch string) string {
+		return `{"mediaType":"` + mtype + `","size":1,"digest":"` + hash + `",` +
+			`"platform":{"os":"linux","architecture":"` + arch + `"}}`
+	}
+	index := `{"schemaVersion":2,"mediaType":"` + itype + `","manifests":[` +
+		descriptor(children[0], "amd64") + "," + descriptor(children[1], "arm64") + `]}`
+
+	missing := "sha256:" + strings.Repeat("f", 64)
+	broken := `{"schemaVersion":2,"mediaType":"` + itype + `","manifests":[` + descriptor(missing, "amd64") + `]}`
+	resp, body := do(t, server, http.MethodPut, "/v2/repo/image/manifests/broken", itype, []byte(broken))
+	if resp.StatusCode != ErrManifestBlobUnknown.Status || !strings.Contains(string(body), ErrManifestBlobUnknown.Code) {
+		t.Errorf("index referring to a missing child: unexpected reply %d: %s", resp.StatusCode, body)
+	}
+
+	pushManifest(t, server, "repo", "image", "latest", itype, []byte(index))
+
+	resp, body = do(t, server, http.MethodGet, "/v2/repo/image/manifests/latest", "", nil)
+	if resp.StatusCode != http.StatusOK || string(body) != index {
+		t.Errorf("unexpected index pulled by tag: %d: %s", resp.StatusCode, body)
+	}
+
+	if ctype := resp.Header.Get("content-type"); ctype != itype {
+		t.Errorf("expected content type %s, got %s", itype, ctype)
+	}
+
+	indexHash := DigestOf([]byte(index)).String()
+	for i, child := range [][]byte{amd64, arm64} {
+		resp, body := do(t, server, http.MethodGet, "/v2/repo/image/manifests/"+children[i], "", nil)
+		if resp.StatusCode != http.StatusOK || string(body) != string(child) {
+			t.Errorf("unexpected child pulled by digest: %d: %s", resp.StatusCode, body)
+		}
+
+		parents, err := reg.storage.ListIndexParents("repo", "image", children[i])
+		if err != nil {
+			t.Fatalf("unable to list index parents: %s", err)
+		}
+
+		if strings.Join(parents, ",") != indexHash {
+			t.Errorf("expected %s to be referred by %s, got %v", children[i], indexHash, parents)
+		}
+	}
+}
+
+func TestManifestInvalidDigest(t *testing.T) {
+	server, _ := newTestServer(t, WithAllowDeleteByDigest(true))
+	pushManifest(t, server, "repo", "image", "latest", "application/vnd.oci.image.manifest.v1+json", []byte(testManifest))
+
+	for _, method := range []string{http.MethodGet, http.MethodHead, http.MethodDelete} {
+		resp, body := do(t, server, method, "/v2/repo/image/manifests/sha256:..", "", nil)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected status %d, got %d: %s", method, http.StatusBadRequest, resp.StatusCode, body)
+		}
+	}
+
+	if resp, body := do(t, server, http.MethodGet, "/v2/repo/image/manifests/latest", "", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected manifest to survive, got %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestServePlatforms(t *testing.T) {
+	server, _ := newTestServer(t)
+
+	mtype := "application/vnd.oci.image.manifest.v1+json"
+	itype := "application/vnd.oci.image.index.v1+json"
+	child := DigestOf([]byte(testManifest)).String()
+	pushManifest(t, server, "repo", "image", child, mtype, []byte(testManifest))
+
+	index := `{"schemaVersion":2,"mediaType":"` + itype + `","manifests":[{"mediaType":"` + mtype + `",` +
+		`"size":1,"digest":"` + child + `","platform":{"os":"linux","architecture":"amd64"}}]}`
+	pushManifest(t, server, "repo", "image", "latest", itype, []byte(index))
+
+	resp, body := do(t, server, http.MethodGet, "/v2/repo/image/manifests/latest?platforms=true", "", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status listing platforms: %d: %s", resp.StatusCode, body)
+	}
+
+	if dgst := resp.Header.Get("docker-content-digest"); dgst != "" {
+		t.Errorf("platforms reply carries the index digest header: %s", dgst)
+	}
+
+	var reply struct {
+		Digest    string            `json:"digest"`
+		Platforms []json.RawMessage `json:"platforms"`
+	}
+	if err := json.Unmarshal(body, &reply); err != nil {
+		t.Fatalf("unable to decode platforms: %s", err)
+	}
+
+	if reply.Digest != DigestOf([]byte(index)).String() || len(reply.Platforms) != 1 {
+		t.Errorf("unexpected platforms reply: %s", body)
+	}
+}
+
+func TestMaxManifestReferences(t *testing.T) {
+	mtype := "application/vnd.oci.image.manifest.v1+json"
+	layer := `{"mediaType":"application/vnd.oci.image.layer.v1.tar","size":1,"digest":"sha256:` + strings.Repeat("a", 64) + `"}`
+	layered := strings.Replace(testManifest, `"layers":[]`, `"layers":[`+layer+`]`, 1)
+
+	for _, tt := range []struct {
+		max    int
+		status int
+	}{
+		{max: 1, status: http.StatusBadRequest},
+		{max: 2, status: http.StatusCreated},
+		{max: 0, status: http.StatusCreated},
+		{max: -1, status: http.StatusCreated},
+	} {
+		server, _ := newTestServer(t, WithMaxManifestReferences(tt.max))
+		resp, body := do(t, server, http.MethodPut, "/v2/repo/image/manifests/latest", mtype, []byte(layered))
+		if resp.StatusCode != tt.status {
+			t.Errorf("limit %d: expected status %d, got %d: %s", tt.max, tt.status, resp.StatusCode, body)
+		}
+	}
+
+	server, _ := newTestServer(t)
+	if resp, body := do(t, server, http.MethodPut, "/v2/repo/image/manifests/latest", mtype, []byte(layered)); resp.StatusCode != http.StatusCreated {
+		t.Errorf("default limit: expected status %d, got %d: %s", http.StatusCreated, resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,132 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"k8s.io/klog"
+)
+
+const (
+	// tmpStorageDir and tmpUploadDir are the directories used by default before storage and
+	// upload directories could be configured.
+	tmpStorageDir = "/tmp/storage"
+	tmpUploadDir  = "/tmp/uploads"
+)
+
+// migrateDir moves the content of the 'from' directory into the 'to' directory. Entries already
+// present in 'to' are left untouched (and kept in 'from') so running it more than once is safe.
+// Entries are renamed when possible and copied, then removed, when 'from' and 'to' live in
+// different filesystems.
+func migrateDir(from, to string, dirmode os.FileMode) error {
+	if filepath.Clean(from) == filepath.Clean(to) {
+		return nil
+	}
+
+	entries, err := os.ReadDir(from)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("unable to read %s: %w", from, err)
+	}
+
+	if err := os.MkdirAll(to, dirmode); err != nil {
+		return fmt.Errorf("unable to create %s: %w", to, err)
+	}
+
+	for _, entry := range entries {
+		src := filepath.Join(from, entry.Name())
+		dst := filepath.Join(to, entry.Name())
+		if _, err := os.Lstat(dst); err == nil {
+			klog.Warningf("not migrating %s, %s already exists", src, dst)
+			continue
+		}
+
+		err := os.Rename(src, dst)
+		if errors.Is(err, syscall.EXDEV) {
+			err = moveAcross(src, dst)
+		}
+		if err != nil {
+			return fmt.Errorf("unable to migrate %s: %w", src, err)
+		}
+		klog.Infof("migrated %s to %s", src, dst)
+	}
+	return nil
+}
+
+// moveAcross copies the provided file or directory tree into dst and then removes src. Used
+// when a rename is not possible because src and dst live in different filesystems. A partial
+// copy is removed on failure so a later attempt starts from scratch.
+func moveAcross(src, dst string) error {
+	err := filepath.WalkDir(src, func(fpath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, fpath)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case entry.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm())
+		case info.Mode().IsRegular():
+			return copyFile(fpath, target, info.Mode().Perm())
+		default:
+			klog.Warningf("not migrating %s, not a regular file", fpath)
+			return nil
+		}
+	})
+	if err != nil {
+		_ = os.RemoveAll(dst)
+		return err
+	}
+	return os.RemoveAll(src)
+}
+
+// copyFile copies the content of src into a new file dst with the provided mode.
+func copyFile(src, dst string, mode os.FileMode) error {
+	from, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer from.Close()
+
+	to, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(to, from); err != nil {
+		to.Close()
+		return err
+	}
+	return to.Close()
+}
+
+// migrateFromTmp moves the content of the default /tmp directories into the configured storage
+// and upload directories.
+func (r *Registry) migrateFromTmp() error {
+	if err := migrateDir(tmpStorageDir, r.disk.basedir, r.disk.dirmode); err != nil {
+		return fmt.Errorf("unable to migrate storage: %w", err)
+	}
+
+	upload := r.blobhdr.upload
+	if err := migrateDir(tmpUploadDir, upload.basedir, upload.dirmode); err != nil {
+		return fmt.Errorf("unable to migrate uploads: %w", err)
+	}
+	return nil
+}
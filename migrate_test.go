@@ -0,0 +1,96 @@
+package registry
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeFiles creates the provided files, relative to dir, with the provided content.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		fpath := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+			t.Fatalf("unable to create directory: %s", err)
+		}
+
+		if err := os.WriteFile(fpath, []byte(content), 0644); err != nil {
+			t.Fatalf("unable to write file: %s", err)
+		}
+	}
+}
+
+// readFile returns the content of the provided file, or an empty string if it does not exist.
+func readFile(t *testing.T, fpath string) string {
+	t.Helper()
+	data, err := os.ReadFile(fpath)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatalf("unable to read file: %s", err)
+	}
+	return string(data)
+}
+
+func TestMigrateDir(t *testing.T) {
+	from, to := t.TempDir(), filepath.Join(t.TempDir(), "storage")
+	writeFiles(t, from, map[string]string{
+		"repo/image/tags/latest": "old",
+		"other/image/tags/v1":    "moved",
+	})
+	writeFiles(t, to, map[string]string{
+		"repo/image/tags/latest": "new",
+	})
+
+	for i := 0; i < 2; i++ {
+		if err := migrateDir(from, to, 0755); err != nil {
+			t.Fatalf("migration %d failed: %s", i, err)
+		}
+	}
+
+	if content := readFile(t, filepath.Join(to, "other/image/tags/v1")); content != "moved" {
+		t.Errorf("entry not migrated, found %q", content)
+	}
+
+	if content := readFile(t, filepath.Join(from, "other/image/tags/v1")); content != "" {
+		t.Errorf("migrated entry left behind, found %q", content)
+	}
+
+	if content := readFile(t, filepath.Join(to, "repo/image/tags/latest")); content != "new" {
+		t.Errorf("existing entry overwritten, found %q", content)
+	}
+
+	if content := readFile(t, filepath.Join(from, "repo/image/tags/latest")); content != "old" {
+		t.Errorf("entry not migrated was removed, found %q", content)
+	}
+}
+
+func TestMigrateDirMissingSource(t *testing.T) {
+	to := filepath.Join(t.TempDir(), "storage")
+	if err := migrateDir(filepath.Join(t.TempDir(), "missing"), to, 0755); err != nil {
+		t.Fatalf("migration from a missing directory failed: %s", err)
+	}
+
+	if _, err := os.Stat(to); !os.IsNotExist(err) {
+		t.Errorf("destination created with nothing to migrate: %v", err)
+	}
+}
+
+func TestMoveAcross(t *testing.T) {
+	src, dst := t.TempDir(), filepath.Join(t.TempDir(), "moved")
+	writeFiles(t, src, map[string]string{
+		"tags/latest":    "digest",
+		"sha256/abcdef0": "blob",
+	})
+
+	if err := moveAcross(src, dst); err != nil {
+		t.Fatalf("unable to move: %s", err)
+	}
+
+	if content := readFile(t, filepath.Join(dst, "sha256/abcdef0")); content != "blob" {
+		t.Errorf("file not copied, found %q", content)
+	}
+
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Errorf("source not removed: %v", err)
+	}
+}
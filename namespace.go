@@ -0,0 +1,47 @@
+package registry
+
+import (
+	"context"
+	"strings"
+)
+
+// nsKey is the context key under which the namespace holder is kept.
+type nsKey struct{}
+
+// nsHolder holds the namespace set by the Authorizer during a request.
+type nsHolder struct {
+	ns string
+}
+
+// withNamespaceHolder returns a context carrying an empty namespace holder. Authorizers can
+// then set the namespace through SetNamespace.
+func withNamespaceHolder(ctx context.Context) context.Context {
+	return context.WithValue(ctx, nsKey{}, &nsHolder{})
+}
+
+// SetNamespace is meant to be called by Authorizer implementations, during Authorize, to set
+// the namespace the authenticated identity has access to (e.g. a tenant claim in the token).
+// When the registry is configured WithNamespaceFromToken the namespace set here is used as the
+// repository for the request, the repository present in the url is ignored. This is a no-op if
+// the registry has not been configured WithNamespaceFromToken.
+func SetNamespace(ctx context.Context, ns string) {
+	if holder, ok := ctx.Value(nsKey{}).(*nsHolder); ok {
+		holder.ns = ns
+	}
+}
+
+// NamespaceFromContext returns the namespace set by the Authorizer for the request the provided
+// context belongs to. Returns false if no namespace has been set.
+func NamespaceFromContext(ctx context.Context) (string, bool) {
+	holder, ok := ctx.Value(nsKey{}).(*nsHolder)
+	if !ok || holder.ns == "" {
+		return "", false
+	}
+	return holder.ns, true
+}
+
+// validNamespace returns true if the provided namespace can be used as a repository name, i.e.
+// it is a single non hidden path component.
+func validNamespace(ns string) bool {
+	return ns != "" && !strings.HasPrefix(ns, ".") && !strings.ContainsAny(ns, "/\\")
+}
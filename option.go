@@ -1,9 +1,23 @@
 package registry
 
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/containers/image/v5/types"
+)
+
 // Option is a function that sets an Option in a Registry reference.
 type Option func(*Registry)
 
-// WithCert sets the certificate and key to be used by the registry api.
+// WithCert sets the certificate and key to be used by the registry api. If both are empty Start
+// serves plain http.
 func WithCert(certpath, keypath string) Option {
 	return func(r *Registry) {
 		r.certpath = certpath
@@ -21,6 +35,503 @@ func WithBindAddress(addr string) Option {
 // WithEventHandler adds provided event handler to the registry
 func WithEventHandler(eh EventHandler) Option {
 	return func(r *Registry) {
-		r.manfhdr.evthandler = eh
+		r.events.handler = eh
+		r.events.filter = 0
+	}
+}
+
+// WithEventHandlerFiltered adds provided event handler to the registry, subscribed only to the
+// provided event types. Events of other types are not dispatched to the handler at all, e.g. a
+// handler subscribed to EventNewTag is never asked about blobs. Tags are still replicated
+// regardless of the filter. Without types the handler is subscribed to all events.
+func WithEventHandlerFiltered(eh EventHandler, types ...EventType) Option {
+	return func(r *Registry) {
+		r.events.handler = eh
+		r.events.filter = 0
+		for _, etype := range types {
+			r.events.filter |= etype
+		}
+	}
+}
+
+// WithStorageEncryption makes the registry encrypt blobs at rest using AES-GCM with the
+// provided key (16, 24 or 32 bytes long). Blobs stored before the option was enabled can't be
+// read back. Panics if the key is invalid.
+func WithStorageEncryption(key []byte) Option {
+	return func(r *Registry) {
+		storage, err := NewEncryptedStorage(r.storage, key)
+		if err != nil {
+			panic(fmt.Sprintf("unable to enable storage encryption: %s", err))
+		}
+		r.useStorage(storage)
+	}
+}
+
+// WithStorageReadOnlyFallback makes the registry fall back to the provided read only storage
+// whenever a write to the primary storage fails. While in this mode pushes are refused with
+// ErrUnavailable and a retry-after header and pulls are served by the secondary storage. Every
+// 'retry' a write is attempted against the primary storage again. This option must come before
+// WithStorageEncryption if both are used.
+func WithStorageReadOnlyFallback(secondary Storage, retry time.Duration) Option {
+	return func(r *Registry) {
+		r.useStorage(NewFallbackStorage(r.storage, secondary, retry))
+	}
+}
+
+// WithStorageFileMode sets the permissions used when creating files and directories in the on
+// disk storage and for upload files. Defaults to 0644 for files and 0755 for directories.
+func WithStorageFileMode(fileMode, dirMode os.FileMode) Option {
+	return func(r *Registry) {
+		r.disk.filemode = fileMode
+		r.disk.dirmode = dirMode
+		r.blobhdr.upload.filemode = fileMode
+		r.blobhdr.upload.dirmode = dirMode
+	}
+}
+
+// WithStorageDir sets the directory where the on disk storage keeps blobs and tags. Defaults
+// to /tmp/storage.
+func WithStorageDir(dir string) Option {
+	return func(r *Registry) {
+		r.disk.basedir = dir
+	}
+}
+
+// WithUploadDir sets the directory where uploads in progress are kept. Defaults to /tmp/uploads.
+func WithUploadDir(dir string) Option {
+	return func(r *Registry) {
+		r.blobhdr.upload.basedir = dir
+	}
+}
+
+// WithMigrateFromTmp makes New move the content of the default /tmp/storage and /tmp/uploads
+// directories into the directories configured through WithStorageDir and WithUploadDir. Content
+// already present in the configured directories is never overwritten so it is safe to keep the
+// option enabled across restarts. Failures are logged and the content that could not be moved
+// is left in place, to be moved on the next start.
+func WithMigrateFromTmp() Option {
+	return func(r *Registry) {
+		r.migrate = true
+	}
+}
+
+// WithUploadDrainWindow sets for how long, during shutdown, the registry waits for uploads in
+// progress to be finalized. New uploads are refused during this window, requests for uploads
+// already started are still served.
+func WithUploadDrainWindow(win time.Duration) Option {
+	return func(r *Registry) {
+		r.drainwin = win
+	}
+}
+
+// WithMaxManifestReferences sets the maximum number of descriptors (config, layers or child
+// manifests) a pushed manifest may refer to. Manifests above this limit are rejected. Defaults
+// to 1000, zero or a negative value lifts the limit.
+func WithMaxManifestReferences(n int) Option {
+	return func(r *Registry) {
+		r.manfhdr.maxrefs = n
+	}
+}
+
+// WithInMemoryUploadThreshold makes uploads smaller than the provided amount of bytes to be kept
+// in memory instead of in a temporary file. Uploads growing beyond the threshold are moved to
+// disk. Keep in mind that each concurrent upload may hold up to this amount of memory.
+func WithInMemoryUploadThreshold(bytes int) Option {
+	return func(r *Registry) {
+		r.blobhdr.upload.memthresh = bytes
+	}
+}
+
+// WithBlobServeStrategy sets how blob content is handed to clients. See BlobServeStream and
+// BlobServeAccel.
+func WithBlobServeStrategy(strategy BlobServeStrategy) Option {
+	return func(r *Registry) {
+		r.blobhdr.strategy = strategy
+	}
+}
+
+// WithUploadIDGenerator sets the function used to generate upload ids, by default ids are UUIDs.
+// Generated ids must be unique and composed only by letters, digits, dashes and underscores.
+func WithUploadIDGenerator(gen func() string) Option {
+	return func(r *Registry) {
+		r.blobhdr.upload.idgen = gen
+	}
+}
+
+// WithMaxTagsPerRepo sets the maximum number of tags a repository/image pair may hold. Pushes
+// creating new tags beyond this limit are refused while overwriting existing tags is always
+// allowed. Zero (the default) means no limit.
+func WithMaxTagsPerRepo(n int) Option {
+	return func(r *Registry) {
+		r.manfhdr.maxtags = n
+	}
+}
+
+// WithMaxManifestSize sets the maximum size, in bytes, of a pushed manifest. This is a hard cap,
+// larger manifests are refused even if they would be spooled to disk (see
+// WithManifestSpoolThreshold). By default manifests are limited to 4MiB.
+func WithMaxManifestSize(bytes int64) Option {
+	return func(r *Registry) {
+		r.manfhdr.maxsize = bytes
+	}
+}
+
+// WithAllowedHosts makes the registry refuse requests whose Host header is not in the provided
+// list. As the authentication realm is built from the Host header this also protects clients
+// from being redirected to an arbitrary realm.
+func WithAllowedHosts(hosts []string) Option {
+	return func(r *Registry) {
+		r.hosts = map[string]bool{}
+		for _, host := range hosts {
+			r.hosts[strings.ToLower(host)] = true
+		}
+	}
+}
+
+// WithManifestValidator sets a function to be called for every manifest being pushed, this
+// allows users to implement their own manifest policies. See ManifestValidator.
+func WithManifestValidator(vldtor ManifestValidator) Option {
+	return func(r *Registry) {
+		r.manfhdr.vldtor = vldtor
+	}
+}
+
+// WithDefaultTag sets the tag used when a client pulls a manifest without providing any
+// reference. By default such requests are refused.
+func WithDefaultTag(tag string) Option {
+	return func(r *Registry) {
+		r.manfhdr.deftag = tag
+	}
+}
+
+// WithMaxRequestBodySize sets the maximum size, in bytes, of any request body except for blob
+// uploads. Zero (the default) means no limit.
+func WithMaxRequestBodySize(bytes int64) Option {
+	return func(r *Registry) {
+		r.maxbody = bytes
+	}
+}
+
+// WithNamespaceFromToken makes the registry trust only the Authorizer when it comes to which
+// repository a request refers to. The Authorizer must call SetNamespace during Authorize with
+// the namespace the authenticated identity owns, this namespace is then used as repository for
+// all storage operations and the repository present in the url is ignored. Requests for which
+// the Authorizer does not set a namespace are refused. This prevents a tenant from accessing
+// other tenants images by crafting urls.
+func WithNamespaceFromToken() Option {
+	return func(r *Registry) {
+		r.nstoken = true
+	}
+}
+
+// WithUploadQuotaPerClient bounds the amount of bytes a single client may hold in uploads in
+// progress. Clients are identified by their authorization header or, if none is sent, by their
+// remote address. Uploads going beyond the quota are refused with ErrQuotaExceeded.
+func WithUploadQuotaPerClient(bytes int64) Option {
+	return func(r *Registry) {
+		r.blobhdr.upload.quota = bytes
+	}
+}
+
+// WithTrustedProxies sets the addresses (or cidrs) of the proxies trusted to report the client
+// address through the x-forwarded-for header. The header is ignored for requests coming from
+// any other address. Panics if an entry can't be parsed.
+func WithTrustedProxies(proxies []string) Option {
+	return func(r *Registry) {
+		nets, err := parseProxies(proxies)
+		if err != nil {
+			panic(fmt.Sprintf("unable to set trusted proxies: %s", err))
+		}
+		r.proxies = nets
+	}
+}
+
+// WithManifestConversion makes the registry convert docker schema2 manifests (and manifest
+// lists) into their oci counterparts when pulled by tag by a client accepting only the oci
+// media types. As the served manifest differs from the stored one so does the served digest.
+// Manifests pulled by digest are served as stored.
+func WithManifestConversion() Option {
+	return func(r *Registry) {
+		r.manfhdr.convert = true
+	}
+}
+
+// WithSeed registers a function to pre-load the registry storage. Seed functions are called, in
+// order, by New once all options have been applied, so they see the same storage (encryption
+// included) the registry uses to serve requests. Seed functions failing are logged, the
+// remaining ones are still called.
+func WithSeed(seed func(Storage) error) Option {
+	return func(r *Registry) {
+		r.seeds = append(r.seeds, seed)
+	}
+}
+
+// WithMinChunkSize makes the registry refuse upload chunks (PATCH requests without a digest)
+// smaller than the provided amount of bytes with ErrRangeInvalid. As the last chunk is often
+// sent without a digest one small chunk is tolerated per upload. Keep the minimum well below
+// the chunk sizes used by clients (usually a few megabytes) or regular pushes will fail.
+func WithMinChunkSize(bytes int) Option {
+	return func(r *Registry) {
+		r.blobhdr.minchunk = int64(bytes)
+	}
+}
+
+// WithStorageHealthCheck makes the registry probe the storage once every interval by writing,
+// reading back and removing a small blob in a reserved location. The /readyz endpoint reports
+// the result of the last probe, failing until the first probe succeeds. Probes run as part of
+// Start (or Run).
+func WithStorageHealthCheck(interval time.Duration) Option {
+	return func(r *Registry) {
+		r.health = newHealth(interval)
+	}
+}
+
+// WithServiceName sets the service identity advertised to clients when they are asked to
+// authenticate. Authentication requests for any other service are refused. Defaults to the
+// Host the request was sent to.
+func WithServiceName(name string) Option {
+	return func(r *Registry) {
+		r.service = name
+	}
+}
+
+// WithAuditLog makes the registry write an audit record, as a json line, into the provided
+// writer for every mutating operation (pushes, deletes and tag rollbacks). Records carry the
+// identity set by the Authorizer through SetIdentity, the client address, the operation, its
+// target and its result.
+func WithAuditLog(to io.Writer) Option {
+	return func(r *Registry) {
+		r.audit = &auditor{to: to}
+	}
+}
+
+// WithDigestHeaderOnGet controls whether the docker-content-digest header is sent on manifest
+// GET responses. It is sent by default, disable it only for clients that can't cope with it.
+// HEAD responses always carry the header.
+func WithDigestHeaderOnGet(enabled bool) Option {
+	return func(r *Registry) {
+		r.manfhdr.nodgst = !enabled
+	}
+}
+
+// WithWebUI enables a minimal, read only, web ui under /ui/ listing repositories, their tags
+// and manifests. Pages go through the same authorization as any other request.
+func WithWebUI(enabled bool) Option {
+	return func(r *Registry) {
+		r.webui = enabled
+	}
+}
+
+// WithConnStateHook sets a function to be called whenever a client connection changes state,
+// see http.Server.ConnState. Only honored when the registry is put online through Start.
+func WithConnStateHook(hook func(net.Conn, http.ConnState)) Option {
+	return func(r *Registry) {
+		r.connhook = hook
+	}
+}
+
+// WithTagHistory keeps, for each tag, the last n digests the tag pointed to before being
+// overwritten. Histories are served as json by GET /admin/tags/<repo>/<image>/<tag>/history
+// and a tag can be pointed back to one of them through POST .../rollback?digest=<digest>.
+// Admin requests go through the Authorizer as any other request.
+func WithTagHistory(n int) Option {
+	return func(r *Registry) {
+		r.manfhdr.history = n
+	}
+}
+
+// WithReplicationTarget mirrors every pushed tag, together with the content it refers to, into
+// the registry at the provided url (e.g. https://mirror.example.com). Replication happens in
+// the background and never blocks pushes, failures are retried and then logged. Blobs already
+// present in the target are not copied again. Username and password, if provided, are sent as
+// basic auth. Panics if the url is invalid.
+func WithReplicationTarget(target, username, password string) Option {
+	return func(r *Registry) {
+		replicate, err := newReplicator(target, username, password)
+		if err != nil {
+			panic(err)
+		}
+		r.events.replicate = replicate
+	}
+}
+
+// WithMaxConcurrentBlobReads caps the number of blobs being served at the same time. Once the
+// cap is reached further blob downloads are refused with a 429 and a retry-after header. Does
+// not apply to blobs served through WithBlobServeStrategy redirects.
+func WithMaxConcurrentBlobReads(n int) Option {
+	return func(r *Registry) {
+		if n > 0 {
+			r.blobhdr.readers = make(chan struct{}, n)
+		}
+	}
+}
+
+// WithManifestPullCounter counts how many times each manifest is pulled and when it was last
+// pulled. Counters are kept in memory and persisted, inside the storage directory, every
+// interval. They are served as json by GET /admin/pulls, requests to it go through the
+// Authorizer as any other request. If the persisted counters can't be read counting starts
+// from scratch.
+func WithManifestPullCounter(interval time.Duration) Option {
+	return func(r *Registry) {
+		r.manfhdr.pulls = newPullCounter(interval)
+	}
+}
+
+// WithStrictDigestValidation makes the registry refuse, with ErrDigestInvalid, digests not in
+// their canonical form (e.g. with uppercase hex). By default such digests are lowercased.
+func WithStrictDigestValidation(strict bool) Option {
+	return func(r *Registry) {
+		r.strict = strict
+	}
+}
+
+// WithAllowDeleteByDigest allows manifests to be deleted by digest. By default only tags can be
+// deleted as deleting a manifest by digest affects every tag pointing to it. When enabled,
+// deleting a manifest still pointed to by tags or referred to by image indexes succeeds with
+// a warning header listing them.
+func WithAllowDeleteByDigest(allow bool) Option {
+	return func(r *Registry) {
+		r.manfhdr.deldgst = allow
+	}
+}
+
+// WithRequireSubject makes the registry refuse, with ErrManifestInvalid, manifests without a
+// subject pushed to repositories matching the provided pattern. The pattern is matched, as in
+// path.Match, against "<repository>/<image>", e.g. "signatures/*". May be used more than once.
+// Panics if the pattern is invalid.
+func WithRequireSubject(pattern string) Option {
+	return func(r *Registry) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			panic(fmt.Sprintf("invalid subject pattern %q: %s", pattern, err))
+		}
+		r.manfhdr.subjreq = append(r.manfhdr.subjreq, pattern)
+	}
+}
+
+// WithBlobStreamValidation hashes uploads as their chunks arrive so a blob whose content does
+// not match the digest provided by the client is refused, with ErrDigestInvalid, before it is
+// committed to the storage.
+func WithBlobStreamValidation() Option {
+	return func(r *Registry) {
+		r.blobhdr.upload.streamval = true
+	}
+}
+
+// WithMaxUploadChunks caps the number of chunks (PATCH requests) a single upload may receive,
+// further chunks are refused with ErrUploadInvalid. Defaults to 10000.
+func WithMaxUploadChunks(n int) Option {
+	return func(r *Registry) {
+		r.blobhdr.upload.maxchunks = n
+	}
+}
+
+// WithDefaultPlatform makes manifest requests for a tag pointing to an image index return the
+// index child matching the provided goos and goarch, unless the client explicitly accepts the
+// index media type. Helps clients not understanding image indexes. A variant may be appended
+// to the architecture, e.g. "arm/v7".
+func WithDefaultPlatform(goos, goarch string) Option {
+	return func(r *Registry) {
+		arch, variant, _ := strings.Cut(goarch, "/")
+		r.manfhdr.defplat = &types.SystemContext{
+			OSChoice:           goos,
+			ArchitectureChoice: arch,
+			VariantChoice:      variant,
+		}
+	}
+}
+
+// WithUploadDurability sets when uploaded content is flushed to disk, trading write throughput
+// for durability. Defaults to DurabilitySyncOnFinalize. See UploadDurability.
+func WithUploadDurability(mode UploadDurability) Option {
+	return func(r *Registry) {
+		r.blobhdr.upload.syncmode = mode
+		r.disk.fsync = mode != DurabilityNone
+	}
+}
+
+// WithMinFreeSpace makes /readyz report the registry as not ready once the free space on the
+// filesystem backing the storage drops below the provided amount of bytes, so traffic can be
+// moved away before uploads start failing. Ignored if the storage can't report its disk usage.
+func WithMinFreeSpace(bytes uint64) Option {
+	return func(r *Registry) {
+		r.minfree = bytes
+	}
+}
+
+// WithTrustForwardedHeaders makes the registry honor the x-forwarded-proto header when building
+// absolute urls, such as the authentication realm. Meant for registries behind a proxy
+// terminating TLS. If trusted proxies are set (see WithTrustedProxies) the header is only
+// honored for requests coming from them.
+func WithTrustForwardedHeaders() Option {
+	return func(r *Registry) {
+		r.fwdproto = true
+	}
+}
+
+// WithManifestTransform sets a function to normalize manifests pushed by tag before they are
+// stored, e.g. to strip fields or inject annotations. Beware the transformed content is what
+// gets stored and it determines the manifest digest, clients learn the digest through the
+// docker-content-digest header but will see it differ from the one they computed. Manifests
+// pushed by digest are stored as pushed. See ManifestTransform.
+func WithManifestTransform(xform ManifestTransform) Option {
+	return func(r *Registry) {
+		r.manfhdr.xform = xform
+	}
+}
+
+// WithUploadDeadline sets for how long an upload session lives, counting from its start. Once
+// the deadline is reached the upload expires regardless of activity. Defaults to 20 minutes.
+func WithUploadDeadline(deadline time.Duration) Option {
+	return func(r *Registry) {
+		r.blobhdr.deadline = deadline
+	}
+}
+
+// WithUploadIdleTimeout sets the maximum gap between two chunks of an upload, uploads not
+// receiving data for longer expire even if their deadline has not been reached. Enforced
+// independently of WithUploadDeadline. Disabled by default.
+func WithUploadIdleTimeout(timeout time.Duration) Option {
+	return func(r *Registry) {
+		r.blobhdr.upload.idle = timeout
+	}
+}
+
+// WithAnnotationPolicy sets a function to be called with the annotations of every manifest
+// being pushed, allowing users to require or forbid annotations without parsing manifests on
+// their own. Runs before the ManifestValidator, if any. See AnnotationPolicy.
+func WithAnnotationPolicy(policy AnnotationPolicy) Option {
+	return func(r *Registry) {
+		r.manfhdr.annpol = policy
+	}
+}
+
+// WithManifestSpoolThreshold sets the size, in bytes, above which pushed manifests are written
+// to a temporary file, in the upload directory, instead of being held in memory while they are
+// validated. Manifests are still refused above the maximum manifest size. Manifests are read
+// back into memory if a ManifestValidator or a ManifestTransform is set as these need the whole
+// content at once. Zero keeps all manifests in memory. By default manifests larger than 1MiB
+// are spooled.
+func WithManifestSpoolThreshold(bytes int64) Option {
+	return func(r *Registry) {
+		r.manfhdr.spool = bytes
+	}
+}
+
+// WithStartupConsistencyCheck makes New verify the storage content before the registry is put
+// online, e.g. to find tags left dangling by an unclean shutdown. The mode selects what is
+// verified and whether dangling tags are removed, see ConsistencyCheck. Inconsistencies are
+// logged. The check is skipped by default as it walks the whole storage.
+func WithStartupConsistencyCheck(mode ConsistencyCheck) Option {
+	return func(r *Registry) {
+		r.fsck = mode
+	}
+}
+
+// WithListener makes Start serve on the provided listener instead of binding the address set
+// through WithBindAddress, e.g. for socket activation or to listen on an ephemeral port. The
+// listener is wrapped with tls using the configured certificate and is closed on shutdown.
+func WithListener(listener net.Listener) Option {
+	return func(r *Registry) {
+		r.listener = listener
 	}
 }
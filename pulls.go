@@ -0,0 +1,220 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+// pullsFile is the file, inside the storage base directory, where pull counters are persisted.
+// Hidden names are never accepted from clients nor listed.
+const pullsFile = ".pulls.json"
+
+// PullStat holds how many times a manifest has been pulled and when it was last pulled.
+type PullStat struct {
+	Repository string    `json:"repository"`
+	Image      string    `json:"image"`
+	Digest     string    `json:"digest"`
+	Pulls      int64     `json:"pulls"`
+	LastPulled time.Time `json:"lastPulled"`
+}
+
+// pullCounter counts manifest pulls in memory and periodically persists the counters to disk,
+// so pulls never cause a write on their own. All methods are safe to be called on a nil
+// reference, in such case they no-op.
+type pullCounter struct {
+	sync.Mutex
+	interval time.Duration
+	path     string
+	stats    map[string]*PullStat
+	dirty    bool
+}
+
+// newPullCounter returns a pull counter persisting its counters every interval.
+func newPullCounter(interval time.Duration) *pullCounter {
+	return &pullCounter{
+		interval: interval,
+		stats:    map[string]*PullStat{},
+	}
+}
+
+// load reads previously persisted counters from the provided path, counters are persisted to
+// the same path from now on. A missing file means no pulls have been counted yet.
+func (p *pullCounter) load(path string) error {
+	if p == nil {
+		return nil
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	p.path = path
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("unable to read pull counters: %w", err)
+	}
+
+	var stats []*PullStat
+	if err := json.Unmarshal(data, &stats); err != nil {
+		return fmt.Errorf("unable to parse pull counters: %w", err)
+	}
+
+	for _, stat := range stats {
+		if stat == nil {
+			continue
+		}
+
+		key := fmt.Sprintf("%s/%s@%s", stat.Repository, stat.Image, stat.Digest)
+		p.stats[key] = stat
+	}
+	return nil
+}
+
+// count records a pull of the provided manifest.
+func (p *pullCounter) count(repo, image, hash string) {
+	if p == nil {
+		return
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	key := fmt.Sprintf("%s/%s@%s", repo, image, hash)
+	stat, ok := p.stats[key]
+	if !ok {
+		stat = &PullStat{Repository: repo, Image: image, Digest: hash}
+		p.stats[key] = stat
+	}
+
+	stat.Pulls++
+	stat.LastPulled = time.Now().UTC()
+	p.dirty = true
+}
+
+// list returns a copy of all counters sorted by repository, image and digest.
+func (p *pullCounter) list() []PullStat {
+	p.Lock()
+	defer p.Unlock()
+
+	stats := make([]PullStat, 0, len(p.stats))
+	for _, stat := range p.stats {
+		stats = append(stats, *stat)
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		a, b := stats[i], stats[j]
+		if a.Repository != b.Repository {
+			return a.Repository < b.Repository
+		}
+		if a.Image != b.Image {
+			return a.Image < b.Image
+		}
+		return a.Digest < b.Digest
+	})
+	return stats
+}
+
+// persist writes the counters to disk if they changed since they were last written. If the
+// write fails counters are written again on the next call.
+func (p *pullCounter) persist() error {
+	p.Lock()
+	dirty := p.dirty
+	p.dirty = false
+	p.Unlock()
+
+	if !dirty {
+		return nil
+	}
+
+	if err := p.write(); err != nil {
+		p.Lock()
+		p.dirty = true
+		p.Unlock()
+		return err
+	}
+	return nil
+}
+
+// write writes the counters to disk. The file is first written to a temporary file and then
+// renamed.
+func (p *pullCounter) write() error {
+	data, err := json.Marshal(p.list())
+	if err != nil {
+		return fmt.Errorf("unable to encode pull counters: %w", err)
+	}
+
+	fp, err := os.CreateTemp(filepath.Dir(p.path), ".tmp-")
+	if err != nil {
+		return fmt.Errorf("unable to create pull counters file: %w", err)
+	}
+	defer os.RemoveAll(fp.Name())
+	defer fp.Close()
+
+	if _, err := fp.Write(data); err != nil {
+		return fmt.Errorf("unable to write pull counters: %w", err)
+	}
+
+	if err := os.Rename(fp.Name(), p.path); err != nil {
+		return fmt.Errorf("unable to move pull counters file: %w", err)
+	}
+	return nil
+}
+
+// run persists the counters every interval until the provided context is done, counters are
+// persisted one last time before returning.
+func (p *pullCounter) run(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := p.persist(); err != nil {
+				klog.Errorf("unable to persist pull counters: %s", err)
+			}
+			return
+		case <-ticker.C:
+			if err := p.persist(); err != nil {
+				klog.Errorf("unable to persist pull counters: %s", err)
+			}
+		}
+	}
+}
+
+// servePullStats replies with the pull counters for all manifests as json. If the Authorizer
+// has set a namespace for the request only the counters for the namespace are returned.
+func (p *pullCounter) servePullStats(resp http.ResponseWriter, request Request) {
+	if !request.IsGet() {
+		ErrUnsupported.Write(resp)
+		return
+	}
+
+	stats := p.list()
+	if ns, ok := NamespaceFromContext(request.Context()); ok {
+		filtered := []PullStat{}
+		for _, stat := range stats {
+			if stat.Repository == ns {
+				filtered = append(filtered, stat)
+			}
+		}
+		stats = filtered
+	}
+
+	resp.Header().Set("content-type", "application/json")
+	if err := json.NewEncoder(resp).Encode(stats); err != nil {
+		klog.Errorf("unable to encode pull counters: %s", err)
+	}
+}
@@ -0,0 +1,61 @@
+package registry
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCorruptPullCounters(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, pullsFile), []byte("{corrupt"), 0644); err != nil {
+		t.Fatalf("unable to write pull counters: %s", err)
+	}
+
+	_, reg := newTestServer(t, WithStorageDir(dir), WithManifestPullCounter(time.Hour))
+
+	if stats := reg.manfhdr.pulls.list(); len(stats) != 0 {
+		t.Errorf("expected no pull counters, got %v", stats)
+	}
+
+	reg.manfhdr.pulls.count("repo", "image", "sha256:abc")
+	if stats := reg.manfhdr.pulls.list(); len(stats) != 1 || stats[0].Pulls != 1 {
+		t.Errorf("unexpected pull counters: %v", stats)
+	}
+}
+
+func TestPartialReadsNotCounted(t *testing.T) {
+	server, reg := newTestServer(t, WithManifestPullCounter(time.Hour))
+
+	mtype := "application/vnd.oci.image.manifest.v1+json"
+	pushManifest(t, server, "repo", "image", "latest", mtype, []byte(testManifest))
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/v2/repo/image/manifests/latest", nil)
+	if err != nil {
+		t.Fatalf("unable to create request: %s", err)
+	}
+	req.Header.Set("range", "bytes=0-3")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unable to read manifest: %s", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("expected status %d, got %d", http.StatusPartialContent, resp.StatusCode)
+	}
+
+	if stats := reg.manfhdr.pulls.list(); len(stats) != 0 {
+		t.Errorf("partial read counted as a pull: %v", stats)
+	}
+
+	if resp, body := do(t, server, http.MethodGet, "/v2/repo/image/manifests/latest", "", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", resp.StatusCode, body)
+	}
+
+	if stats := reg.manfhdr.pulls.list(); len(stats) != 1 || stats[0].Pulls != 1 {
+		t.Errorf("unexpected pull counters: %v", stats)
+	}
+}
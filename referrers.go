@@ -0,0 +1,116 @@
+package registry
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"k8s.io/klog"
+)
+
+// referrerFields holds the manifest fields needed to describe a referrer.
+type referrerFields struct {
+	ArtifactType string `json:"artifactType"`
+	Config       *struct {
+		MediaType string `json:"mediaType"`
+	} `json:"config"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+// artifactType returns the artifact type of the manifest, the config media type is used for
+// manifests not setting one.
+func (r referrerFields) artifactType() string {
+	if r.ArtifactType == "" && r.Config != nil {
+		return r.Config.MediaType
+	}
+	return r.ArtifactType
+}
+
+// referrerDescriptor describes a manifest referring to a subject.
+type referrerDescriptor struct {
+	MediaType    string            `json:"mediaType"`
+	Digest       string            `json:"digest"`
+	Size         int64             `json:"size"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+}
+
+// referrersReply is the image index sent to requests for the referrers of a manifest.
+type referrersReply struct {
+	SchemaVersion int                  `json:"schemaVersion"`
+	MediaType     string               `json:"mediaType"`
+	Manifests     []referrerDescriptor `json:"manifests"`
+}
+
+// serveReferrers replies with an image index listing the manifests pushed with the requested
+// manifest as their subject, i.e. GET /v2/<repository>/<image>/referrers/<digest>. Referrers
+// can be filtered by artifact type through the 'artifactType' query. Unknown subjects have no
+// referrers, they are not an error.
+func (m *ManifestHandler) serveReferrers(resp http.ResponseWriter, request Request) {
+	if !request.IsGet() {
+		ErrUnsupported.Write(resp)
+		return
+	}
+
+	repo, image, err := request.RepositoryAndImage()
+	if err != nil {
+		klog.Errorf("unable to parse repo/image: %s", err)
+		ErrNameInvalid.Write(resp)
+		return
+	}
+
+	subject := request.ManifestID()
+	if !validDigest(subject) {
+		klog.Errorf("invalid referrers subject %q", subject)
+		ErrDigestInvalid.Write(resp)
+		return
+	}
+
+	hashes, err := m.storage.ListReferrers(repo, image, subject)
+	if err != nil {
+		klog.Errorf("unable to list referrers: %s", err)
+		ErrInternal(err).Write(resp)
+		return
+	}
+
+	filter := request.Get("artifactType")
+	reply := referrersReply{
+		SchemaVersion: 2,
+		MediaType:     "application/vnd.oci.image.index.v1+json",
+		Manifests:     []referrerDescriptor{},
+	}
+	for _, hash := range hashes {
+		man, rerr := m.load(repo, image, hash, true)
+		if rerr == ErrUnknownManifest {
+			continue
+		} else if rerr != nil {
+			rerr.Write(resp)
+			return
+		}
+
+		var fields referrerFields
+		if err := json.Unmarshal(man.data, &fields); err != nil {
+			klog.Errorf("unable to parse referrer %s: %s", hash, err)
+			continue
+		}
+
+		if filter != "" && fields.artifactType() != filter {
+			continue
+		}
+
+		reply.Manifests = append(reply.Manifests, referrerDescriptor{
+			MediaType:    man.ctype,
+			Digest:       man.digest,
+			Size:         man.size,
+			ArtifactType: fields.artifactType(),
+			Annotations:  fields.Annotations,
+		})
+	}
+
+	if filter != "" {
+		resp.Header().Set("oci-filters-applied", "artifactType")
+	}
+	resp.Header().Set("content-type", reply.MediaType)
+	if err := json.NewEncoder(resp).Encode(reply); err != nil {
+		klog.Errorf("unable to encode referrers: %s", err)
+	}
+}
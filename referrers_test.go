@@ -0,0 +1,85 @@
+package registry
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestReferrers(t *testing.T) {
+	server, _ := newTestServer(t)
+
+	mtype := "application/vnd.oci.image.manifest.v1+json"
+	subject := DigestOf([]byte(testManifest)).String()
+	pushManifest(t, server, "repo", "image", "latest", mtype, []byte(testManifest))
+
+	signature := `{"schemaVersion":2,"mediaType":"` + mtype + `","artifactType":"application/vnd.example.signature",` +
+		`"config":{"mediaType":"application/vnd.oci.empty.v1+json","size":2,` +
+		`"digest":"sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a"},"layers":[],` +
+		`"subject":{"mediaType":"` + mtype + `","size":1,"digest":"` + subject + `"},` +
+		`"annotations":{"org.example":"signed"}}`
+	sbom := strings.Replace(signature, "application/vnd.example.signature", "application/vnd.example.sbom", 1)
+	for _, referrer := range []string{signature, sbom} {
+		dgst := DigestOf([]byte(referrer)).String()
+		path := "/v2/repo/image/manifests/" + dgst
+		resp, body := do(t, server, http.MethodPut, path, mtype, []byte(referrer))
+		if resp.StatusCode != http.StatusCreated || resp.Header.Get("oci-subject") != subject {
+			t.Fatalf("unexpected reply pushing referrer: %d %q: %s", resp.StatusCode, resp.Header.Get("oci-subject"), body)
+		}
+	}
+
+	for _, tt := range []struct {
+		name     string
+		query    string
+		expected []string
+		filtered bool
+	}{
+		{
+			name:     "all",
+			expected: []string{"application/vnd.example.sbom", "application/vnd.example.signature"},
+		},
+		{
+			name:     "filtered",
+			query:    "?artifactType=application/vnd.example.sbom",
+			expected: []string{"application/vnd.example.sbom"},
+			filtered: true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := do(t, server, http.MethodGet, "/v2/repo/image/referrers/"+subject+tt.query, "", nil)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("unexpected status: %d: %s", resp.StatusCode, body)
+			}
+
+			if filtered := resp.Header.Get("oci-filters-applied") == "artifactType"; filtered != tt.filtered {
+				t.Errorf("expected filters applied header %v, got %v", tt.filtered, filtered)
+			}
+
+			var reply referrersReply
+			if err := json.Unmarshal(body, &reply); err != nil {
+				t.Fatalf("unable to parse referrers: %s", err)
+			}
+
+			var types []string
+			for _, desc := range reply.Manifests {
+				types = append(types, desc.ArtifactType)
+				if desc.MediaType != mtype || desc.Annotations["org.example"] != "signed" || desc.Size == 0 {
+					t.Errorf("unexpected descriptor: %+v", desc)
+				}
+			}
+
+			sort.Strings(types)
+			if strings.Join(types, ",") != strings.Join(tt.expected, ",") {
+				t.Errorf("expected artifact types %v, got %v", tt.expected, types)
+			}
+		})
+	}
+
+	unknown := "sha256:" + strings.Repeat("0", 64)
+	resp, body := do(t, server, http.MethodGet, "/v2/repo/image/referrers/"+unknown, "", nil)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `"manifests":[]`) {
+		t.Errorf("unexpected reply for unknown subject: %d: %s", resp.StatusCode, body)
+	}
+}
@@ -4,7 +4,10 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
+	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
@@ -14,7 +17,8 @@ import (
 // Authorizer is an abstraction so we users can provide their own implementation. Two functions
 // are required here: Authenticate receives a request to authenticate a user and returns a token
 // or and Error while Authorize validates the token and returns an error if invalid or nil if
-// the token is valid.
+// the token is valid. Credentials are better read through Request.BasicAuth and
+// Request.BearerToken.
 type Authorizer interface {
 	Authenticate(context.Context, Request) (string, *Error)
 	Authorize(context.Context, Request) *Error
@@ -29,13 +33,137 @@ type EventHandler interface {
 // Handler and dispatches all received requests directly to our backend registry. This entity
 // also manages users authentication.
 type Registry struct {
-	blobhdr    *BlobHandler
-	manfhdr    *ManifestHandler
-	authzer    Authorizer
-	certpath   string
-	keypath    string
-	bind       string
-	evthandler EventHandler
+	blobhdr  *BlobHandler
+	manfhdr  *ManifestHandler
+	storage  Storage
+	disk     *StorageHandler
+	authzer  Authorizer
+	certpath string
+	keypath  string
+	bind     string
+	events   *events
+	drainwin time.Duration
+	hosts    map[string]bool
+	maxbody  int64
+	nstoken  bool
+	proxies  []*net.IPNet
+	seeds    []func(Storage) error
+	health   *health
+	service  string
+	audit    *auditor
+	migrate  bool
+	webui    bool
+	connhook func(net.Conn, http.ConnState)
+	strict   bool
+	minfree  uint64
+	fwdproto bool
+	running  lifecycle
+	fsck     ConsistencyCheck
+	listener net.Listener
+}
+
+// lifecycle keeps track of the http server and the background workers of a running registry
+// so they can be stopped through Shutdown. The registry is shut down only once, the result is
+// kept for later calls.
+type lifecycle struct {
+	sync.Mutex
+	server *http.Server
+	cancel context.CancelFunc
+	done   chan struct{}
+	once   sync.Once
+	err    error
+}
+
+// serving records the http server put online by Start.
+func (l *lifecycle) serving(server *http.Server) {
+	l.Lock()
+	defer l.Unlock()
+	l.server = server
+}
+
+// working records the background workers started by Run. The returned channel must be closed
+// once the workers are done.
+func (l *lifecycle) working(cancel context.CancelFunc) chan struct{} {
+	l.Lock()
+	defer l.Unlock()
+	l.cancel = cancel
+	l.done = make(chan struct{})
+	return l.done
+}
+
+// get returns the http server and how to stop and wait for the background workers. Any of
+// them is nil if not running.
+func (l *lifecycle) get() (*http.Server, context.CancelFunc, chan struct{}) {
+	l.Lock()
+	defer l.Unlock()
+	return l.server, l.cancel, l.done
+}
+
+// StorageReadOnly returns true if the registry is configured with WithStorageReadOnlyFallback
+// and the primary storage is currently refusing writes.
+func (r *Registry) StorageReadOnly() bool {
+	if fallback, ok := r.fallback(); ok {
+		return fallback.ReadOnly()
+	}
+	return false
+}
+
+// fallback returns the FallbackStorage in use, if any. Wrappers stacked on top of it (e.g.
+// encryption) are looked through.
+func (r *Registry) fallback() (*FallbackStorage, bool) {
+	storage := r.storage
+	for {
+		switch s := storage.(type) {
+		case *FallbackStorage:
+			return s, true
+		case *EncryptedStorage:
+			storage = s.Storage
+		default:
+			return nil, false
+		}
+	}
+}
+
+// writeDeleted replies to a successful delete request. All delete handlers must reply through
+// it so they consistently return 202 with an empty body.
+func writeDeleted(resp http.ResponseWriter) {
+	resp.Header().Set("content-length", "0")
+	resp.WriteHeader(http.StatusAccepted)
+}
+
+// serviceName returns the service identity of the registry, as advertised to clients in the
+// www-authenticate header. Defaults to the request Host if none has been configured.
+func (r *Registry) serviceName(request Request) string {
+	if r.service != "" {
+		return r.service
+	}
+	return request.Host
+}
+
+// hostAllowed returns true if the request Host header is among the allowed hosts. Hosts are
+// compared with and without port. If no list of allowed hosts was configured all hosts are
+// allowed.
+func (r *Registry) hostAllowed(request Request) bool {
+	if len(r.hosts) == 0 {
+		return true
+	}
+
+	host := strings.ToLower(request.Host)
+	if r.hosts[host] {
+		return true
+	}
+
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		return r.hosts[hostname]
+	}
+	return false
+}
+
+// useStorage makes both the blob and manifest handlers use the provided storage.
+func (r *Registry) useStorage(storage Storage) {
+	r.storage = storage
+	r.blobhdr.storage = storage
+	r.manfhdr.storage = storage
 }
 
 // redirectToAuth redirect the client do the authentication endpoint by means of setting the
@@ -48,17 +176,48 @@ func (r *Registry) redirectToAuth(resp http.ResponseWriter, request Request) {
 		return
 	}
 
-	realm := fmt.Sprintf("https://%s/v2/auth", request.Host)
-	authdr := fmt.Sprintf("bearer realm=\"%s\",service=\"%s\"", realm, request.Host)
+	realm := fmt.Sprintf("%s://%s/v2/auth", r.scheme(request), request.Host)
+	authdr := fmt.Sprintf("bearer realm=\"%s\",service=\"%s\"", realm, r.serviceName(request))
 	resp.Header().Add("www-authenticate", authdr)
 	resp.WriteHeader(http.StatusUnauthorized)
 }
 
+// options replies OPTIONS requests with the list of methods supported by the targeted resource.
+func (r *Registry) options(resp http.ResponseWriter, request Request) {
+	var allow []string
+	switch {
+	case request.HasBlobUploadID():
+		allow = []string{http.MethodGet, http.MethodPatch, http.MethodPut, http.MethodDelete}
+	case request.IsBlobUploadRequest():
+		allow = []string{http.MethodPost}
+	case request.IsBlob():
+		allow = []string{http.MethodGet, http.MethodHead}
+	case request.IsManifest():
+		allow = []string{http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete}
+	case request.IsReferrers(), request.IsPing(), request.IsAuth(), request.IsReadyz():
+		allow = []string{http.MethodGet}
+	default:
+		ErrUnsupported.Write(resp)
+		return
+	}
+
+	allow = append(allow, http.MethodOptions)
+	resp.Header().Add("docker-distribution-api-version", "registry/2.0")
+	resp.Header().Set("allow", strings.Join(allow, ", "))
+	resp.WriteHeader(http.StatusOK)
+}
+
 // authenticate manages the user authentication.
 func (r *Registry) authenticate(resp http.ResponseWriter, request Request) {
 	resp.Header().Add("docker-distribution-api-version", "registry/2.0")
 	resp.Header().Add("content-type", "application/json")
 
+	if service := request.Get("service"); service != "" && service != r.serviceName(request) {
+		klog.Errorf("refusing authentication for service %q", service)
+		ErrUnauthorized.Write(resp)
+		return
+	}
+
 	token, err := r.authzer.Authenticate(request.Context(), request)
 	if err != nil {
 		err.Write(resp)
@@ -75,7 +234,35 @@ func (r *Registry) authenticate(resp http.ResponseWriter, request Request) {
 // ServeHTTP is our main http handler. Attempts to understand the request and dispatches to
 // the appropriate handler.
 func (r *Registry) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	req = req.WithContext(withClientInfo(req.Context(), r.clientInfo(Request{req})))
 	request := Request{req}
+	if !r.hostAllowed(request) {
+		klog.Errorf("refusing request for host %q", request.Host)
+		ErrHostNotAllowed.Write(resp)
+		return
+	}
+	if r.maxbody > 0 && !request.HasBlobUploadID() && !request.IsBlobUploadRequest() {
+		if request.ContentLength > r.maxbody {
+			klog.Errorf("request body too large: %d bytes", request.ContentLength)
+			ErrRequestTooLarge.Write(resp)
+			return
+		}
+		request.Body = &limitedBody{ReadCloser: request.Body, remaining: r.maxbody}
+	}
+	if request.IsV1() {
+		// we only support v2, a 404 with the api version header tells old clients so.
+		resp.Header().Add("docker-distribution-api-version", "registry/2.0")
+		resp.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if request.IsOptions() {
+		r.options(resp, request)
+		return
+	}
+	if request.IsReadyz() {
+		r.readyz(resp)
+		return
+	}
 	if request.IsPing() {
 		r.redirectToAuth(resp, request)
 		return
@@ -84,11 +271,47 @@ func (r *Registry) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 		r.authenticate(resp, request)
 		return
 	}
+	if r.nstoken {
+		request = Request{req.WithContext(withNamespaceHolder(req.Context()))}
+	}
 	if err := r.authzer.Authorize(request.Context(), request); err != nil {
 		err.Write(resp)
 		klog.Errorf("unable to authorize token: %q", err.Message)
 		return
 	}
+	if r.nstoken {
+		if ns, ok := NamespaceFromContext(request.Context()); !ok || !validNamespace(ns) {
+			klog.Errorf("authorizer did not provide a valid namespace: %q", ns)
+			ErrUnauthorized.Write(resp)
+			return
+		}
+	}
+	if r.webui && request.IsWebUI() {
+		r.serveWebUI(resp, request)
+		return
+	}
+	if r.manfhdr.pulls != nil && request.IsPullStats() {
+		r.manfhdr.pulls.servePullStats(resp, request)
+		return
+	}
+	if request.IsDiskUsage() {
+		r.serveDiskUsage(resp, request)
+		return
+	}
+	if r.strict && !request.CanonicalDigests() {
+		klog.Errorf("refusing non canonical digest in %s", request.URL)
+		ErrDigestInvalid.Write(resp)
+		return
+	}
+	if op := r.audit.operation(request); op != "" {
+		recorder := &statusRecorder{ResponseWriter: resp}
+		defer r.audit.record(request, op, recorder)
+		resp = recorder
+	}
+	if r.manfhdr.history > 0 && request.IsTagHistory() {
+		r.manfhdr.serveTagHistory(resp, request)
+		return
+	}
 	if request.IsBlob() {
 		r.blobhdr.ServeHTTP(resp, request)
 		return
@@ -97,54 +320,217 @@ func (r *Registry) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 		r.manfhdr.ServeHTTP(resp, request)
 		return
 	}
+	if request.IsReferrers() {
+		r.manfhdr.serveReferrers(resp, request)
+		return
+	}
 	ErrUnsupported.Write(resp)
 }
 
-// Start puts the metrics http server online.
+// drainUploads stops the registry from accepting new uploads and gives uploads in progress a
+// chance to be finalized before the server is shut down. Requests for existing upload sessions
+// are still served. Waits for the drain window at most, or until the provided context is done.
+func (r *Registry) drainUploads(ctx context.Context) {
+	r.blobhdr.upload.Drain()
+	ctx, cancel := context.WithTimeout(ctx, r.drainwin)
+	defer cancel()
+
+	if active := r.blobhdr.upload.waitDrained(ctx); active > 0 {
+		klog.Warningf("shutting down with %d upload(s) still active", active)
+	}
+}
+
+// Run runs the registry background workers (e.g. upload garbage collection) until the provided
+// context is done. Start calls it, embedders managing their own listener must call it too.
+func (r *Registry) Run(ctx context.Context) {
+	r.work(ctx)()
+}
+
+// work starts the registry background workers, recording them so Shutdown can stop them, and
+// returns a function waiting for them to finish. Workers run until the provided context is
+// done or Shutdown is called.
+func (r *Registry) work(ctx context.Context) func() {
+	ctx, cancel := context.WithCancel(ctx)
+	done := r.running.working(cancel)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go r.blobhdr.upload.gc(ctx, &wg)
+	if r.health != nil {
+		wg.Add(1)
+		go r.health.run(ctx, r.storage, &wg)
+	}
+	if r.manfhdr.pulls != nil {
+		wg.Add(1)
+		go r.manfhdr.pulls.run(ctx, &wg)
+	}
+	if r.events.replicate != nil {
+		wg.Add(1)
+		go r.events.replicate.run(ctx, r.storage, &wg)
+	}
+
+	return func() {
+		wg.Wait()
+		cancel()
+		close(done)
+	}
+}
+
+// Handler returns the registry as an http.Handler without binding any socket, e.g. to be used
+// with httptest.NewServer or with a caller managed http.Server. Background workers are run
+// until the provided context is done. Do not use it together with Start or Run.
+func (r *Registry) Handler(ctx context.Context) http.Handler {
+	// workers are started before returning so a Shutdown right after this call stops them.
+	wait := r.work(ctx)
+	go wait()
+	return r
+}
+
+// Shutdown stops a registry put online through Start, Run or Handler. New uploads are refused
+// and uploads in progress are given the drain window to be finalized, then the http server is
+// shut down and the background workers are stopped. Returns once everything has stopped or
+// the provided context is done, whichever happens first. The registry is shut down only once,
+// later calls wait for the first one and return its result.
+func (r *Registry) Shutdown(ctx context.Context) error {
+	r.running.once.Do(func() {
+		r.running.err = r.shutdown(ctx)
+	})
+	return r.running.err
+}
+
+// shutdown does the work for Shutdown.
+func (r *Registry) shutdown(ctx context.Context) error {
+	r.drainUploads(ctx)
+
+	server, cancel, done := r.running.get()
+	if server != nil {
+		if err := server.Shutdown(ctx); err != nil {
+			return fmt.Errorf("unable to shut down https server: %w", err)
+		}
+	}
+
+	if cancel == nil {
+		return nil
+	}
+
+	cancel()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Start puts the metrics http server online, see serve. The registry is shut down once the
+// provided context is done or Shutdown is called.
 func (r *Registry) Start(ctx context.Context) error {
 	server := &http.Server{
-		Addr:    r.bind,
-		Handler: r,
+		Addr:      r.bind,
+		Handler:   r,
+		ConnState: r.connhook,
 	}
+	r.running.serving(server)
+
+	// workers are also stopped when the server stops because Shutdown has been called.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	wait := r.work(ctx)
+	done := make(chan struct{})
+	go func() {
+		wait()
+		close(done)
+	}()
 
 	go func() {
 		<-ctx.Done()
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), r.drainwin+10*time.Second)
 		defer cancel()
-		if err := server.Shutdown(ctx); err != nil {
-			klog.Errorf("error shutting down https server: %s", err)
+		if err := r.Shutdown(ctx); err != nil {
+			klog.Errorf("error shutting down registry: %s", err)
 		}
 	}()
 
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go r.blobhdr.upload.gc(ctx, &wg)
-
-	if err := server.ListenAndServeTLS("certs/server.crt", "certs/server.key"); err != nil {
-		wg.Wait()
-		if err == http.ErrServerClosed {
-			return nil
-		}
+	err := r.serve(server)
+	cancel()
+	<-done
+	if err != nil && err != http.ErrServerClosed {
 		return err
 	}
-	wg.Wait()
 	return nil
 }
 
-// New returns a http handler for our image registry requests.
+// serve serves the provided server on the listener provided through WithListener or, if none
+// has been provided, on the bind address. Connections are served over tls unless both the
+// certificate and key paths are empty.
+func (r *Registry) serve(server *http.Server) error {
+	secure := r.certpath != "" || r.keypath != ""
+	switch {
+	case r.listener != nil && secure:
+		return server.ServeTLS(r.listener, r.certpath, r.keypath)
+	case r.listener != nil:
+		return server.Serve(r.listener)
+	case secure:
+		return server.ListenAndServeTLS(r.certpath, r.keypath)
+	default:
+		return server.ListenAndServe()
+	}
+}
+
+// New returns a http handler for our image registry requests. The returned Registry can be put
+// online through Start or, if the caller wants to manage the http server, through Handler or
+// Run.
 func New(auth Authorizer, opts ...Option) *Registry {
 	sthandler := NewStorageHandler()
+	evts := &events{}
 	registry := &Registry{
 		bind:     ":8080",
 		certpath: "certs/server.crt",
 		keypath:  "certs/server.key",
+		drainwin: 30 * time.Second,
 		blobhdr:  NewBlobHandler(sthandler),
 		manfhdr:  NewManifestHandler(sthandler),
+		storage:  sthandler,
+		disk:     sthandler,
+		events:   evts,
 		authzer:  auth,
 	}
+	registry.blobhdr.events = evts
+	registry.blobhdr.upload.events = evts
+	registry.blobhdr.authzer = auth
+	registry.manfhdr.events = evts
+	registry.manfhdr.upload = registry.blobhdr.upload
 
 	for _, opt := range opts {
 		opt(registry)
 	}
+
+	// the registry comes up regardless of the failures below, they are logged and what
+	// failed is left as is so it can be retried on the next start.
+	if registry.migrate {
+		if err := registry.migrateFromTmp(); err != nil {
+			klog.Errorf("unable to migrate from tmp, content left in place: %s", err)
+		}
+	}
+
+	pullspath := filepath.Join(registry.disk.basedir, pullsFile)
+	if err := registry.manfhdr.pulls.load(pullspath); err != nil {
+		klog.Errorf("unable to load pull counters, starting from scratch: %s", err)
+	}
+
+	if registry.fsck != 0 {
+		problems, err := checkConsistency(registry.storage, registry.fsck)
+		if err != nil {
+			klog.Errorf("unable to check storage consistency: %s", err)
+		}
+		klog.Infof("storage consistency check found %d problem(s)", problems)
+	}
+
+	for _, seed := range registry.seeds {
+		if err := seed(registry.storage); err != nil {
+			klog.Errorf("unable to seed storage: %s", err)
+		}
+	}
 	return registry
 }
@@ -0,0 +1,329 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestStorage returns a StorageHandler keeping its content in a temporary directory.
+func newTestStorage(t testing.TB) *StorageHandler {
+	t.Helper()
+	storage := NewStorageHandler()
+	storage.basedir = t.TempDir()
+	return storage
+}
+
+// newTestServer returns a test http server for a registry keeping its content, and uploads,
+// in temporary directories. The server is closed, and the registry stopped, once the test
+// is done.
+func newTestServer(t testing.TB, opts ...Option) (*httptest.Server, *Registry) {
+	t.Helper()
+	opts = append([]Option{WithStorageDir(t.TempDir()), WithUploadDir(t.TempDir())}, opts...)
+	reg := New(AllowAllAuthorizer("test"), opts...)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	server := httptest.NewServer(reg.Handler(ctx))
+	t.Cleanup(func() {
+		server.Close()
+		cancel()
+	})
+	return server, reg
+}
+
+// pushBlob uploads the provided content, in a single request, as a blob of the provided
+// repository and image. Returns the blob digest.
+func pushBlob(t testing.TB, server *httptest.Server, repo, image string, content []byte) string {
+	t.Helper()
+	resp, err := http.Post(server.URL+"/v2/"+repo+"/"+image+"/blobs/uploads/", "", nil)
+	if err != nil {
+		t.Fatalf("unable to start upload: %s", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("unexpected status starting upload: %d", resp.StatusCode)
+	}
+
+	hash := DigestOf(content).String()
+	location := server.URL + resp.Header.Get("location") + "?digest=" + hash
+	req, err := http.NewRequest(http.MethodPut, location, bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("unable to create upload request: %s", err)
+	}
+
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatalf("unable to upload blob: %s", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("unexpected status uploading blob: %d", resp.StatusCode)
+	}
+	return hash
+}
+
+// testManifest is an oci image manifest referring to a config blob that is never pushed.
+const testManifest = `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json",` +
+	`"config":{"mediaType":"application/vnd.oci.image.config.v1+json","size":2,` +
+	`"digest":"sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a"},"layers":[]}`
+
+// do sends a request with the provided method and body to the provided registry path. The
+// content type header is set if not empty. The response body is read and returned.
+func do(t *testing.T, server *httptest.Server, method, path, ctype string, body []byte) (*http.Response, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(method, server.URL+path, bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("unable to create request: %s", err)
+	}
+
+	if ctype != "" {
+		req.Header.Set("content-type", ctype)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unable to send request: %s", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("unable to read response: %s", err)
+	}
+	return resp, data
+}
+
+// pushManifest pushes the provided manifest under the provided reference, failing the test
+// unless the registry replies with 201.
+func pushManifest(t *testing.T, server *httptest.Server, repo, image, ref, ctype string, manifest []byte) {
+	t.Helper()
+	path := "/v2/" + repo + "/" + image + "/manifests/" + ref
+	if resp, body := do(t, server, http.MethodPut, path, ctype, manifest); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("unexpected status pushing manifest: %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestSeedFailure(t *testing.T) {
+	var seeded bool
+	newTestServer(
+		t,
+		WithSeed(func(Storage) error { return errors.New("seed failed") }),
+		WithSeed(func(Storage) error { seeded = true; return nil }),
+	)
+
+	if !seeded {
+		t.Error("seeds after a failing one were not called")
+	}
+}
+
+func TestShutdownRightAfterHandler(t *testing.T) {
+	reg := New(
+		AllowAllAuthorizer("test"),
+		WithStorageDir(t.TempDir()),
+		WithUploadDir(t.TempDir()),
+	)
+	reg.Handler(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := reg.Shutdown(ctx); err != nil {
+		t.Fatalf("unexpected error shutting down: %s", err)
+	}
+
+	_, _, done := reg.running.get()
+	select {
+	case <-done:
+	default:
+		t.Fatal("background workers still running after shutdown")
+	}
+
+	if err := reg.Shutdown(ctx); err != nil {
+		t.Errorf("unexpected error on second shutdown: %s", err)
+	}
+}
+
+func TestShutdownWhileStarted(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err)
+	}
+
+	reg := New(
+		AllowAllAuthorizer("test"),
+		WithStorageDir(t.TempDir()),
+		WithUploadDir(t.TempDir()),
+		WithListener(listener),
+		WithCert("", ""),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	started := make(chan error)
+	go func() {
+		started <- reg.Start(ctx)
+	}()
+
+	url := "http://" + listener.Addr().String() + "/v2/"
+	for i := 0; ; i++ {
+		resp, err := http.Get(url)
+		if err == nil {
+			resp.Body.Close()
+			break
+		}
+		if i == 100 {
+			t.Fatalf("registry never came online: %s", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	sctx, scancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer scancel()
+	if err := reg.Shutdown(sctx); err != nil {
+		t.Fatalf("unexpected error shutting down: %s", err)
+	}
+
+	cancel()
+	select {
+	case err := <-started:
+		if err != nil {
+			t.Errorf("unexpected error from start: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("start did not return after shutdown")
+	}
+}
+
+func TestV1Refused(t *testing.T) {
+	server, _ := newTestServer(t)
+
+	resp, _ := do(t, server, http.MethodGet, "/v1/_ping", "", nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected status %d, got %d", http.StatusNotFound, resp.StatusCode)
+	}
+
+	if version := resp.Header.Get("docker-distribution-api-version"); version != "registry/2.0" {
+		t.Errorf("unexpected api version header %q", version)
+	}
+}
+
+func TestOptions(t *testing.T) {
+	server, _ := newTestServer(t)
+
+	for _, tt := range []struct {
+		path   string
+		status int
+		allow  string
+	}{
+		{
+			path:   "/v2/repo/image/blobs/sha256:" + strings.Repeat("a", 64),
+			status: http.StatusOK,
+			allow:  "GET, HEAD, OPTIONS",
+		},
+		{
+			path:   "/v2/repo/image/manifests/latest",
+			status: http.StatusOK,
+			allow:  "GET, HEAD, PUT, DELETE, OPTIONS",
+		},
+		{
+			path:   "/v2/repo/image/blobs/uploads/",
+			status: http.StatusOK,
+			allow:  "POST, OPTIONS",
+		},
+		{
+			path:   "/v2/repo/image/blobs/uploads/00000000-0000-0000-0000-000000000000",
+			status: http.StatusOK,
+			allow:  "GET, PATCH, PUT, DELETE, OPTIONS",
+		},
+		{
+			path:   "/v2/_catalog",
+			status: ErrUnsupported.Status,
+		},
+	} {
+		resp, body := do(t, server, http.MethodOptions, tt.path, "", nil)
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: expected status %d, got %d: %s", tt.path, tt.status, resp.StatusCode, body)
+			continue
+		}
+
+		if allow := resp.Header.Get("allow"); allow != tt.allow {
+			t.Errorf("%s: expected allow %q, got %q", tt.path, tt.allow, allow)
+		}
+
+		if tt.status == http.StatusOK && resp.Header.Get("docker-distribution-api-version") != "registry/2.0" {
+			t.Errorf("%s: api version header missing", tt.path)
+		}
+	}
+}
+
+func TestMaxRequestBodySize(t *testing.T) {
+	server, _ := newTestServer(t, WithMaxRequestBodySize(16))
+
+	resp, body := do(t, server, http.MethodPost, "/v2/auth", "", bytes.Repeat([]byte("a"), 64))
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected status %d, got %d: %s", http.StatusRequestEntityTooLarge, resp.StatusCode, body)
+	}
+
+	if !strings.Contains(string(body), ErrRequestTooLarge.Message) {
+		t.Errorf("unexpected reply %s", body)
+	}
+
+	// without a content length the limit is enforced while reading.
+	req, err := http.NewRequest(
+		http.MethodPut,
+		server.URL+"/v2/repo/image/manifests/latest",
+		io.MultiReader(strings.NewReader(testManifest)),
+	)
+	if err != nil {
+		t.Fatalf("unable to create request: %s", err)
+	}
+	req.Header.Set("content-type", "application/vnd.oci.image.manifest.v1+json")
+
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatalf("unable to push manifest: %s", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected status %d, got %d", http.StatusRequestEntityTooLarge, resp.StatusCode)
+	}
+
+	// blob uploads are not subject to the limit.
+	pushBlob(t, server, "repo", "image", bytes.Repeat([]byte("b"), 64))
+}
+
+func TestDeleteReplies(t *testing.T) {
+	server, _ := newTestServer(t, WithAllowDeleteByDigest(true))
+
+	mtype := "application/vnd.oci.image.manifest.v1+json"
+	hash := DigestOf([]byte(testManifest)).String()
+	pushManifest(t, server, "repo", "image", "latest", mtype, []byte(testManifest))
+
+	resp, _ := do(t, server, http.MethodPost, "/v2/repo/image/blobs/uploads/", "", nil)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("unexpected status starting upload: %d", resp.StatusCode)
+	}
+	upload := resp.Header.Get("location")
+
+	for _, path := range []string{
+		upload,
+		"/v2/repo/image/manifests/latest",
+		"/v2/repo/image/manifests/" + hash,
+	} {
+		resp, body := do(t, server, http.MethodDelete, path, "", nil)
+		if resp.StatusCode != http.StatusAccepted {
+			t.Errorf("%s: expected status %d, got %d: %s", path, http.StatusAccepted, resp.StatusCode, body)
+		}
+
+		if resp.ContentLength != 0 || len(body) != 0 {
+			t.Errorf("%s: expected an empty reply, got %d bytes: %s", path, resp.ContentLength, body)
+		}
+	}
+}
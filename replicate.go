@@ -0,0 +1,268 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containers/image/v5/manifest"
+	"k8s.io/klog"
+)
+
+const (
+	// replicationQueueSize is the number of tags waiting for replication we keep in memory,
+	// tags pushed while the queue is full are not replicated.
+	replicationQueueSize = 1024
+	// replicationAttempts is the number of times we attempt to replicate a tag.
+	replicationAttempts = 5
+)
+
+// replication is a tag waiting to be mirrored to the replication target.
+type replication struct {
+	repo  string
+	image string
+	tag   string
+}
+
+// replicator mirrors tags into another registry through the distribution api. Tags are queued
+// as they are pushed and copied, in the background, by run. All methods are safe to be called
+// on a nil reference, in such case they no-op.
+type replicator struct {
+	target   *url.URL
+	username string
+	password string
+	client   *http.Client
+	queue    chan replication
+}
+
+// newReplicator returns a replicator mirroring tags into the registry at the provided url.
+// Credentials, if not empty, are sent as basic auth.
+func newReplicator(target, username, password string) (*replicator, error) {
+	turl, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid replication target: %w", err)
+	}
+
+	if turl.Scheme != "http" && turl.Scheme != "https" {
+		return nil, fmt.Errorf("invalid replication target %q: unsupported scheme", target)
+	}
+
+	return &replicator{
+		target:   turl,
+		username: username,
+		password: password,
+		client:   &http.Client{Timeout: 10 * time.Minute},
+		queue:    make(chan replication, replicationQueueSize),
+	}, nil
+}
+
+// enqueue schedules the replication of a tag. Never blocks, tags are dropped if the queue is
+// full.
+func (p *replicator) enqueue(repo, image, tag string) {
+	if p == nil {
+		return
+	}
+
+	select {
+	case p.queue <- replication{repo: repo, image: image, tag: tag}:
+	default:
+		klog.Errorf("replication queue full, not replicating %s/%s:%s", repo, image, tag)
+	}
+}
+
+// run replicates queued tags until the provided context is done. Failed replications are
+// retried with an exponential backoff.
+func (p *replicator) run(ctx context.Context, storage Storage, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-p.queue:
+			p.replicate(ctx, storage, job)
+		}
+	}
+}
+
+// replicate copies a tag into the target registry, retrying on failure.
+func (p *replicator) replicate(ctx context.Context, storage Storage, job replication) {
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		err := p.copyTag(ctx, storage, job)
+		if err == nil {
+			klog.Infof("replicated %s/%s:%s to %s", job.repo, job.image, job.tag, p.target.Host)
+			return
+		}
+
+		if attempt == replicationAttempts {
+			klog.Errorf("giving up replicating %s/%s:%s: %s", job.repo, job.image, job.tag, err)
+			return
+		}
+
+		klog.Warningf("unable to replicate %s/%s:%s, retrying: %s", job.repo, job.image, job.tag, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+			backoff *= 2
+		}
+	}
+}
+
+// copyTag copies the manifest a tag points to, and everything it refers to, into the target.
+func (p *replicator) copyTag(ctx context.Context, storage Storage, job replication) error {
+	hash, err := storage.ResolveTag(job.repo, job.image, job.tag)
+	if err != nil {
+		return fmt.Errorf("unable to resolve tag: %w", err)
+	}
+	return p.copyManifest(ctx, storage, job.repo, job.image, hash, job.tag)
+}
+
+// copyManifest copies a manifest into the target under the provided reference. Blobs, or child
+// manifests for image indexes, are copied first as registries refuse manifests referring to
+// unknown content.
+func (p *replicator) copyManifest(ctx context.Context, storage Storage, repo, image, hash, ref string) error {
+	data, err := p.read(storage, repo, image, hash)
+	if err != nil {
+		return err
+	}
+
+	ctype, err := storage.GetManifestType(repo, image, hash)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("unable to read manifest content type: %w", err)
+	}
+	if ctype == "" {
+		ctype = manifest.GuessMIMEType(data)
+	}
+
+	refs, err := parseManifestReferences(data, ctype)
+	if err != nil {
+		return err
+	}
+
+	for _, dgst := range refs {
+		if manifest.MIMETypeIsMultiImage(ctype) {
+			err = p.copyManifest(ctx, storage, repo, image, dgst, dgst)
+		} else {
+			err = p.copyBlob(ctx, storage, repo, image, dgst)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	path := fmt.Sprintf("/v2/%s/%s/manifests/%s", repo, image, ref)
+	resp, err := p.do(ctx, http.MethodPut, p.url(path), ctype, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("unexpected status pushing manifest %s: %d", ref, resp.StatusCode)
+	}
+	return nil
+}
+
+// copyBlob copies a blob into the target unless the target already has it.
+func (p *replicator) copyBlob(ctx context.Context, storage Storage, repo, image, hash string) error {
+	path := fmt.Sprintf("/v2/%s/%s/blobs/%s", repo, image, hash)
+	resp, err := p.do(ctx, http.MethodHead, p.url(path), "", nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	path = fmt.Sprintf("/v2/%s/%s/blobs/uploads/", repo, image)
+	resp, err = p.do(ctx, http.MethodPost, p.url(path), "", nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("unexpected status starting blob upload: %d", resp.StatusCode)
+	}
+
+	location, err := p.target.Parse(resp.Header.Get("location"))
+	if err != nil {
+		return fmt.Errorf("invalid blob upload location: %w", err)
+	}
+
+	query := location.Query()
+	query.Set("digest", hash)
+	location.RawQuery = query.Encode()
+
+	blob, _, err := storage.GetBlob(repo, image, hash)
+	if err != nil {
+		return fmt.Errorf("unable to read blob %s: %w", hash, err)
+	}
+	defer blob.Close()
+
+	resp, err = p.do(ctx, http.MethodPut, location, "application/octet-stream", blob)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("unexpected status pushing blob %s: %d", hash, resp.StatusCode)
+	}
+	return nil
+}
+
+// read reads a manifest from the storage.
+func (p *replicator) read(storage Storage, repo, image, hash string) ([]byte, error) {
+	blob, _, err := storage.GetBlob(repo, image, hash)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read manifest %s: %w", hash, err)
+	}
+	defer blob.Close()
+
+	data, err := io.ReadAll(blob)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read manifest %s: %w", hash, err)
+	}
+	return data, nil
+}
+
+// url returns the target url for the provided path.
+func (p *replicator) url(path string) *url.URL {
+	turl := *p.target
+	turl.Path = strings.TrimSuffix(turl.Path, "/") + path
+	return &turl
+}
+
+// do sends a request to the target registry.
+func (p *replicator) do(ctx context.Context, method string, turl *url.URL, ctype string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, turl.String(), body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create request: %w", err)
+	}
+
+	if ctype != "" {
+		req.Header.Set("content-type", ctype)
+	}
+
+	if p.username != "" || p.password != "" {
+		req.SetBasicAuth(p.username, p.password)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to reach replication target: %w", err)
+	}
+	return resp, nil
+}
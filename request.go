@@ -1,9 +1,14 @@
 package registry
 
 import (
+	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
 )
 
@@ -24,6 +29,59 @@ type Scope struct {
 	Operations []string
 }
 
+// validDigest returns true if the provided string is a sha256 digest in its normalized form,
+// i.e. "sha256:" followed by 64 lowercase hex characters.
+func validDigest(dgst string) bool {
+	parsed, err := ParseDigest(dgst)
+	return err == nil && parsed.String() == dgst
+}
+
+// validTag returns true if the provided string is a valid tag, i.e. it matches the expression
+// [a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}. Tags starting with a dot are refused so clients can't reach
+// tags used internally, e.g. by EncryptedStorage.
+func validTag(tag string) bool {
+	if len(tag) == 0 || len(tag) > 128 || tag[0] == '.' || tag[0] == '-' {
+		return false
+	}
+	for _, c := range tag {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '_', c == '.', c == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// errBodyTooLarge is returned when reading from a request body larger than allowed.
+var errBodyTooLarge = errors.New("request body too large")
+
+// limitedBody wraps a request body and fails reads once more than 'remaining' bytes are read.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+// Read reads from the underlying body, returns errBodyTooLarge if the body is larger than
+// allowed.
+func (l *limitedBody) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		return 0, errBodyTooLarge
+	}
+
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+
+	read, err := l.ReadCloser.Read(p)
+	l.remaining -= int64(read)
+	if l.remaining < 0 {
+		return read, errBodyTooLarge
+	}
+	return read, err
+}
+
 // Request wraps a default http.Request reference. Provides some tooling around analysing the
 // desired intent of the embed http.Request. Registry protocol is a huge mess, it is easir to
 // gather all url related parsing and foo into a single entity.
@@ -31,20 +89,41 @@ type Request struct {
 	*http.Request
 }
 
+// ClientID returns a string identifying the client issuing the request. Clients sending an
+// authorization header are identified by its hash, others by their remote address.
+func (r *Request) ClientID() string {
+	if authorization := r.Header.Get("authorization"); authorization != "" {
+		return fmt.Sprintf("auth:%x", sha256.Sum256([]byte(authorization)))
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return fmt.Sprintf("addr:%s", r.RemoteAddr)
+	}
+	return fmt.Sprintf("addr:%s", host)
+}
+
+// credentials returns the credentials sent in the authorization header under the provided
+// authentication scheme. Schemes are compared case insensitively (RFC 7235) and whitespace
+// around the scheme and the credentials is ignored. Returns false if the header is absent,
+// uses a different scheme or carries no credentials, or credentials with whitespace in them.
+func (r *Request) credentials(scheme string) (string, bool) {
+	fields := strings.Fields(r.Header.Get("authorization"))
+	if len(fields) != 2 || !strings.EqualFold(fields[0], scheme) {
+		return "", false
+	}
+	return fields[1], true
+}
+
 // BasicAuth parses the Basic authentication sent by the container runtime in a header named
 // authorization. This function does not return errors, if the information could not be parsed
 // empty strings are returned.
 func (r *Request) BasicAuth() (string, string) {
-	authorization := r.Header.Get("authorization")
-	if len(authorization) == 0 {
+	authorization, ok := r.credentials("Basic")
+	if !ok {
 		return "", ""
 	}
 
-	if !strings.HasPrefix(authorization, "Basic ") {
-		return "", ""
-	}
-
-	authorization = strings.TrimPrefix(authorization, "Basic ")
 	decoded, err := base64.StdEncoding.DecodeString(authorization)
 	if err != nil {
 		return "", ""
@@ -58,6 +137,13 @@ func (r *Request) BasicAuth() (string, string) {
 	return slices[0], slices[1]
 }
 
+// BearerToken returns the token sent in the authorization header using the Bearer scheme, in
+// any casing. Returns false if no valid bearer token has been sent. Authorizer implementations
+// should rely on it instead of parsing the authorization header on their own.
+func (r *Request) BearerToken() (string, bool) {
+	return r.credentials("Bearer")
+}
+
 // AccessScope extracts the access scope (as sent by the container runtime) from the request.
 func (r *Request) AccessScope() (*AccessScope, error) {
 	// scope format is "repository:reponame/imagename:operation-0,operation-1", we need to
@@ -96,6 +182,13 @@ func (r *Request) IsPing() bool {
 	return turl == "/v2"
 }
 
+// IsV1 verifies if the request points to the old (v1) registry api, these requests are sent by
+// old clients probing for the registry version.
+func (r *Request) IsV1() bool {
+	turl := strings.TrimSuffix(r.Request.URL.Path, "/")
+	return turl == "/v1" || strings.HasPrefix(turl, "/v1/")
+}
+
 // IsAuth verifies if the url path points to our authentication endpoint. The authentication
 // endpoint path is "/v2/auth".
 func (r *Request) IsAuth() bool {
@@ -103,6 +196,44 @@ func (r *Request) IsAuth() bool {
 	return turl == "/v2/auth"
 }
 
+// IsReadyz verifies if the url path points to the readiness endpoint "/readyz".
+func (r *Request) IsReadyz() bool {
+	turl := strings.TrimSuffix(r.Request.URL.Path, "/")
+	return turl == "/readyz"
+}
+
+// IsWebUI verifies if the url path points to the web ui, i.e. starts with "/ui/".
+func (r *Request) IsWebUI() bool {
+	turl := strings.TrimSuffix(r.Request.URL.Path, "/")
+	return turl == "/ui" || strings.HasPrefix(turl, "/ui/")
+}
+
+// IsTagHistory verifies if the url path points to the admin tag history endpoints, i.e. starts
+// with "/admin/tags/".
+func (r *Request) IsTagHistory() bool {
+	return strings.HasPrefix(r.Request.URL.Path, "/admin/tags/")
+}
+
+// IsPullStats verifies if the url path points to the admin pull counters endpoint, i.e.
+// "/admin/pulls".
+func (r *Request) IsPullStats() bool {
+	turl := strings.TrimSuffix(r.Request.URL.Path, "/")
+	return turl == "/admin/pulls"
+}
+
+// IsDiskUsage verifies if the url path points to the admin disk usage endpoint, i.e.
+// "/admin/disk".
+func (r *Request) IsDiskUsage() bool {
+	turl := strings.TrimSuffix(r.Request.URL.Path, "/")
+	return turl == "/admin/disk"
+}
+
+// IsPlatformsQuery returns true if the request asks for the platforms in an image index, i.e.
+// carries the "platforms=true" query.
+func (r *Request) IsPlatformsQuery() bool {
+	return r.Get("platforms") == "true"
+}
+
 // IsBlob returns true if the url refers to a blob access.
 func (r *Request) IsBlob() bool {
 	return strings.Contains(r.Request.URL.Path, "/blobs/")
@@ -114,6 +245,35 @@ func (r *Request) IsBlobUploadRequest() bool {
 	return strings.HasSuffix(turl, "/blobs/uploads")
 }
 
+// IsUploadStart returns true if the request is a POST to /blobs/uploads/, this is how clients
+// ask for a new upload session.
+func (r *Request) IsUploadStart() bool {
+	return r.IsPost() && r.IsBlobUploadRequest()
+}
+
+// IsUploadChunk returns true if the request is a PATCH against an upload id, this means the
+// client is sending yet another chunk of the blob being uploaded.
+func (r *Request) IsUploadChunk() bool {
+	return r.IsPatch() && r.HasBlobUploadID()
+}
+
+// IsUploadFinalize returns true if the request is a PUT against an upload id. This is the last
+// request of an upload session, it may or may not carry the last chunk of data.
+func (r *Request) IsUploadFinalize() bool {
+	return r.IsPut() && r.HasBlobUploadID()
+}
+
+// IsUploadCancel returns true if the request is a DELETE against an upload id.
+func (r *Request) IsUploadCancel() bool {
+	return r.IsDelete() && r.HasBlobUploadID()
+}
+
+// IsUploadStatus returns true if the request is a GET against an upload id, clients use it to
+// learn how much of the upload has been received.
+func (r *Request) IsUploadStatus() bool {
+	return r.IsGet() && r.HasBlobUploadID()
+}
+
 // IsHead returns true if this is an http.MethodHead request.
 func (r *Request) IsHead() bool {
 	return r.Request.Method == http.MethodHead
@@ -129,6 +289,16 @@ func (r *Request) IsGet() bool {
 	return r.Request.Method == http.MethodGet
 }
 
+// IsPost returns true if this is an http.MethodPost request.
+func (r *Request) IsPost() bool {
+	return r.Request.Method == http.MethodPost
+}
+
+// IsOptions returns true if this is an http.MethodOptions request.
+func (r *Request) IsOptions() bool {
+	return r.Request.Method == http.MethodOptions
+}
+
 // IsPut returns true if this is an http.MethodPut request.
 func (r *Request) IsPut() bool {
 	return r.Request.Method == http.MethodPut
@@ -140,19 +310,53 @@ func (r *Request) IsDelete() bool {
 }
 
 // HasBlobUploadID returns true if the url contains an upload identification, this generally
-// means that a client is uploading blob data.
+// means that a client is uploading blob data. Upload urls follow the /blobs/uploads/<id> form,
+// the /blobs/upload/id/<id> form used by older versions is still recognized so uploads started
+// before an upgrade can be finished.
 func (r *Request) HasBlobUploadID() bool {
-	return strings.Contains(r.Request.URL.Path, "/blobs/upload/id/")
+	if strings.Contains(r.Request.URL.Path, "/blobs/upload/id/") {
+		return true
+	}
+
+	_, id, found := strings.Cut(r.Request.URL.Path, "/blobs/uploads/")
+	return found && strings.Trim(id, "/") != ""
 }
 
 // RepositoryAndImage attempts to extract repository and image references from the inner req,
-// the url format is expected to be like /v2/<repository>/<image>/...
+// the url format is expected to be like /v2/<repository>/<image>/... If the Authorizer has set
+// a namespace for the request (see SetNamespace) it is returned as the repository. Empty and
+// hidden (starting with a dot) names are refused, these are reserved for internal use.
 func (r *Request) RepositoryAndImage() (string, string, error) {
 	parts := strings.Split(r.Request.URL.Path, "/")
 	if len(parts) < 4 {
 		return "", "", fmt.Errorf("unable to extract url repository and image")
 	}
-	return parts[2], parts[3], nil
+
+	repo, image := parts[2], parts[3]
+	if ns, ok := NamespaceFromContext(r.Context()); ok {
+		repo = ns
+	}
+
+	if !validNamespace(repo) || !validNamespace(image) {
+		return "", "", fmt.Errorf("invalid repository or image name %q/%q", repo, image)
+	}
+	return repo, image, nil
+}
+
+// MountSource returns the repository and image a cross repository blob mount refers to through
+// the 'from' query parameter, in the form <repository>/<image>. Returns false if the parameter
+// is missing or invalid. If the Authorizer has set a namespace for the request it is returned
+// as the repository.
+func (r *Request) MountSource() (string, string, bool) {
+	repo, image, found := strings.Cut(r.Get("from"), "/")
+	if !found || !validNamespace(repo) || !validNamespace(image) {
+		return "", "", false
+	}
+
+	if ns, ok := NamespaceFromContext(r.Context()); ok {
+		return ns, image, true
+	}
+	return repo, image, true
 }
 
 // ContentType returns the content type header from the inner request.
@@ -160,6 +364,11 @@ func (r *Request) ContentType() string {
 	return r.Request.Header.Get("content-type")
 }
 
+// IsReferrers returns true if the url refers to the referrers of a manifest.
+func (r *Request) IsReferrers() bool {
+	return strings.Contains(r.Request.URL.Path, "/referrers/")
+}
+
 // IsManifest returns true if the url refers to a manifest access.
 func (r *Request) IsManifest() bool {
 	return strings.Contains(r.Request.URL.Path, "/manifests/")
@@ -180,12 +389,76 @@ func (r *Request) UploadID() string {
 	return r.last()
 }
 
-// BlobHash extracts the blob hash from the  underlying url.
+// BlobHash extracts the blob hash from the  underlying url. The hash is normalized, see
+// normalizeDigest.
 func (r *Request) BlobHash() string {
-	return r.last()
+	return normalizeDigest(r.last())
 }
 
-// ManifestID extracts the manifst tag or hash from the  underlying url.
+// ManifestID extracts the manifst tag or hash from the  underlying url. Hashes are normalized,
+// see normalizeDigest.
 func (r *Request) ManifestID() string {
+	if ref := r.last(); isDigestReference(ref) {
+		return normalizeDigest(ref)
+	}
 	return r.last()
 }
+
+// CanonicalDigests returns false if any digest the request refers to is not in its normalized
+// form (see validDigest). Digests are looked for in blob urls, in manifest urls referring to a
+// digest and in the 'digest' and 'mount' query parameters.
+func (r *Request) CanonicalDigests() bool {
+	var dgsts []string
+	switch {
+	case r.IsManifest() && isDigestReference(r.last()):
+		dgsts = append(dgsts, r.last())
+	case r.IsBlob() && !r.IsBlobUploadRequest() && !r.HasBlobUploadID():
+		dgsts = append(dgsts, r.last())
+	}
+
+	for _, param := range []string{"digest", "mount"} {
+		if dgst := r.Get(param); dgst != "" {
+			dgsts = append(dgsts, dgst)
+		}
+	}
+
+	for _, dgst := range dgsts {
+		if !validDigest(dgst) {
+			return false
+		}
+	}
+	return true
+}
+
+// UploadOffset returns the offset at which the chunk carried by the request starts, taken from
+// its content-range header (e.g. "1024-2047"). Returns false if the request has no
+// content-range header and an error if the header can't be parsed.
+func (r *Request) UploadOffset() (int64, bool, error) {
+	crange := strings.TrimPrefix(r.Header.Get("content-range"), "bytes ")
+	if crange == "" {
+		return 0, false, nil
+	}
+
+	start, end, found := strings.Cut(crange, "-")
+	if !found {
+		return 0, true, fmt.Errorf("invalid content range %q", crange)
+	}
+
+	offset, err := strconv.ParseInt(start, 10, 64)
+	if err != nil || offset < 0 {
+		return 0, true, fmt.Errorf("invalid content range %q", crange)
+	}
+
+	if last, err := strconv.ParseInt(end, 10, 64); err != nil || last < offset {
+		return 0, true, fmt.Errorf("invalid content range %q", crange)
+	}
+	return offset, true, nil
+}
+
+// UploadDigest returns the normalized digest provided by the client when finalizing an upload.
+func (r *Request) UploadDigest() string {
+	if dgst := r.Get("digest"); dgst != "" {
+		return normalizeDigest(dgst)
+	}
+	return ""
+}
@@ -0,0 +1,81 @@
+package registry
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUploadPredicates(t *testing.T) {
+	upload := "/v2/repo/image/blobs/uploads/00000000-0000-0000-0000-000000000000"
+	for _, tt := range []struct {
+		method   string
+		path     string
+		start    bool
+		chunk    bool
+		finalize bool
+		cancel   bool
+		status   bool
+	}{
+		{method: http.MethodPost, path: "/v2/repo/image/blobs/uploads/", start: true},
+		{method: http.MethodPost, path: "/v2/repo/image/blobs/uploads", start: true},
+		{method: http.MethodPatch, path: upload, chunk: true},
+		{method: http.MethodPut, path: upload, finalize: true},
+		{method: http.MethodDelete, path: upload, cancel: true},
+		{method: http.MethodGet, path: upload, status: true},
+		{method: http.MethodPatch, path: "/v2/repo/image/blobs/upload/id/abc", chunk: true},
+		{method: http.MethodPut, path: "/v2/repo/image/blobs/uploads/"},
+		{method: http.MethodPatch, path: "/v2/repo/image/blobs/uploads/"},
+		{method: http.MethodPost, path: upload},
+		{method: http.MethodPut, path: "/v2/repo/image/manifests/latest"},
+		{method: http.MethodGet, path: "/v2/repo/image/blobs/sha256:abc"},
+	} {
+		request := Request{httptest.NewRequest(tt.method, tt.path, nil)}
+		for name, pair := range map[string][2]bool{
+			"IsUploadStart":    {request.IsUploadStart(), tt.start},
+			"IsUploadChunk":    {request.IsUploadChunk(), tt.chunk},
+			"IsUploadFinalize": {request.IsUploadFinalize(), tt.finalize},
+			"IsUploadCancel":   {request.IsUploadCancel(), tt.cancel},
+			"IsUploadStatus":   {request.IsUploadStatus(), tt.status},
+		} {
+			if pair[0] != pair[1] {
+				t.Errorf("%s %s: expected %s to be %v", tt.method, tt.path, name, pair[1])
+			}
+		}
+	}
+}
+
+func TestAuthorizationSchemeCase(t *testing.T) {
+	creds := base64.StdEncoding.EncodeToString([]byte("user:pass"))
+	for _, tt := range []struct {
+		header string
+		user   string
+		pass   string
+		token  string
+	}{
+		{header: "Basic " + creds, user: "user", pass: "pass"},
+		{header: "basic " + creds, user: "user", pass: "pass"},
+		{header: "BASIC  " + creds + " ", user: "user", pass: "pass"},
+		{header: "Bearer token", token: "token"},
+		{header: "bearer token", token: "token"},
+		{header: "BeArEr token", token: "token"},
+		{header: "Bearer"},
+		{header: "Bearer two tokens"},
+		{header: "Digest " + creds},
+		{header: "Basic !notbase64"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+		req.Header.Set("authorization", tt.header)
+		request := Request{req}
+
+		if user, pass := request.BasicAuth(); user != tt.user || pass != tt.pass {
+			t.Errorf("%q: expected basic auth %q/%q, got %q/%q", tt.header, tt.user, tt.pass, user, pass)
+		}
+
+		token, ok := request.BearerToken()
+		if token != tt.token || ok != (tt.token != "") {
+			t.Errorf("%q: expected bearer token %q, got %q (%v)", tt.header, tt.token, token, ok)
+		}
+	}
+}
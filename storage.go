@@ -2,34 +2,219 @@ package registry
 
 import (
 	"crypto/sha256"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
+	"io/fs"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"k8s.io/klog"
 )
 
+// Storage is implemented by any entity capable of storing blobs and tags. Blob and manifest
+// handlers only talk to the storage through this interface so wrappers (e.g. encryption) can
+// be stacked on top of the on disk implementation.
+type Storage interface {
+	PutTag(repo, image, tag, hash string) error
+	GetTag(repo, image, tag string) (io.ReadCloser, int64, error)
+	ResolveTag(repo, image, tag string) (string, error)
+	GetBlob(repo, image, hash string) (io.ReadCloser, int64, error)
+	PutBlob(repo, image, hash string, from io.Reader) error
+	StatBlob(repo, image, hash string) (int64, error)
+	BlobModTime(repo, image, hash string) (time.Time, error)
+	PutManifestType(repo, image, hash, ctype string) error
+	GetManifestType(repo, image, hash string) (string, error)
+	PutReferrer(repo, image, subject, hash string) error
+	ListReferrers(repo, image, subject string) ([]string, error)
+	PutIndexChild(repo, image, index, child string) error
+	ListIndexParents(repo, image, child string) ([]string, error)
+	ListRepositories() ([]string, error)
+	ListTags(repo, image string) ([]string, error)
+}
+
+// BlobPather is implemented by storages keeping blobs as regular files. BlobPath returns the
+// path for a blob relative to the storage base directory.
+type BlobPather interface {
+	BlobPath(repo, image, hash string) string
+}
+
+// BlobDeleter is implemented by storages capable of removing blobs.
+type BlobDeleter interface {
+	DeleteBlob(repo, image, hash string) error
+}
+
+// ImageChecker is implemented by storages capable of telling if a repository and image exist.
+type ImageChecker interface {
+	ImageExists(repo, image string) (bool, error)
+}
+
+// TagDeleter is implemented by storages capable of removing tags.
+type TagDeleter interface {
+	DeleteTag(repo, image, tag string) error
+}
+
+// BlobLocator is implemented by storages capable of finding a blob regardless of the repository
+// and image it has been pushed to.
+type BlobLocator interface {
+	BlobExistsAnywhere(hash string) (string, string, bool)
+}
+
+// TagHistorian is implemented by storages capable of remembering the digests a tag pointed to.
+// Histories are kept newest first and capped to max entries.
+type TagHistorian interface {
+	PutTagHistory(repo, image, tag, hash string, max int) error
+	TagHistory(repo, image, tag string) ([]string, error)
+}
+
+// DiskUsage holds the size, in bytes, of the filesystem backing a storage together with how
+// much of it is used and how much is still available for new content.
+type DiskUsage struct {
+	Total uint64 `json:"total"`
+	Used  uint64 `json:"used"`
+	Free  uint64 `json:"free"`
+}
+
+// SpaceReporter is implemented by storages capable of reporting the usage of their backing
+// filesystem.
+type SpaceReporter interface {
+	DiskUsage() (DiskUsage, error)
+}
+
 // StorageHandler manages our on disk blob storage.
 type StorageHandler struct {
-	basedir string
+	sync.Mutex
+	basedir  string
+	taglocks [tagLockStripes]sync.RWMutex
+	readers  map[string]*sharedBlob
+	filemode os.FileMode
+	dirmode  os.FileMode
+	fsync    bool
+}
+
+// errInvalidDigest is returned when a file named after something other than a valid digest is
+// requested. It wraps os.ErrNotExist as no such file can exist in the storage.
+var errInvalidDigest = fmt.Errorf("invalid digest: %w", os.ErrNotExist)
+
+// digestFile returns the path of the file named after the provided digest inside dir. Digests
+// are laid out as <algorithm>/<encoded> as not all filesystems accept ':' in file names. Digests
+// not in their normalized form (see validDigest) are refused with errInvalidDigest so they can
+// never be turned into paths outside dir.
+func digestFile(dir, hash string) (string, error) {
+	if !validDigest(hash) {
+		return "", fmt.Errorf("%w: %q", errInvalidDigest, hash)
+	}
+	algo, encoded, _ := strings.Cut(hash, ":")
+	return fmt.Sprintf("%s/%s/%s", dir, algo, encoded), nil
+}
+
+// lookupDigestFile returns the path of the existing file named after the provided digest inside
+// dir. Files written by older versions, named after the digest as is, are still found. If no
+// file exists the path given by digestFile is returned.
+func lookupDigestFile(dir, hash string) (string, error) {
+	fpath, err := digestFile(dir, hash)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := os.Lstat(fpath); err == nil {
+		return fpath, nil
+	}
+
+	legacy := fmt.Sprintf("%s/%s", dir, hash)
+	if _, err := os.Lstat(legacy); err == nil {
+		return legacy, nil
+	}
+	return fpath, nil
+}
+
+// listDigests returns the digests of all files inside the provided directory, as laid out by
+// digestFile. Files named after the digest as is, by older versions, are also returned.
+func listDigests(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	digests := []string{}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		if entry.Type().IsRegular() {
+			digests = append(digests, entry.Name())
+			continue
+		}
+
+		if !entry.IsDir() {
+			continue
+		}
+
+		files, err := os.ReadDir(fmt.Sprintf("%s/%s", dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, file := range files {
+			if !file.Type().IsRegular() || strings.HasPrefix(file.Name(), ".") {
+				continue
+			}
+			digests = append(digests, fmt.Sprintf("%s:%s", entry.Name(), file.Name()))
+		}
+	}
+	return digests, nil
+}
+
+// tagLockStripes is the number of locks tags are spread over, see tagLock.
+const tagLockStripes = 256
+
+// tagLock returns the lock for the provided tag. Tag reads and writes are serialized through
+// this lock so a reader never observes a tag being written. Tags are spread over a fixed set
+// of locks, by a hash of their names, so unrelated tags may share a lock.
+func (s *StorageHandler) tagLock(repo, image, tag string) *sync.RWMutex {
+	hasher := fnv.New32a()
+	fmt.Fprintf(hasher, "%s/%s/%s", repo, image, tag)
+	return &s.taglocks[hasher.Sum32()%tagLockStripes]
 }
 
 // PutTag stores a manifest tag. The tag is stored in the 'tags' directory and it is a regular
-// file whose content is the blob name where the manifest for the tag is stored.
+// file whose content is the blob name where the manifest for the tag is stored. The tag file is
+// first written to a temporary file and then renamed.
 func (s *StorageHandler) PutTag(repo, image, tag, hash string) error {
 	tagdir := fmt.Sprintf("%s/%s/%s/tags", s.basedir, repo, image)
-	if err := os.MkdirAll(tagdir, os.ModePerm); err != nil && !os.IsExist(err) {
+	if err := os.MkdirAll(tagdir, s.dirmode); err != nil {
 		return fmt.Errorf("unable to create manifest storage: %w", err)
 	}
 
-	tagpath := fmt.Sprintf("%s/%s", tagdir, tag)
-	manfp, err := os.OpenFile(tagpath, os.O_CREATE|os.O_RDWR, 0644)
+	manfp, err := os.CreateTemp(tagdir, ".tmp-")
 	if err != nil {
 		return fmt.Errorf("unable to create tag file: %w", err)
 	}
+	defer os.RemoveAll(manfp.Name())
 	defer manfp.Close()
 
 	if _, err := manfp.WriteString(hash); err != nil {
 		return fmt.Errorf("unable to write to tag file: %w", err)
 	}
+
+	if err := manfp.Chmod(s.filemode); err != nil {
+		return fmt.Errorf("unable to set tag file permissions: %w", err)
+	}
+
+	lock := s.tagLock(repo, image, tag)
+	lock.Lock()
+	defer lock.Unlock()
+
+	tagpath := fmt.Sprintf("%s/%s", tagdir, tag)
+	if err := os.Rename(manfp.Name(), tagpath); err != nil {
+		return fmt.Errorf("unable to move tag file: %w", err)
+	}
 	return nil
 }
 
@@ -37,20 +222,35 @@ func (s *StorageHandler) PutTag(repo, image, tag, hash string) error {
 // manifest is stored. Returns a ReadCloser from where the manifest can be read. It is caller
 // responsibility to close the returned ReadCloser.
 func (s *StorageHandler) GetTag(repo, image, tag string) (io.ReadCloser, int64, error) {
+	hash, err := s.ResolveTag(repo, image, tag)
+	if err != nil {
+		return nil, 0, err
+	}
+	return s.GetBlob(repo, image, hash)
+}
+
+// ResolveTag reads the tag file and returns the hash of the manifest blob the tag points to.
+func (s *StorageHandler) ResolveTag(repo, image, tag string) (string, error) {
+	lock := s.tagLock(repo, image, tag)
+	lock.RLock()
+	defer lock.RUnlock()
+
 	tagpath := fmt.Sprintf("%s/%s/%s/tags/%s", s.basedir, repo, image, tag)
 	data, err := os.ReadFile(tagpath)
 	if err != nil {
-		return nil, 0, fmt.Errorf("unable to read tag file: %w", err)
+		return "", fmt.Errorf("unable to read tag file: %w", err)
 	}
-
-	hash := string(data)
-	return s.GetBlob(repo, image, hash)
+	return string(data), nil
 }
 
 // GetBlob gets a blob from our storage. Returns a ReadCloser from where the blob content can be
 // read and it caller's responsibility to close the returned ReadCloser.
 func (s *StorageHandler) GetBlob(repo, image, hash string) (io.ReadCloser, int64, error) {
-	blobpath := fmt.Sprintf("%s/%s/%s/%s", s.basedir, repo, image, hash)
+	blobpath, err := lookupDigestFile(fmt.Sprintf("%s/%s/%s", s.basedir, repo, image), hash)
+	if err != nil {
+		return nil, 0, err
+	}
+
 	blobfp, err := os.Open(blobpath)
 	if err != nil {
 		return nil, 0, fmt.Errorf("unable to open blob file: %w", err)
@@ -65,41 +265,207 @@ func (s *StorageHandler) GetBlob(repo, image, hash string) (io.ReadCloser, int64
 	return blobfp, finfo.Size(), nil
 }
 
+// sharedBlob is a blob file opened for random access and shared by all its concurrent readers.
+type sharedBlob struct {
+	fp   *os.File
+	size int64
+	refs int
+}
+
+// blobReader is a reference to a shared blob file. Closing it releases the reference, the file
+// itself is closed once all references are released.
+type blobReader struct {
+	io.ReaderAt
+	once    sync.Once
+	release func()
+}
+
+// Close releases the reference to the shared blob file.
+func (b *blobReader) Close() error {
+	b.once.Do(b.release)
+	return nil
+}
+
+// blobReaderAt returns a reader for random access to a blob together with the blob size.
+// Concurrent readers of the same blob share a single open file, reads at different offsets
+// don't interfere with each other. Callers must Close the returned reader once done.
+func (s *StorageHandler) blobReaderAt(repo, image, hash string) (*blobReader, int64, error) {
+	blobpath, err := lookupDigestFile(fmt.Sprintf("%s/%s/%s", s.basedir, repo, image), hash)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	shared, ok := s.readers[blobpath]
+	if !ok {
+		fp, err := os.Open(blobpath)
+		if err != nil {
+			return nil, 0, fmt.Errorf("unable to open blob file: %w", err)
+		}
+
+		finfo, err := fp.Stat()
+		if err != nil {
+			fp.Close()
+			return nil, 0, fmt.Errorf("unable to read blob properties: %w", err)
+		}
+
+		shared = &sharedBlob{fp: fp, size: finfo.Size()}
+		s.readers[blobpath] = shared
+	}
+
+	shared.refs++
+	release := func() {
+		s.Lock()
+		defer s.Unlock()
+
+		shared.refs--
+		if shared.refs > 0 {
+			return
+		}
+
+		delete(s.readers, blobpath)
+		if err := shared.fp.Close(); err != nil {
+			klog.Errorf("unable to close blob file: %s", err)
+		}
+	}
+	return &blobReader{ReaderAt: shared.fp, release: release}, shared.size, nil
+}
+
 // PutBlob writes content from the provided io.Reader as a blob of the provided repository
-// and image pair. Checks if the written hash matches the provided hash and returns an error
-// if there is a mismatch. In case of mismatch the file is deleted from disk.
+// and image pair. The blob is first written to a temporary file and only renamed into place
+// once its hash matches the provided hash, on mismatch an error is returned and any blob
+// already stored under the hash is left untouched. Unless fsync has been disabled the blob is
+// flushed to disk before returning.
 func (s *StorageHandler) PutBlob(repo, image, hash string, from io.Reader) error {
-	repodir := fmt.Sprintf("%s/%s/%s", s.basedir, repo, image)
-	if err := os.MkdirAll(repodir, os.ModePerm); err != nil && !os.IsExist(err) {
+	blobpath, err := digestFile(fmt.Sprintf("%s/%s/%s", s.basedir, repo, image), hash)
+	if err != nil {
+		return err
+	}
+
+	blobdir := filepath.Dir(blobpath)
+	if err := os.MkdirAll(blobdir, s.dirmode); err != nil {
 		return fmt.Errorf("unable to create image storage: %w", err)
 	}
 
-	blobpath := fmt.Sprintf("%s/%s/%s/%s", s.basedir, repo, image, hash)
-	blobfp, err := os.OpenFile(blobpath, os.O_CREATE|os.O_RDWR, 0644)
+	blobfp, err := os.CreateTemp(blobdir, ".tmp-")
 	if err != nil {
 		return fmt.Errorf("unable to create blob file: %w", err)
 	}
+	defer os.RemoveAll(blobfp.Name())
 	defer blobfp.Close()
 
+	if err := blobfp.Chmod(s.filemode); err != nil {
+		return fmt.Errorf("unable to set blob file mode: %w", err)
+	}
+
 	hasher := sha256.New()
 	to := io.MultiWriter(blobfp, hasher)
 	if _, err := io.Copy(to, from); err != nil {
-		_ = os.RemoveAll(blobpath)
 		return fmt.Errorf("error copying blob: %w", err)
 	}
 
-	reshash := fmt.Sprintf("sha256:%x", hasher.Sum(nil))
+	reshash := digestFromHash(hasher).String()
 	if hash != reshash {
-		_ = os.RemoveAll(blobpath)
-		return fmt.Errorf("blob hash mismatch")
+		return &DigestMismatchError{Expected: hash, Actual: reshash}
+	}
+
+	if s.fsync {
+		if err := blobfp.Sync(); err != nil {
+			return fmt.Errorf("unable to sync blob file: %w", err)
+		}
+	}
+
+	if err := os.Rename(blobfp.Name(), blobpath); err != nil {
+		return fmt.Errorf("unable to move blob file: %w", err)
+	}
+
+	if !s.fsync {
+		return nil
+	}
+	return syncDir(blobdir)
+}
+
+// syncDir flushes the provided directory to disk so entries recently created in it survive a
+// crash.
+func syncDir(dir string) error {
+	fp, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("unable to open directory for sync: %w", err)
+	}
+	defer fp.Close()
+
+	if err := fp.Sync(); err != nil {
+		return fmt.Errorf("unable to sync directory: %w", err)
 	}
 	return nil
 }
 
+// ImageExists returns true if the repository and image directory exists.
+func (s *StorageHandler) ImageExists(repo, image string) (bool, error) {
+	imgdir := fmt.Sprintf("%s/%s/%s", s.basedir, repo, image)
+	if _, err := os.Stat(imgdir); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// DiskUsage reports the usage of the filesystem holding the storage base directory. Free space
+// is the space available to unprivileged users.
+func (s *StorageHandler) DiskUsage() (DiskUsage, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(s.basedir, &stat); err != nil {
+		return DiskUsage{}, fmt.Errorf("unable to stat storage filesystem: %w", err)
+	}
+
+	bsize := uint64(stat.Bsize)
+	return DiskUsage{
+		Total: stat.Blocks * bsize,
+		Used:  (stat.Blocks - stat.Bfree) * bsize,
+		Free:  stat.Bavail * bsize,
+	}, nil
+}
+
+// DeleteTag removes a tag from the storage. The manifest the tag points to is kept.
+func (s *StorageHandler) DeleteTag(repo, image, tag string) error {
+	lock := s.tagLock(repo, image, tag)
+	lock.Lock()
+	defer lock.Unlock()
+
+	tagpath := fmt.Sprintf("%s/%s/%s/tags/%s", s.basedir, repo, image, tag)
+	return os.Remove(tagpath)
+}
+
+// BlobPath returns the path, relative to the storage base directory, where the blob is kept.
+func (s *StorageHandler) BlobPath(repo, image, hash string) string {
+	fpath, err := lookupDigestFile(fmt.Sprintf("%s/%s/%s", s.basedir, repo, image), hash)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimPrefix(fpath, s.basedir+"/")
+}
+
+// DeleteBlob removes a blob from the storage.
+func (s *StorageHandler) DeleteBlob(repo, image, hash string) error {
+	fpath, err := lookupDigestFile(fmt.Sprintf("%s/%s/%s", s.basedir, repo, image), hash)
+	if err != nil {
+		return err
+	}
+	return os.Remove(fpath)
+}
+
 // StatBlob checks if a blob identified by its hash exists inside the provided repository and
 // image.
 func (s *StorageHandler) StatBlob(repo, image, hash string) (int64, error) {
-	fpath := fmt.Sprintf("%s/%s/%s/%s", s.basedir, repo, image, hash)
+	fpath, err := lookupDigestFile(fmt.Sprintf("%s/%s/%s", s.basedir, repo, image), hash)
+	if err != nil {
+		return 0, err
+	}
+
 	finfo, err := os.Stat(fpath)
 	if err != nil {
 		return 0, err
@@ -107,9 +473,344 @@ func (s *StorageHandler) StatBlob(repo, image, hash string) (int64, error) {
 	return finfo.Size(), nil
 }
 
+// BlobExistsAnywhere looks for the provided blob in all repositories and images and returns the
+// first repository and image holding it. As blobs are kept per image this scans the storage.
+func (s *StorageHandler) BlobExistsAnywhere(hash string) (string, string, bool) {
+	names, err := s.ListRepositories()
+	if err != nil {
+		klog.Errorf("unable to look for blob %s: %s", hash, err)
+		return "", "", false
+	}
+
+	for _, name := range names {
+		repo, image, _ := strings.Cut(name, "/")
+		if _, err := s.StatBlob(repo, image, hash); err == nil {
+			return repo, image, true
+		}
+	}
+	return "", "", false
+}
+
+// PutManifestType stores the content type for the manifest stored under the provided hash. The
+// content type is kept in a regular file, named after the manifest hash, inside the 'manifests'
+// directory.
+func (s *StorageHandler) PutManifestType(repo, image, hash, ctype string) error {
+	fpath, err := digestFile(fmt.Sprintf("%s/%s/%s/manifests", s.basedir, repo, image), hash)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fpath), s.dirmode); err != nil {
+		return fmt.Errorf("unable to create manifest storage: %w", err)
+	}
+
+	if err := os.WriteFile(fpath, []byte(ctype), s.filemode); err != nil {
+		return fmt.Errorf("unable to write manifest content type: %w", err)
+	}
+	return nil
+}
+
+// GetManifestType returns the content type for the manifest stored under the provided hash.
+func (s *StorageHandler) GetManifestType(repo, image, hash string) (string, error) {
+	fpath, err := lookupDigestFile(fmt.Sprintf("%s/%s/%s/manifests", s.basedir, repo, image), hash)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := os.ReadFile(fpath)
+	if err != nil {
+		return "", fmt.Errorf("unable to read manifest content type: %w", err)
+	}
+	return string(data), nil
+}
+
+// PutReferrer records that the manifest stored under the provided hash refers to the subject
+// manifest. Referrers are kept as empty files, named after the referrer hash, inside a directory
+// named after the subject hash in the 'referrers' directory.
+func (s *StorageHandler) PutReferrer(repo, image, subject, hash string) error {
+	refdir, err := digestFile(fmt.Sprintf("%s/%s/%s/referrers", s.basedir, repo, image), subject)
+	if err != nil {
+		return err
+	}
+
+	fpath, err := digestFile(refdir, hash)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fpath), s.dirmode); err != nil {
+		return fmt.Errorf("unable to create referrers storage: %w", err)
+	}
+
+	if err := os.WriteFile(fpath, nil, s.filemode); err != nil {
+		return fmt.Errorf("unable to write referrer file: %w", err)
+	}
+	return nil
+}
+
+// ListReferrers returns the hashes of all manifests referring to the provided subject manifest,
+// see PutReferrer.
+func (s *StorageHandler) ListReferrers(repo, image, subject string) ([]string, error) {
+	refdir, err := digestFile(fmt.Sprintf("%s/%s/%s/referrers", s.basedir, repo, image), subject)
+	if err != nil {
+		return nil, err
+	}
+
+	referrers, err := listDigests(refdir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, fmt.Errorf("unable to list referrers: %w", err)
+	}
+	return referrers, nil
+}
+
+// PutIndexChild records that the image index identified by 'index' refers to the manifest
+// identified by 'child'. References are kept indexed by child so we can tell whether a manifest
+// is still in use by an index.
+func (s *StorageHandler) PutIndexChild(repo, image, index, child string) error {
+	pardir, err := digestFile(fmt.Sprintf("%s/%s/%s/parents", s.basedir, repo, image), child)
+	if err != nil {
+		return err
+	}
+
+	fpath, err := digestFile(pardir, index)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fpath), s.dirmode); err != nil {
+		return fmt.Errorf("unable to create parents storage: %w", err)
+	}
+
+	if err := os.WriteFile(fpath, nil, s.filemode); err != nil {
+		return fmt.Errorf("unable to write parent file: %w", err)
+	}
+	return nil
+}
+
+// ListIndexParents returns the hashes of all image indexes referring to the provided manifest.
+// Parents recorded by older versions, kept in a directory named after the child hash as is,
+// are also returned.
+func (s *StorageHandler) ListIndexParents(repo, image, child string) ([]string, error) {
+	pardir := fmt.Sprintf("%s/%s/%s/parents", s.basedir, repo, image)
+	childdir, err := digestFile(pardir, child)
+	if err != nil {
+		return nil, err
+	}
+	dirs := []string{childdir, fmt.Sprintf("%s/%s", pardir, child)}
+
+	parents := []string{}
+	for _, dir := range dirs {
+		digests, err := listDigests(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("unable to list parents: %w", err)
+		}
+		parents = append(parents, digests...)
+	}
+	return parents, nil
+}
+
+// maxWalkDepth bounds how deep storage walks descend. The storage layout is never this deep.
+const maxWalkDepth = 8
+
+// walk calls fn for every non hidden directory and regular file found up to depth levels below
+// dir, paths given to fn are relative to dir. Symlinks and special files are never followed nor
+// reported, so a walk can't leave the storage base directory nor loop. Directories that can't
+// be read are logged and skipped. dir itself may be a symlink.
+func (s *StorageHandler) walk(dir string, depth int, fn func(rel string, entry fs.DirEntry) error) error {
+	if depth > maxWalkDepth {
+		depth = maxWalkDepth
+	}
+
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+
+	return filepath.WalkDir(root, func(fpath string, entry fs.DirEntry, err error) error {
+		if fpath == root {
+			return err
+		}
+
+		if err != nil {
+			klog.Errorf("unable to walk %s: %s", fpath, err)
+			return fs.SkipDir
+		}
+
+		rel, err := filepath.Rel(root, fpath)
+		if err != nil {
+			return err
+		}
+
+		skip := strings.HasPrefix(entry.Name(), ".")
+		if !entry.IsDir() {
+			skip = skip || !entry.Type().IsRegular()
+		}
+		if skip {
+			if entry.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		if err := fn(rel, entry); err != nil {
+			return err
+		}
+
+		if entry.IsDir() && strings.Count(rel, string(filepath.Separator))+1 >= depth {
+			return fs.SkipDir
+		}
+		return nil
+	})
+}
+
+// ListRepositories returns all repository/image pairs present in the storage. Entries in the
+// storage base directory that are not directories (or are hidden) are ignored, so are
+// repositories without any image.
+func (s *StorageHandler) ListRepositories() ([]string, error) {
+	var names []string
+	err := s.walk(s.basedir, 2, func(rel string, entry fs.DirEntry) error {
+		repo, image, found := strings.Cut(filepath.ToSlash(rel), "/")
+		if entry.IsDir() && found {
+			names = append(names, fmt.Sprintf("%s/%s", repo, image))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list repositories: %w", err)
+	}
+	return names, nil
+}
+
+// errNameUnknown is returned when listing tags for a repository and image that does not exist.
+// It wraps os.ErrNotExist.
+var errNameUnknown = fmt.Errorf("unknown repository: %w", os.ErrNotExist)
+
+// ListTags returns all tags for the provided repository and image. Hidden entries and entries
+// that are not regular files are ignored. Returns errNameUnknown if the repository and image
+// do not exist and an empty list if they exist but hold no tags.
+func (s *StorageHandler) ListTags(repo, image string) ([]string, error) {
+	imgdir := fmt.Sprintf("%s/%s/%s", s.basedir, repo, image)
+	if _, err := os.Stat(imgdir); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, errNameUnknown
+		}
+		return nil, fmt.Errorf("unable to list tags: %w", err)
+	}
+
+	tagdir := fmt.Sprintf("%s/tags", imgdir)
+	entries, err := os.ReadDir(tagdir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return []string{}, nil
+		}
+		return nil, fmt.Errorf("unable to list tags: %w", err)
+	}
+
+	tags := []string{}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		tags = append(tags, entry.Name())
+	}
+	return tags, nil
+}
+
+// PutTagHistory records that the provided tag used to point to hash. Histories are stored in
+// the 'history' directory, one file per tag holding one digest per line. Only the newest max
+// entries are kept.
+func (s *StorageHandler) PutTagHistory(repo, image, tag, hash string, max int) error {
+	histdir := fmt.Sprintf("%s/%s/%s/history", s.basedir, repo, image)
+	if err := os.MkdirAll(histdir, s.dirmode); err != nil {
+		return fmt.Errorf("unable to create tag history storage: %w", err)
+	}
+
+	lock := s.tagLock(repo, image, tag)
+	lock.Lock()
+	defer lock.Unlock()
+
+	histpath := fmt.Sprintf("%s/%s", histdir, tag)
+	history, err := s.readTagHistory(histpath)
+	if err != nil {
+		return err
+	}
+
+	history = append([]string{hash}, history...)
+	if len(history) > max {
+		history = history[:max]
+	}
+
+	histfp, err := os.CreateTemp(histdir, ".tmp-")
+	if err != nil {
+		return fmt.Errorf("unable to create tag history file: %w", err)
+	}
+	defer os.RemoveAll(histfp.Name())
+	defer histfp.Close()
+
+	if _, err := histfp.WriteString(strings.Join(history, "\n") + "\n"); err != nil {
+		return fmt.Errorf("unable to write to tag history file: %w", err)
+	}
+
+	if err := histfp.Chmod(s.filemode); err != nil {
+		return fmt.Errorf("unable to set tag history file permissions: %w", err)
+	}
+
+	if err := os.Rename(histfp.Name(), histpath); err != nil {
+		return fmt.Errorf("unable to move tag history file: %w", err)
+	}
+	return nil
+}
+
+// TagHistory returns the digests the provided tag pointed to, newest first. Tags without any
+// history return an empty list.
+func (s *StorageHandler) TagHistory(repo, image, tag string) ([]string, error) {
+	lock := s.tagLock(repo, image, tag)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	histpath := fmt.Sprintf("%s/%s/%s/history/%s", s.basedir, repo, image, tag)
+	return s.readTagHistory(histpath)
+}
+
+// readTagHistory reads the tag history file. A missing file is an empty history.
+func (s *StorageHandler) readTagHistory(histpath string) ([]string, error) {
+	data, err := os.ReadFile(histpath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return []string{}, nil
+		}
+		return nil, fmt.Errorf("unable to read tag history file: %w", err)
+	}
+	return strings.Fields(string(data)), nil
+}
+
+// BlobModTime returns the last time the blob identified by the provided hash was modified.
+func (s *StorageHandler) BlobModTime(repo, image, hash string) (time.Time, error) {
+	fpath, err := lookupDigestFile(fmt.Sprintf("%s/%s/%s", s.basedir, repo, image), hash)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	finfo, err := os.Stat(fpath)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return finfo.ModTime(), nil
+}
+
 // NewStorageHandler returns a new storage handler for image blobs.
 func NewStorageHandler() *StorageHandler {
 	return &StorageHandler{
-		basedir: "/tmp/storage",
+		basedir:  tmpStorageDir,
+		readers:  map[string]*sharedBlob{},
+		filemode: 0644,
+		dirmode:  0755,
+		fsync:    true,
 	}
 }
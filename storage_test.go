@@ -0,0 +1,320 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTagReadAfterWrite(t *testing.T) {
+	storage := newTestStorage(t)
+
+	digests := []string{
+		"sha256:" + strings.Repeat("a", 64),
+		"sha256:" + strings.Repeat("b", 64),
+	}
+	if err := storage.PutTag("repo", "image", "latest", digests[0]); err != nil {
+		t.Fatalf("unable to store tag: %s", err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for writer := 0; writer < 4; writer++ {
+		wg.Add(1)
+		go func(writer int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				if err := storage.PutTag("repo", "image", "latest", digests[(writer+i)%2]); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(writer)
+	}
+
+	for reader := 0; reader < 8; reader++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 400; i++ {
+				hash, err := storage.ResolveTag("repo", "image", "latest")
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				if hash != digests[0] && hash != digests[1] {
+					errs <- fmt.Errorf("tag resolved to %q", hash)
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestTagLockStripes(t *testing.T) {
+	storage := newTestStorage(t)
+
+	first := storage.tagLock("repo", "image", "latest")
+	if again := storage.tagLock("repo", "image", "latest"); again != first {
+		t.Error("the same tag got two different locks")
+	}
+
+	locks := map[*sync.RWMutex]bool{}
+	for i := 0; i < 10*tagLockStripes; i++ {
+		locks[storage.tagLock("repo", "image", fmt.Sprint(i))] = true
+	}
+
+	if len(locks) > tagLockStripes {
+		t.Errorf("expected at most %d locks, got %d", tagLockStripes, len(locks))
+	}
+}
+
+func TestListIgnoresStrayEntries(t *testing.T) {
+	storage := newTestStorage(t)
+
+	hash := "sha256:" + strings.Repeat("a", 64)
+	if err := storage.PutTag("repo", "image", "latest", hash); err != nil {
+		t.Fatalf("unable to store tag: %s", err)
+	}
+
+	for _, dir := range []string{"lost+found", ".trash/image", "repo/image/tags/subdir"} {
+		if err := os.MkdirAll(filepath.Join(storage.basedir, dir), 0755); err != nil {
+			t.Fatalf("unable to create %s: %s", dir, err)
+		}
+	}
+
+	for _, file := range []string{".DS_Store", "README", "repo/notes.txt", "repo/image/tags/.hidden"} {
+		if err := os.WriteFile(filepath.Join(storage.basedir, file), []byte("stray"), 0644); err != nil {
+			t.Fatalf("unable to create %s: %s", file, err)
+		}
+	}
+
+	names, err := storage.ListRepositories()
+	if err != nil {
+		t.Fatalf("unable to list repositories: %s", err)
+	}
+
+	if strings.Join(names, ",") != "repo/image" {
+		t.Errorf("unexpected repositories %v", names)
+	}
+
+	tags, err := storage.ListTags("repo", "image")
+	if err != nil {
+		t.Fatalf("unable to list tags: %s", err)
+	}
+
+	if strings.Join(tags, ",") != "latest" {
+		t.Errorf("unexpected tags %v", tags)
+	}
+}
+
+func TestStorageFileMode(t *testing.T) {
+	dir := t.TempDir()
+	server, reg := newTestServer(t, WithStorageDir(dir), WithStorageFileMode(0600, 0700))
+
+	pushBlob(t, server, "repo", "image", []byte("layer"))
+	pushManifest(t, server, "repo", "image", "latest", "application/vnd.oci.image.manifest.v1+json", []byte(testManifest))
+
+	var files int
+	err := filepath.WalkDir(dir, func(fpath string, entry fs.DirEntry, err error) error {
+		if err != nil || fpath == dir {
+			return err
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		expected := os.FileMode(0600)
+		if entry.IsDir() {
+			expected = 0700
+		} else {
+			files++
+		}
+
+		if info.Mode().Perm() != expected {
+			t.Errorf("%s: expected mode %o, got %o", fpath, expected, info.Mode().Perm())
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unable to walk storage: %s", err)
+	}
+
+	if files == 0 {
+		t.Fatal("no files found in the storage")
+	}
+
+	uploads := reg.blobhdr.upload
+	id, err := uploads.Start(time.Hour, "client", "repo", "image")
+	if err != nil {
+		t.Fatalf("unable to start upload: %s", err)
+	}
+
+	if _, err := uploads.Append(context.Background(), id, strings.NewReader("data")); err != nil {
+		t.Fatalf("unable to append: %s", err)
+	}
+
+	info, err := os.Stat(uploads.tmpFileForUpload(id))
+	if err != nil {
+		t.Fatalf("unable to stat upload file: %s", err)
+	}
+
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("upload file: expected mode 600, got %o", info.Mode().Perm())
+	}
+}
+
+func TestListTagsUnknown(t *testing.T) {
+	server, reg := newTestServer(t, WithWebUI(true))
+	pushBlob(t, server, "repo", "empty", []byte("layer"))
+
+	if _, err := reg.storage.ListTags("repo", "unknown"); !errors.Is(err, errNameUnknown) || !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected an unknown name error, got %v", err)
+	}
+
+	tags, err := reg.storage.ListTags("repo", "empty")
+	if err != nil {
+		t.Fatalf("unable to list tags: %s", err)
+	}
+
+	if tags == nil || len(tags) != 0 {
+		t.Errorf("expected an empty tag list, got %#v", tags)
+	}
+
+	resp, body := do(t, server, http.MethodGet, "/ui/repo/unknown", "", nil)
+	if resp.StatusCode != ErrNameUnknown.Status || !strings.Contains(string(body), ErrNameUnknown.Code) {
+		t.Errorf("unknown image: unexpected reply %d: %s", resp.StatusCode, body)
+	}
+
+	if resp, body := do(t, server, http.MethodGet, "/ui/repo/empty", "", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("empty image: unexpected reply %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestWalkSymlinks(t *testing.T) {
+	storage := newTestStorage(t)
+	if err := storage.PutTag("repo", "image", "latest", "sha256:"+strings.Repeat("a", 64)); err != nil {
+		t.Fatalf("unable to store tag: %s", err)
+	}
+
+	outside := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(outside, "escaped", "image"), 0755); err != nil {
+		t.Fatalf("unable to create outside directory: %s", err)
+	}
+
+	for link, target := range map[string]string{
+		"escaped":         filepath.Join(outside, "escaped"),
+		"repo/outside":    filepath.Join(outside, "escaped", "image"),
+		"repo/image/loop": filepath.Join(storage.basedir, "repo"),
+	} {
+		if err := os.Symlink(target, filepath.Join(storage.basedir, link)); err != nil {
+			t.Fatalf("unable to create symlink: %s", err)
+		}
+	}
+
+	done := make(chan struct{})
+	var visited []string
+	var err error
+	go func() {
+		defer close(done)
+		err = storage.walk(storage.basedir, maxWalkDepth+10, func(rel string, _ fs.DirEntry) error {
+			visited = append(visited, filepath.ToSlash(rel))
+			return nil
+		})
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("storage walk did not finish")
+	}
+
+	if err != nil {
+		t.Fatalf("unable to walk storage: %s", err)
+	}
+
+	for _, rel := range visited {
+		if strings.Contains(rel, "escaped") || strings.Contains(rel, "outside") || strings.Contains(rel, "loop") {
+			t.Errorf("walk followed a symlink: %s", rel)
+		}
+	}
+
+	names, err := storage.ListRepositories()
+	if err != nil {
+		t.Fatalf("unable to list repositories: %s", err)
+	}
+
+	if strings.Join(names, ",") != "repo/image" {
+		t.Errorf("unexpected repositories %v", names)
+	}
+}
+
+func TestStorageInvalidDigest(t *testing.T) {
+	storage := newTestStorage(t)
+	for _, hash := range []string{"../../victim", "sha256:..", "sha256:../../victim", ""} {
+		err := storage.PutBlob("repo", "image", hash, strings.NewReader("data"))
+		if !errors.Is(err, errInvalidDigest) {
+			t.Errorf("%q: expected invalid digest writing blob, got %v", hash, err)
+		}
+
+		if _, err := storage.StatBlob("repo", "image", hash); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%q: expected blob not to exist, got %v", hash, err)
+		}
+
+		if err := storage.PutManifestType("repo", "image", hash, "type"); !errors.Is(err, errInvalidDigest) {
+			t.Errorf("%q: expected invalid digest writing manifest type, got %v", hash, err)
+		}
+	}
+
+	if entries, err := os.ReadDir(storage.basedir); err != nil || len(entries) != 0 {
+		t.Errorf("expected storage to remain empty, got %v, %v", entries, err)
+	}
+}
+
+func TestPutBlobMismatchKeepsBlob(t *testing.T) {
+	storage := newTestStorage(t)
+	content := []byte("content")
+	hash := DigestOf(content).String()
+	if err := storage.PutBlob("repo", "image", hash, bytes.NewReader(content)); err != nil {
+		t.Fatalf("unable to store blob: %s", err)
+	}
+
+	var mismatch *DigestMismatchError
+	if err := storage.PutBlob("repo", "image", hash, strings.NewReader("other")); !errors.As(err, &mismatch) {
+		t.Fatalf("expected digest mismatch, got %v", err)
+	}
+
+	blob, _, err := storage.GetBlob("repo", "image", hash)
+	if err != nil {
+		t.Fatalf("blob removed by mismatching push: %s", err)
+	}
+	defer blob.Close()
+
+	if data, err := io.ReadAll(blob); err != nil || !bytes.Equal(data, content) {
+		t.Errorf("blob changed by mismatching push: %q, %v", data, err)
+	}
+
+	entries, err := os.ReadDir(filepath.Join(storage.basedir, "repo", "image", "sha256"))
+	if err != nil || len(entries) != 1 {
+		t.Errorf("expected only the blob to be stored, got %v, %v", entries, err)
+	}
+}
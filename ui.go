@@ -0,0 +1,141 @@
+package registry
+
+import (
+	"errors"
+	"html/template"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"k8s.io/klog"
+)
+
+// uiTemplates holds the pages served by the web ui. Pages are kept minimal on purpose, they are
+// meant for humans taking a quick look at the registry content.
+var uiTemplates = template.Must(template.New("ui").Parse(`
+{{define "header"}}<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>registry</title></head><body>
+<p><a href="/ui/">repositories</a></p>{{end}}
+{{define "footer"}}</body></html>{{end}}
+{{define "repositories"}}{{template "header"}}
+<h1>repositories</h1>
+<ul>{{range .}}<li><a href="/ui/{{.}}/">{{.}}</a></li>{{else}}<li>no repositories</li>{{end}}</ul>
+{{template "footer"}}{{end}}
+{{define "tags"}}{{template "header"}}
+<h1>{{.Name}}</h1>
+<ul>{{range .Tags}}<li><a href="/ui/{{$.Name}}/{{.}}">{{.}}</a></li>{{else}}<li>no tags</li>{{end}}</ul>
+{{template "footer"}}{{end}}
+{{define "manifest"}}{{template "header"}}
+<h1>{{.Name}}:{{.Tag}}</h1>
+<dl><dt>digest</dt><dd>{{.Digest}}</dd><dt>content type</dt><dd>{{.ContentType}}</dd>
+<dt>size</dt><dd>{{.Size}} bytes</dd></dl>
+<pre>{{.Content}}</pre>
+{{template "footer"}}{{end}}
+`))
+
+// uiPage renders the provided template into the response.
+func uiPage(resp http.ResponseWriter, name string, data interface{}) {
+	resp.Header().Set("content-type", "text/html; charset=utf-8")
+	if err := uiTemplates.ExecuteTemplate(resp, name, data); err != nil {
+		klog.Errorf("unable to render ui page %s: %s", name, err)
+	}
+}
+
+// serveWebUI serves the read only web ui. Urls follow the form /ui/ for the list of repositories,
+// /ui/<repository>/<image>/ for the list of tags and /ui/<repository>/<image>/<tag> for the
+// manifest details.
+func (r *Registry) serveWebUI(resp http.ResponseWriter, request Request) {
+	if !request.IsGet() {
+		ErrUnsupported.Write(resp)
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(request.URL.Path, "/ui"), "/")
+	parts := strings.Split(path, "/")
+	switch {
+	case path == "":
+		r.uiRepositories(resp, request)
+	case len(parts) == 2:
+		r.uiTags(resp, request)
+	case len(parts) == 3:
+		r.uiManifest(resp, request)
+	default:
+		ErrUnsupported.Write(resp)
+	}
+}
+
+// uiRepositories lists all repositories. If the Authorizer has set a namespace for the request
+// only the repositories in it are listed.
+func (r *Registry) uiRepositories(resp http.ResponseWriter, request Request) {
+	repos, err := r.storage.ListRepositories()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		klog.Errorf("unable to list repositories: %s", err)
+		ErrInternal(err).Write(resp)
+		return
+	}
+
+	if ns, ok := NamespaceFromContext(request.Context()); ok {
+		var filtered []string
+		for _, repo := range repos {
+			if strings.HasPrefix(repo, ns+"/") {
+				filtered = append(filtered, repo)
+			}
+		}
+		repos = filtered
+	}
+
+	sort.Strings(repos)
+	uiPage(resp, "repositories", repos)
+}
+
+// uiTags lists all tags for a repository and image.
+func (r *Registry) uiTags(resp http.ResponseWriter, request Request) {
+	repo, image, err := request.RepositoryAndImage()
+	if err != nil {
+		ErrNameInvalid.Write(resp)
+		return
+	}
+
+	tags, err := r.storage.ListTags(repo, image)
+	if err != nil {
+		if errors.Is(err, errNameUnknown) {
+			ErrNameUnknown.Write(resp)
+			return
+		}
+		klog.Errorf("unable to list tags: %s", err)
+		ErrInternal(err).Write(resp)
+		return
+	}
+
+	sort.Strings(tags)
+	uiPage(resp, "tags", map[string]interface{}{
+		"Name": repo + "/" + image,
+		"Tags": tags,
+	})
+}
+
+// uiManifest shows the manifest a tag points to. Manifests are resolved exactly as they are
+// for pulls.
+func (r *Registry) uiManifest(resp http.ResponseWriter, request Request) {
+	repo, image, err := request.RepositoryAndImage()
+	if err != nil {
+		ErrNameInvalid.Write(resp)
+		return
+	}
+
+	man, rerr := r.manfhdr.resolve(request)
+	if rerr != nil {
+		rerr.Write(resp)
+		return
+	}
+
+	uiPage(resp, "manifest", map[string]interface{}{
+		"Name":        repo + "/" + image,
+		"Tag":         request.ManifestID(),
+		"Digest":      man.digest,
+		"ContentType": man.ctype,
+		"Size":        len(man.data),
+		"Content":     string(man.data),
+	})
+}
@@ -1,8 +1,13 @@
 package registry
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"os"
 	"path"
@@ -14,6 +19,23 @@ import (
 	"k8s.io/klog"
 )
 
+// validUploadID returns true if the provided upload id is composed only by letters, digits,
+// dashes and underscores and is at most 128 characters long. As upload ids are used to compose
+// file paths this protects us against path traversal.
+func validUploadID(id string) bool {
+	if len(id) == 0 || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
 // tmpFileWrapper wraps an os.File reference and provide tooling around deleting the temporary
 // file when a call to Close() is executed.
 type tmpFileWrapper struct {
@@ -28,37 +50,131 @@ func (t *tmpFileWrapper) Close() error {
 	return os.RemoveAll(t.File.Name())
 }
 
+// UploadDurability determines when uploaded content is flushed (fsync) to disk. Flushing
+// protects content the client has been told is stored from a host crash, at the cost of
+// write throughput.
+type UploadDurability int
+
+const (
+	// DurabilitySyncOnFinalize flushes blobs to disk before a finished upload is reported as
+	// stored. Chunks of uploads still in progress may be lost on a crash, in such case the
+	// client has to restart the upload. This is the default.
+	DurabilitySyncOnFinalize UploadDurability = iota
+	// DurabilityNone never flushes, leaving it to the operating system. Fastest, but blobs
+	// reported as stored may be lost or truncated on a crash.
+	DurabilityNone
+	// DurabilitySyncPerChunk flushes every chunk before acknowledging it, and every blob
+	// before reporting it as stored. Safest and slowest. Uploads are never kept in memory
+	// under this mode.
+	DurabilitySyncPerChunk
+)
+
 // UploadHandler handles the phisical storage
 type UploadHandler struct {
 	sync.Mutex
-	active  map[string]time.Time
-	basedir string
+	active    map[string]time.Time
+	sizes     map[string]int64
+	reserved  map[string]int64
+	owners    map[string]string
+	targets   map[string]string
+	smalls    map[string]bool
+	quota     int64
+	membufs   map[string]*bytes.Buffer
+	memthresh int
+	basedir   string
+	filemode  os.FileMode
+	dirmode   os.FileMode
+	draining  bool
+	idgen     func() string
+	events    *events
+	streamval bool
+	hashers   map[string]hash.Hash
+	chunks    map[string]int
+	maxchunks int
+	syncmode  UploadDurability
+	idle      time.Duration
+	touched   map[string]time.Time
+	busy      map[string]bool
+	now       func() time.Time
 }
 
 // clean remove dangling upload files from disk. Upload files are removed if their reference
-// is too old or non existent.
+// is too old or non existent. Failures are logged and reported to the event handler.
 func (u *UploadHandler) clean() {
+	for id, err := range u.collect() {
+		u.events.fireUploadCleanupFailed(id, err)
+	}
+}
+
+// gcBatchSize is the number of left over upload files inspected (and removed) at once while
+// holding the lock.
+const gcBatchSize = 100
+
+// collect removes expired and dangling upload files. Returns the upload ids whose files could
+// not be removed, indexed by id. The lock is held only while expired uploads are detected and
+// while each batch of left over files is inspected, the directory is read without holding it
+// so uploads are not starved when there are many files around.
+func (u *UploadHandler) collect() map[string]error {
+	failures := u.collectExpired()
+
+	files, err := os.ReadDir(u.basedir)
+	if err != nil {
+		klog.Errorf("unable to list upload files: %s", err)
+		return failures
+	}
+
+	var batch []os.DirEntry
+	for _, file := range files {
+		if !u.isUploadFile(file) {
+			continue
+		}
+
+		batch = append(batch, file)
+		if len(batch) < gcBatchSize {
+			continue
+		}
+
+		u.collectLeftOvers(batch, failures)
+		batch = nil
+	}
+
+	u.collectLeftOvers(batch, failures)
+	return failures
+}
+
+// collectExpired removes expired uploads. Returns the upload ids whose files could not be
+// removed, indexed by id.
+func (u *UploadHandler) collectExpired() map[string]error {
 	u.Lock()
 	defer u.Unlock()
 
-	for id, deadline := range u.active {
-		if deadline.After(time.Now()) {
+	failures := map[string]error{}
+	now := u.now()
+	for id := range u.active {
+		if !u.expired(id, now) {
 			continue
 		}
 
 		fpath := u.tmpFileForUpload(id)
 		if err := os.RemoveAll(fpath); err != nil {
 			klog.Errorf("unable to delete upload file: %s", err)
+			failures[id] = err
 		}
-		delete(u.active, id)
+		u.forget(id)
 	}
+	return failures
+}
 
-	files, err := os.ReadDir(u.basedir)
-	if err != nil {
-		klog.Errorf("unable to list upload files: %s", err)
+// collectLeftOvers removes the provided upload files if they do not belong to an active upload.
+// Failures are added to the provided map, indexed by upload id.
+func (u *UploadHandler) collectLeftOvers(files []os.DirEntry, failures map[string]error) {
+	if len(files) == 0 {
 		return
 	}
 
+	u.Lock()
+	defer u.Unlock()
+
 	for _, file := range files {
 		id := u.idForUploadFile(file.Name())
 		if _, ok := u.active[id]; ok {
@@ -68,22 +184,37 @@ func (u *UploadHandler) clean() {
 		fpath := fmt.Sprintf("%s/%s", u.basedir, file.Name())
 		if err := os.RemoveAll(fpath); err != nil {
 			klog.Errorf("unable to delete upload file: %s", err)
+			failures[id] = err
 		}
 	}
 }
 
 // gc collects inactive upload ids and deletes their underlying files as soon as they expire, gc
 // stands for garbage collection. This function also inspects the basedir for files that have no
-// more active references (left overs) and removes them.
+// more active references (left overs) and removes them. Runs every minute until the provided
+// context is done.
 func (u *UploadHandler) gc(ctx context.Context, wg *sync.WaitGroup) {
 	defer wg.Done()
 	ticker := time.NewTicker(time.Minute)
-	select {
-	case <-ctx.Done():
-		return
-	case <-ticker.C:
-		u.clean()
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			u.clean()
+		}
+	}
+}
+
+// isUploadFile returns true if the provided directory entry looks like an upload file, i.e. a
+// regular, non hidden, file with the .tmp extension. Anything else is left alone.
+func (u *UploadHandler) isUploadFile(entry os.DirEntry) bool {
+	name := entry.Name()
+	if !entry.Type().IsRegular() || strings.HasPrefix(name, ".") {
+		return false
 	}
+	return strings.HasSuffix(name, ".tmp")
 }
 
 // idForUploadFile returns the id for a given file. Files are named as <id>.tmp so this function
@@ -96,36 +227,148 @@ func (u *UploadHandler) idForUploadFile(fpath string) string {
 // Start creates an unique id for a given upload. This function must be called to allocate an
 // slot in our uploads database. As an argument caller must inform for how long they want to
 // keep the slot available, after this the slot is invalidated and any dangling content is
-// removed from the filesystem.
-func (u *UploadHandler) Start(deadline time.Duration) string {
+// removed from the filesystem. The client starting the upload is recorded so the per client
+// quota can be enforced, so is the repository and image the upload is meant for. Returns an
+// error if the handler is draining.
+func (u *UploadHandler) Start(deadline time.Duration, client, repo, image string) (string, error) {
+	u.Lock()
+	defer u.Unlock()
+
+	if u.draining {
+		return "", fmt.Errorf("upload handler is draining")
+	}
+
+	id := u.idgen()
+	if !validUploadID(id) {
+		return "", fmt.Errorf("invalid upload id generated: %q", id)
+	}
+
+	if _, ok := u.active[id]; ok {
+		return "", fmt.Errorf("upload id %q already in use", id)
+	}
+
+	if err := os.MkdirAll(u.basedir, u.dirmode); err != nil {
+		return "", fmt.Errorf("unable to create upload directory: %w", err)
+	}
+
+	now := u.now()
+	u.active[id] = now.Add(deadline)
+	u.touched[id] = now
+	u.owners[id] = client
+	u.targets[id] = path.Join(repo, image)
+	if u.memthresh > 0 && u.syncmode != DurabilitySyncPerChunk {
+		u.membufs[id] = bytes.NewBuffer(nil)
+	}
+	if u.streamval {
+		u.hashers[id] = sha256.New()
+	}
+	return id, nil
+}
+
+// Drain stops the handler from accepting new uploads. Uploads already in progress can still
+// receive data and be finalized.
+func (u *UploadHandler) Drain() {
+	u.Lock()
+	defer u.Unlock()
+	u.draining = true
+}
+
+// Active returns the number of uploads in progress (not expired), whether or not they are
+// receiving data at the moment.
+func (u *UploadHandler) Active() int {
 	u.Lock()
 	defer u.Unlock()
 
-	id := uuid.New().String()
-	u.active[id] = time.Now().Add(deadline)
-	return id
+	var count int
+	now := u.now()
+	for id := range u.active {
+		if !u.expired(id, now) {
+			count++
+		}
+	}
+	return count
 }
 
-// isValid checks if the provided upload id is still active (exists and is not expired).
+// waitDrained waits until there are no more active uploads or until the provided context is
+// done. Returns the number of uploads still active.
+func (u *UploadHandler) waitDrained(ctx context.Context) int {
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		active := u.Active()
+		if active == 0 {
+			return 0
+		}
+
+		select {
+		case <-ctx.Done():
+			return active
+		case <-ticker.C:
+		}
+	}
+}
+
+// errUploadUnknown is returned when referring to an upload id that is malformed, that does not
+// exist or that has expired.
+var errUploadUnknown = errors.New("unknown upload id")
+
+// isValid checks if the provided upload id is still active (exists and is not expired). The
+// returned error wraps errUploadUnknown. Expired uploads are removed on the spot.
 func (u *UploadHandler) isValid(id string) error {
-	if _, err := uuid.Parse(id); err != nil {
-		return fmt.Errorf("invalid upload id: %w", err)
+	if !validUploadID(id) {
+		return fmt.Errorf("%w: invalid format", errUploadUnknown)
 	}
 
 	u.Lock()
 	defer u.Unlock()
 
-	expire, ok := u.active[id]
-	if !ok {
-		return fmt.Errorf("unknown upload id")
+	if _, ok := u.active[id]; !ok {
+		return errUploadUnknown
 	}
 
-	if time.Now().After(expire) {
-		return fmt.Errorf("upload id expired")
+	if u.expired(id, u.now()) {
+		// no need to wait for the next gc run, the upload can't be used anymore.
+		if err := os.RemoveAll(u.tmpFileForUpload(id)); err != nil {
+			klog.Errorf("unable to delete expired upload file: %s", err)
+		}
+		u.forget(id)
+		return fmt.Errorf("%w: expired", errUploadUnknown)
 	}
 	return nil
 }
 
+// expired returns true if the upload went past its deadline or, if an idle timeout has been
+// set, if it hasn't received data for longer than the idle timeout. Uploads receiving data are
+// never idle. Caller must hold the lock.
+func (u *UploadHandler) expired(id string, now time.Time) bool {
+	if now.After(u.active[id]) {
+		return true
+	}
+
+	if u.idle <= 0 || u.busy[id] {
+		return false
+	}
+	return now.Sub(u.touched[id]) > u.idle
+}
+
+// touch records the upload has just received data and whether it is still receiving it.
+// Idle timeouts are measured from the last call.
+func (u *UploadHandler) touch(id string, busy bool) {
+	u.Lock()
+	defer u.Unlock()
+
+	if _, ok := u.active[id]; !ok {
+		return
+	}
+
+	u.touched[id] = u.now()
+	if busy {
+		u.busy[id] = true
+		return
+	}
+	delete(u.busy, id)
+}
+
 // tmpFileForUpload returns a tmp file path for the provided upload id.
 func (u *UploadHandler) tmpFileForUpload(id string) string {
 	return fmt.Sprintf("%s/%s.tmp", u.basedir, id)
@@ -138,19 +381,246 @@ func (u *UploadHandler) Delete(id string) {
 
 	fpath := u.tmpFileForUpload(id)
 	_ = os.RemoveAll(fpath)
+	u.forget(id)
+}
+
+// errQuotaExceeded is returned when an upload would take a client beyond its quota.
+var errQuotaExceeded = errors.New("upload quota exceeded")
+
+// quotaReader reserves quota for an upload as data is read for it. Reads fail once the upload
+// owner runs out of quota. Reservations are made under the upload handler lock so concurrent
+// uploads of the same owner can't take it beyond its quota.
+type quotaReader struct {
+	io.Reader
+	uploads *UploadHandler
+	id      string
+}
+
+// Read reads from the underlying reader, returns errQuotaExceeded if the quota is exceeded.
+func (q *quotaReader) Read(p []byte) (int, error) {
+	if left := q.uploads.quotaLeft(q.id); int64(len(p)) > left+1 {
+		p = p[:left+1]
+	}
+
+	read, err := q.Reader.Read(p)
+	if !q.uploads.reserve(q.id, int64(read)) {
+		return read, errQuotaExceeded
+	}
+	return read, err
+}
+
+// clientReader reads from a client request body and fails reads once the provided context is
+// done. Keeps the first error returned so we can tell the client went away, as opposed to
+// failures happening on our side.
+type clientReader struct {
+	io.Reader
+	ctx context.Context
+	err error
+}
+
+// Read reads from the underlying reader unless the context is done.
+func (c *clientReader) Read(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	if err := c.ctx.Err(); err != nil {
+		c.err = err
+		return 0, err
+	}
+
+	read, err := c.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		c.err = err
+	}
+	return read, err
+}
+
+// forget removes all references to the provided upload id. Caller must hold the lock.
+func (u *UploadHandler) forget(id string) {
 	delete(u.active, id)
+	delete(u.sizes, id)
+	delete(u.reserved, id)
+	delete(u.owners, id)
+	delete(u.targets, id)
+	delete(u.smalls, id)
+	delete(u.membufs, id)
+	delete(u.hashers, id)
+	delete(u.chunks, id)
+	delete(u.touched, id)
+	delete(u.busy, id)
 }
 
-// Append appends the provided Reader to the underlying upload under the provide id. Returns
-// the amount of written bytes or an error. In case of error the underlying upload for the
-// provided id may be left in an unknown state.
-func (u *UploadHandler) Append(id string, from io.Reader) (int64, error) {
-	if err := u.isValid(id); err != nil {
-		return 0, fmt.Errorf("unable to append to upload: %w", err)
+// belongsTo returns false if the upload was started for a repository and image other than the
+// provided ones. Unknown uploads are not judged here, see isValid.
+func (u *UploadHandler) belongsTo(id, repo, image string) bool {
+	u.Lock()
+	defer u.Unlock()
+	target, ok := u.targets[id]
+	return !ok || target == path.Join(repo, image)
+}
+
+// smallChunk records that the upload received a chunk smaller than the minimum chunk size.
+// Returns true if the upload had already received one. Nothing is recorded for uploads not
+// active.
+func (u *UploadHandler) smallChunk(id string) bool {
+	u.Lock()
+	defer u.Unlock()
+
+	if _, ok := u.active[id]; !ok {
+		return false
 	}
 
+	if u.smalls[id] {
+		return true
+	}
+	u.smalls[id] = true
+	return false
+}
+
+// chunk records that the upload received a chunk. Returns false if the upload had already
+// received the maximum number of chunks. Nothing is recorded for uploads not active.
+func (u *UploadHandler) chunk(id string) bool {
+	u.Lock()
+	defer u.Unlock()
+
+	if _, ok := u.active[id]; !ok {
+		return true
+	}
+
+	if u.chunks[id] >= u.maxchunks {
+		return false
+	}
+	u.chunks[id]++
+	return true
+}
+
+// usage returns the amount of bytes held, or reserved by appends in progress, by all uploads
+// in progress for the provided client. Caller must hold the lock.
+func (u *UploadHandler) usage(client string) int64 {
+	var total int64
+	for id, owner := range u.owners {
+		if owner == client {
+			total += u.sizes[id] + u.reserved[id]
+		}
+	}
+	return total
+}
+
+// reserve reserves quota for an append in progress to the provided upload. Returns false,
+// reserving nothing, if the reservation would take the upload owner beyond its quota.
+// Reservations are released once the append is committed or rolled back.
+func (u *UploadHandler) reserve(id string, size int64) bool {
+	u.Lock()
+	defer u.Unlock()
+
+	if u.usage(u.owners[id])+size > u.quota {
+		return false
+	}
+	u.reserved[id] += size
+	return true
+}
+
+// quotaLeft returns how many bytes the owner of the provided upload can still upload. Returns
+// -1 if there is no quota in place.
+func (u *UploadHandler) quotaLeft(id string) int64 {
+	if u.quota <= 0 {
+		return -1
+	}
+
+	u.Lock()
+	defer u.Unlock()
+
+	left := u.quota - u.usage(u.owners[id])
+	if left < 0 {
+		return 0
+	}
+	return left
+}
+
+// Size returns the amount of bytes uploaded so far, over all chunks, for the provided upload.
+func (u *UploadHandler) Size(id string) int64 {
+	u.Lock()
+	defer u.Unlock()
+	return u.sizes[id]
+}
+
+// hasher returns the running hash for the provided upload id. Returns nil if uploads are not
+// being hashed as they arrive or if the hash has been invalidated by a failed append.
+func (u *UploadHandler) hasher(id string) hash.Hash {
+	u.Lock()
+	defer u.Unlock()
+	return u.hashers[id]
+}
+
+// Digest returns the digest of the content uploaded so far, over all chunks, for the provided
+// upload. Returns false if uploads are not being hashed as they arrive, see
+// WithBlobStreamValidation, or if a failed append made the running hash unreliable.
+func (u *UploadHandler) Digest(id string) (string, bool) {
+	hasher := u.hasher(id)
+	if hasher == nil {
+		return "", false
+	}
+	return digestFromHash(hasher).String(), true
+}
+
+// memBuffer returns the in memory buffer for the provided upload id. Returns nil if the upload
+// is not being kept in memory.
+func (u *UploadHandler) memBuffer(id string) *bytes.Buffer {
+	u.Lock()
+	defer u.Unlock()
+	return u.membufs[id]
+}
+
+// appendToMemory appends the provided Reader to the in memory buffer for the upload. Data is
+// read into a chunk of its own and only copied into the shared buffer, under the lock, once
+// read. If the buffer grows beyond the configured threshold its content is spilled into the
+// upload temp file and the upload continues on disk.
+func (u *UploadHandler) appendToMemory(id string, buf *bytes.Buffer, from io.Reader) (int64, error) {
+	u.Lock()
+	room := int64(u.memthresh - buf.Len())
+	u.Unlock()
+
+	chunk := bytes.NewBuffer(nil)
+	written, err := io.CopyN(chunk, from, room+1)
+	if err != nil && err != io.EOF {
+		return 0, fmt.Errorf("unable to copy data: %w", err)
+	}
+
+	u.Lock()
+	if _, ok := u.active[id]; !ok {
+		u.Unlock()
+		return 0, errUploadUnknown
+	}
+
+	if u.membufs[id] != buf {
+		// spilled to disk by a concurrent append, continue there.
+		u.Unlock()
+		return u.appendToFile(id, io.MultiReader(chunk, from))
+	}
+
+	if err == io.EOF && buf.Len()+chunk.Len() <= u.memthresh {
+		buf.Write(chunk.Bytes())
+		u.Unlock()
+		return written, nil
+	}
+	delete(u.membufs, id)
+	u.Unlock()
+
+	// the buffer can't be reached through the upload anymore, it is safe to read it unlocked.
+	buffered := int64(buf.Len())
+	spilled, err := u.appendToFile(id, io.MultiReader(buf, chunk, from))
+	if err != nil {
+		return 0, err
+	}
+	return spilled - buffered, nil
+}
+
+// appendToFile appends the provided Reader to the upload temp file. The file is flushed to disk
+// if running under DurabilitySyncPerChunk.
+func (u *UploadHandler) appendToFile(id string, from io.Reader) (int64, error) {
 	fpath := u.tmpFileForUpload(id)
-	fp, err := os.OpenFile(fpath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	fp, err := os.OpenFile(fpath, os.O_CREATE|os.O_RDWR|os.O_APPEND, u.filemode)
 	if err != nil {
 		return 0, fmt.Errorf("unable to append to storage: %w", err)
 	}
@@ -160,15 +630,122 @@ func (u *UploadHandler) Append(id string, from io.Reader) (int64, error) {
 	if err != nil {
 		return 0, fmt.Errorf("unable to copy data: %w", err)
 	}
+
+	if u.syncmode == DurabilitySyncPerChunk {
+		if err := fp.Sync(); err != nil {
+			return 0, fmt.Errorf("unable to sync upload file: %w", err)
+		}
+	}
 	return written, nil
 }
 
+// Append appends the provided Reader to the underlying upload under the provide id. Returns
+// the amount of written bytes or an error. If the append fails, e.g. because the client went
+// away and the context has been cancelled, whatever it wrote is discarded and the upload is
+// kept as it was before so the client can resume it from its last committed size.
+func (u *UploadHandler) Append(ctx context.Context, id string, from io.Reader) (int64, error) {
+	if err := u.isValid(id); err != nil {
+		return 0, fmt.Errorf("unable to append to upload: %w", err)
+	}
+
+	u.touch(id, true)
+	defer u.touch(id, false)
+
+	client := &clientReader{Reader: from, ctx: ctx}
+	from = client
+
+	if u.quota > 0 {
+		from = &quotaReader{Reader: from, uploads: u, id: id}
+	}
+
+	hasher := u.hasher(id)
+	var state []byte
+	if hasher != nil {
+		state = hashState(hasher)
+		from = io.TeeReader(from, hasher)
+	}
+
+	var written int64
+	var err error
+	if buf := u.memBuffer(id); buf != nil {
+		written, err = u.appendToMemory(id, buf, from)
+	} else {
+		written, err = u.appendToFile(id, from)
+	}
+	if err != nil {
+		if client.err != nil {
+			klog.Infof("upload %s interrupted, discarding the chunk: %s", id, client.err)
+		}
+		if rerr := u.rollback(id, state); rerr != nil {
+			klog.Errorf("unable to roll upload %s back, discarding it: %s", id, rerr)
+			u.Delete(id)
+		}
+		return 0, err
+	}
+
+	u.Lock()
+	u.sizes[id] += written
+	delete(u.reserved, id)
+	u.Unlock()
+	return written, nil
+}
+
+// hashState returns the marshaled state of the provided running hash. Returns nil if the hash
+// state can't be marshaled.
+func hashState(hasher hash.Hash) []byte {
+	marshaler, ok := hasher.(encoding.BinaryMarshaler)
+	if !ok {
+		return nil
+	}
+
+	state, err := marshaler.MarshalBinary()
+	if err != nil {
+		return nil
+	}
+	return state
+}
+
+// rollback discards everything written to the upload beyond its committed size, releasing the
+// quota reserved for it, and restores its running hash to the provided state. If the state is
+// nil the running hash is dropped, see Digest. Uploads kept in memory may have been spilled to
+// disk by the failed append, in such case the upload continues on disk.
+func (u *UploadHandler) rollback(id string, state []byte) error {
+	u.Lock()
+	defer u.Unlock()
+
+	delete(u.reserved, id)
+	size := u.sizes[id]
+	if buf, ok := u.membufs[id]; ok {
+		buf.Truncate(int(size))
+	} else if err := os.Truncate(u.tmpFileForUpload(id), size); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("unable to truncate upload file: %w", err)
+	}
+
+	hasher, ok := u.hashers[id]
+	if !ok {
+		return nil
+	}
+
+	unmarshaler, ok := hasher.(encoding.BinaryUnmarshaler)
+	if state == nil || !ok || unmarshaler.UnmarshalBinary(state) != nil {
+		delete(u.hashers, id)
+	}
+	return nil
+}
+
 // End ends the upload identified by the provided id. Returns a ReadCloser from where the upload
 // content can be read. If no error is returned then the upload with the provided id becomes not
 // active. It is responsibility of the caller to call Close() on returned Closer.
 func (u *UploadHandler) End(id string) (io.ReadCloser, error) {
 	if err := u.isValid(id); err != nil {
-		return nil, fmt.Errorf("unable to append to upload: %w", err)
+		return nil, fmt.Errorf("unable to end upload: %w", err)
+	}
+
+	if buf := u.memBuffer(id); buf != nil {
+		u.Lock()
+		u.forget(id)
+		u.Unlock()
+		return io.NopCloser(buf), nil
 	}
 
 	fpath := u.tmpFileForUpload(id)
@@ -178,18 +755,51 @@ func (u *UploadHandler) End(id string) (io.ReadCloser, error) {
 	}
 
 	u.Lock()
-	delete(u.active, id)
+	u.forget(id)
 	u.Unlock()
 
 	return &tmpFileWrapper{fp}, nil
 }
 
+// spoolFile creates a temporary file, in the upload directory, for content too large to be
+// kept in memory that is not part of an upload (e.g. large manifests). The file is removed
+// when closed, if the process dies before that the file is collected as a left over. Files are
+// only accessed through the returned descriptor so gc unlinking them while in use is harmless.
+func (u *UploadHandler) spoolFile() (*tmpFileWrapper, error) {
+	if err := os.MkdirAll(u.basedir, u.dirmode); err != nil {
+		return nil, fmt.Errorf("unable to create upload directory: %w", err)
+	}
+
+	fp, err := os.CreateTemp(u.basedir, "spool-*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create spool file: %w", err)
+	}
+	return &tmpFileWrapper{fp}, nil
+}
+
 // NewUploadHandler returns a new storage handler. This storage handler is used to store upload
 // content into temporary files in local filesystem.
 func NewUploadHandler() *UploadHandler {
 	u := &UploadHandler{
-		active:  map[string]time.Time{},
-		basedir: "/tmp/uploads",
+		active:    map[string]time.Time{},
+		sizes:     map[string]int64{},
+		reserved:  map[string]int64{},
+		owners:    map[string]string{},
+		targets:   map[string]string{},
+		smalls:    map[string]bool{},
+		membufs:   map[string]*bytes.Buffer{},
+		hashers:   map[string]hash.Hash{},
+		chunks:    map[string]int{},
+		touched:   map[string]time.Time{},
+		busy:      map[string]bool{},
+		basedir:   tmpUploadDir,
+		filemode:  0644,
+		dirmode:   0755,
+		maxchunks: 10000,
+		idgen: func() string {
+			return uuid.New().String()
+		},
+		now: time.Now,
 	}
 	return u
 }
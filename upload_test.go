@@ -0,0 +1,471 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+// newTestUploads returns an UploadHandler keeping its uploads in a temporary directory.
+func newTestUploads(t *testing.T) *UploadHandler {
+	t.Helper()
+	uploads := NewUploadHandler()
+	uploads.basedir = t.TempDir()
+	return uploads
+}
+
+// cancelReader returns its content in a single read and cancels the context right after, as a
+// client going away in the middle of a request would.
+type cancelReader struct {
+	content []byte
+	cancel  context.CancelFunc
+}
+
+// Read returns the content and cancels the context. Reads after that block for a while, the
+// reader in front of it is expected to notice the cancellation first.
+func (c *cancelReader) Read(p []byte) (int, error) {
+	if c.content == nil {
+		time.Sleep(time.Second)
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	read := copy(p, c.content)
+	c.content = nil
+	c.cancel()
+	return read, nil
+}
+
+func TestAppendInterrupted(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		memthresh int
+	}{
+		{name: "on disk"},
+		{name: "in memory", memthresh: 1024},
+		{name: "spilled to disk", memthresh: 16},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			uploads := newTestUploads(t)
+			uploads.memthresh = tt.memthresh
+			uploads.streamval = true
+
+			id, err := uploads.Start(time.Hour, "client", "repo", "image")
+			if err != nil {
+				t.Fatalf("unable to start upload: %s", err)
+			}
+
+			committed := []byte("0123456789")
+			if _, err := uploads.Append(context.Background(), id, bytes.NewReader(committed)); err != nil {
+				t.Fatalf("unable to append: %s", err)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			partial := &cancelReader{content: []byte("partial chunk never finished"), cancel: cancel}
+			start := time.Now()
+			if _, err := uploads.Append(ctx, id, partial); !errors.Is(err, context.Canceled) {
+				t.Fatalf("expected the append to be cancelled, got %v", err)
+			}
+
+			if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+				t.Errorf("cancelled append took %s", elapsed)
+			}
+
+			if size := uploads.Size(id); size != int64(len(committed)) {
+				t.Errorf("expected upload size %d, got %d", len(committed), size)
+			}
+
+			finfo, err := os.Stat(uploads.tmpFileForUpload(id))
+			if err == nil && finfo.Size() != int64(len(committed)) {
+				t.Errorf("expected upload file size %d, got %d", len(committed), finfo.Size())
+			} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+				t.Fatalf("unable to stat upload file: %s", err)
+			}
+
+			rest := []byte("abcdefghij")
+			if _, err := uploads.Append(context.Background(), id, bytes.NewReader(rest)); err != nil {
+				t.Fatalf("unable to resume upload: %s", err)
+			}
+
+			content := append(committed, rest...)
+			if dgst, ok := uploads.Digest(id); !ok || dgst != DigestOf(content).String() {
+				t.Errorf("unexpected running digest %q (%v)", dgst, ok)
+			}
+
+			fp, err := uploads.End(id)
+			if err != nil {
+				t.Fatalf("unable to end upload: %s", err)
+			}
+			defer fp.Close()
+
+			data, err := io.ReadAll(fp)
+			if err != nil {
+				t.Fatalf("unable to read upload: %s", err)
+			}
+
+			if string(data) != string(content) {
+				t.Errorf("expected upload content %q, got %q", content, data)
+			}
+		})
+	}
+}
+
+// heldReader returns its content and then blocks until released. If set, drained is closed
+// once the content has been read.
+type heldReader struct {
+	content []byte
+	release chan struct{}
+	drained chan struct{}
+}
+
+// Read returns the content, once drained it waits for the release before returning io.EOF.
+func (h *heldReader) Read(p []byte) (int, error) {
+	if len(h.content) > 0 {
+		read := copy(p, h.content)
+		h.content = h.content[read:]
+		return read, nil
+	}
+	if h.drained != nil {
+		close(h.drained)
+		h.drained = nil
+	}
+	<-h.release
+	return 0, io.EOF
+}
+
+func TestAppendQuotaConcurrent(t *testing.T) {
+	uploads := newTestUploads(t)
+	uploads.quota = 100
+
+	first, err := uploads.Start(time.Hour, "client", "repo", "image")
+	if err != nil {
+		t.Fatalf("unable to start upload: %s", err)
+	}
+
+	second, err := uploads.Start(time.Hour, "client", "repo", "image")
+	if err != nil {
+		t.Fatalf("unable to start upload: %s", err)
+	}
+
+	held := &heldReader{content: bytes.Repeat([]byte("a"), 80), release: make(chan struct{})}
+	done := make(chan error)
+	go func() {
+		_, err := uploads.Append(context.Background(), first, held)
+		done <- err
+	}()
+
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		uploads.Lock()
+		reserved := uploads.reserved[first]
+		uploads.Unlock()
+		if reserved == 80 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("first append never reserved its quota, reserved %d", reserved)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	content := bytes.Repeat([]byte("b"), 80)
+	if _, err := uploads.Append(context.Background(), second, bytes.NewReader(content)); !errors.Is(err, errQuotaExceeded) {
+		t.Errorf("expected the concurrent append to exceed the quota, got %v", err)
+	}
+
+	if size := uploads.Size(second); size != 0 {
+		t.Errorf("expected the refused upload to be empty, got %d bytes", size)
+	}
+
+	if finfo, err := os.Stat(uploads.tmpFileForUpload(second)); err == nil && finfo.Size() != 0 {
+		t.Errorf("refused upload left %d bytes on disk", finfo.Size())
+	}
+
+	close(held.release)
+	if err := <-done; err != nil {
+		t.Fatalf("first append failed: %s", err)
+	}
+
+	if size := uploads.Size(first); size != 80 {
+		t.Errorf("expected 80 bytes in the first upload, got %d", size)
+	}
+
+	if _, err := uploads.Append(context.Background(), second, bytes.NewReader(content[:20])); err != nil {
+		t.Errorf("append within the quota failed: %s", err)
+	}
+}
+
+func TestAppendToMemoryEnded(t *testing.T) {
+	uploads := newTestUploads(t)
+	uploads.memthresh = 1024
+
+	id, err := uploads.Start(time.Hour, "client", "repo", "image")
+	if err != nil {
+		t.Fatalf("unable to start upload: %s", err)
+	}
+
+	drained := make(chan struct{})
+	held := &heldReader{
+		content: []byte("chunk"),
+		release: make(chan struct{}),
+		drained: drained,
+	}
+	done := make(chan error)
+	go func() {
+		_, err := uploads.Append(context.Background(), id, held)
+		done <- err
+	}()
+	<-drained
+
+	fp, err := uploads.End(id)
+	if err != nil {
+		t.Fatalf("unable to end upload: %s", err)
+	}
+	defer fp.Close()
+
+	close(held.release)
+	if err := <-done; !errors.Is(err, errUploadUnknown) {
+		t.Errorf("expected the append to an ended upload to fail, got %v", err)
+	}
+
+	data, err := io.ReadAll(fp)
+	if err != nil {
+		t.Fatalf("unable to read upload: %s", err)
+	}
+
+	if len(data) != 0 {
+		t.Errorf("append landed on an ended upload: %q", data)
+	}
+}
+
+func TestWaitDrained(t *testing.T) {
+	uploads := newTestUploads(t)
+
+	id, err := uploads.Start(time.Hour, "client", "repo", "image")
+	if err != nil {
+		t.Fatalf("unable to start upload: %s", err)
+	}
+
+	uploads.Drain()
+	if _, err := uploads.Start(time.Hour, "client", "repo", "image"); err == nil {
+		t.Error("draining handler accepted a new upload")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if active := uploads.waitDrained(ctx); active != 1 {
+		t.Errorf("expected the idle upload session to be waited for, got %d", active)
+	}
+
+	if _, err := uploads.Append(context.Background(), id, bytes.NewReader([]byte("data"))); err != nil {
+		t.Errorf("unable to append while draining: %s", err)
+	}
+
+	uploads.Delete(id)
+	ctx, cancel = context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	start := time.Now()
+	if active := uploads.waitDrained(ctx); active != 0 {
+		t.Errorf("expected no active uploads, got %d", active)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("waited %s once no upload was left", elapsed)
+	}
+}
+
+// BenchmarkCollect runs the upload garbage collection over thousands of upload files while
+// another goroutine keeps using the handler, reporting the longest the latter waited for the
+// lock.
+func BenchmarkCollect(b *testing.B) {
+	uploads := NewUploadHandler()
+	uploads.basedir = b.TempDir()
+
+	var id string
+	for i := 0; i < 5000; i++ {
+		var err error
+		if id, err = uploads.Start(time.Hour, "client", "repo", "image"); err != nil {
+			b.Fatalf("unable to start upload: %s", err)
+		}
+
+		if err := os.WriteFile(uploads.tmpFileForUpload(id), nil, 0600); err != nil {
+			b.Fatalf("unable to create upload file: %s", err)
+		}
+	}
+
+	var longest time.Duration
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		done := make(chan struct{})
+		go func() {
+			uploads.collect()
+			close(done)
+		}()
+
+		for running := true; running; {
+			select {
+			case <-done:
+				running = false
+			default:
+			}
+
+			start := time.Now()
+			uploads.Size(id)
+			if waited := time.Since(start); waited > longest {
+				longest = waited
+			}
+		}
+	}
+	b.ReportMetric(float64(longest.Microseconds()), "max-lock-wait-us")
+}
+
+func TestExpiredUploadRemovedOnAccess(t *testing.T) {
+	uploads := newTestUploads(t)
+
+	id, err := uploads.Start(time.Hour, "client", "repo", "image")
+	if err != nil {
+		t.Fatalf("unable to start upload: %s", err)
+	}
+
+	if _, err := uploads.Append(context.Background(), id, bytes.NewReader([]byte("data"))); err != nil {
+		t.Fatalf("unable to append: %s", err)
+	}
+
+	uploads.Lock()
+	uploads.active[id] = time.Now().Add(-time.Second)
+	uploads.Unlock()
+
+	if _, err := uploads.Append(context.Background(), id, bytes.NewReader([]byte("more"))); !errors.Is(err, errUploadUnknown) {
+		t.Fatalf("expected an unknown upload error, got %v", err)
+	}
+
+	if _, err := os.Stat(uploads.tmpFileForUpload(id)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expired upload file still around: %v", err)
+	}
+
+	uploads.Lock()
+	defer uploads.Unlock()
+	if _, ok := uploads.active[id]; ok {
+		t.Error("expired upload still active")
+	}
+
+	if _, ok := uploads.sizes[id]; ok {
+		t.Error("expired upload size still recorded")
+	}
+}
+
+// fakeClock is a clock that only moves when told so.
+type fakeClock struct {
+	now time.Time
+}
+
+// Now returns the current fake time.
+func (f *fakeClock) Now() time.Time {
+	return f.now
+}
+
+// Advance moves the clock forward.
+func (f *fakeClock) Advance(d time.Duration) {
+	f.now = f.now.Add(d)
+}
+
+func TestUploadTimeouts(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		deadline time.Duration
+		idle     time.Duration
+		steps    []time.Duration
+		expires  int
+	}{
+		{
+			name:     "deadline without idle timeout",
+			deadline: 10 * time.Minute,
+			steps:    []time.Duration{5 * time.Minute, 4 * time.Minute, 2 * time.Minute},
+			expires:  2,
+		},
+		{
+			name:     "idle timeout",
+			deadline: time.Hour,
+			idle:     time.Minute,
+			steps:    []time.Duration{50 * time.Second, 50 * time.Second, 61 * time.Second},
+			expires:  2,
+		},
+		{
+			name:     "deadline reached by an upload never idle",
+			deadline: 2 * time.Minute,
+			idle:     time.Minute,
+			steps:    []time.Duration{50 * time.Second, 50 * time.Second, 50 * time.Second},
+			expires:  2,
+		},
+		{
+			name:     "paused upload resumed within the idle timeout",
+			deadline: time.Hour,
+			idle:     10 * time.Minute,
+			steps:    []time.Duration{9 * time.Minute, 9 * time.Minute, 9 * time.Minute},
+			expires:  -1,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := &fakeClock{now: time.Now()}
+			uploads := newTestUploads(t)
+			uploads.now = clock.Now
+			uploads.idle = tt.idle
+
+			id, err := uploads.Start(tt.deadline, "client", "repo", "image")
+			if err != nil {
+				t.Fatalf("unable to start upload: %s", err)
+			}
+
+			for i, step := range tt.steps {
+				clock.Advance(step)
+				_, err := uploads.Append(context.Background(), id, bytes.NewReader([]byte("data")))
+				if i == tt.expires {
+					if !errors.Is(err, errUploadUnknown) {
+						t.Fatalf("step %d: expected the upload to expire, got %v", i, err)
+					}
+					return
+				}
+
+				if err != nil {
+					t.Fatalf("step %d: unable to append: %s", i, err)
+				}
+			}
+
+			if tt.expires >= 0 {
+				t.Fatal("upload never expired")
+			}
+		})
+	}
+}
+
+func TestUploadIdleCollected(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	uploads := newTestUploads(t)
+	uploads.now = clock.Now
+	uploads.idle = time.Minute
+
+	idle, err := uploads.Start(time.Hour, "client", "repo", "image")
+	if err != nil {
+		t.Fatalf("unable to start upload: %s", err)
+	}
+
+	clock.Advance(30 * time.Second)
+	fresh, err := uploads.Start(time.Hour, "client", "repo", "image")
+	if err != nil {
+		t.Fatalf("unable to start upload: %s", err)
+	}
+
+	clock.Advance(31 * time.Second)
+	uploads.collect()
+
+	if err := uploads.isValid(idle); !errors.Is(err, errUploadUnknown) {
+		t.Errorf("idle upload not collected: %v", err)
+	}
+
+	if err := uploads.isValid(fresh); err != nil {
+		t.Errorf("fresh upload collected: %s", err)
+	}
+}